@@ -5,9 +5,12 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
 	"github.com/maruel/subcommands"
 )
 
@@ -32,10 +35,19 @@ type archiveRun struct {
 }
 
 func (c *archiveRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
 	if err := c.commonServerFlags.Parse(); err != nil {
 		return err
 	}
-	if err := c.isolateFlags.Parse(); err != nil {
+	if err := c.isolateFlags.Parse("."); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolateFile(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolatedFile(); err != nil {
 		return err
 	}
 	if len(args) != 0 {
@@ -45,18 +57,41 @@ func (c *archiveRun) Parse(a subcommands.Application, args []string) error {
 }
 
 func (c *archiveRun) main(a subcommands.Application, args []string) error {
-	fmt.Printf("Server:    %s\n", c.serverURL)
-	fmt.Printf("Namespace: %s\n", c.namespace)
-	fmt.Printf("Isolate:   %s\n", c.Isolate)
-	fmt.Printf("Isolated:  %s\n", c.Isolated)
-	fmt.Printf("Blacklist: %s\n", c.Blacklist)
-	fmt.Printf("Config:    %s\n", c.ConfigVariables)
-	fmt.Printf("Path:      %s\n", c.PathVariables)
-	fmt.Printf("Extra:     %s\n", c.ExtraVariables)
-	return errors.New("TODO")
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	common.Infof("Server:    %s", c.serverURL)
+	common.Infof("Namespace: %s", c.namespace)
+	common.Infof("Isolate:   %s", c.Isolate)
+	common.Infof("Isolated:  %s", c.Isolated)
+	common.Infof("Blacklist: %s", c.Blacklist)
+	common.Infof("Config:    %s", c.ConfigVariables)
+	common.Infof("Path:      %s", c.PathVariables)
+	common.Infof("Extra:     %s", c.ExtraVariables)
+	tree := isolate.Tree{
+		Cwd:  ".",
+		Opts: c.ArchiveOptions,
+	}
+	client, err := c.createAuthClient()
+	if err != nil {
+		return err
+	}
+	p := c.startProgress(a.GetErr())
+	hashes, stats, err := isolate.IsolateAndArchive(ctx, client, []isolate.Tree{tree}, c.namespace, c.serverURL, c.concurrency, p)
+	p.Stop()
+	if err2 := c.dumpStats(stats); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	for name, digest := range hashes {
+		fmt.Fprintf(a.GetOut(), "%s  %s\n", digest, name)
+	}
+	return nil
 }
 
 func (c *archiveRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
 	if err := c.Parse(a, args); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
@@ -0,0 +1,53 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/luci/luci-go/client/isolateserver/localserver"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestArchiveLocalServer archives a tree to a local isolate server through
+// the command line flags, like an offline workflow would.
+func TestArchiveLocalServer(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+	s, err := localserver.New(filepath.Join(td, "store"))
+	assert.NoError(t, err)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	isolatePath := filepath.Join(td, "foo.isolate")
+	assert.NoError(t, ioutil.WriteFile(isolatePath, []byte(`{'variables': {'files': ['data']}}`), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(td, "data"), []byte("data"), 0600))
+	isolated := filepath.Join(td, "foo.isolated")
+
+	args := []string{"-isolate-server", ts.URL, "-namespace", "default-gzip", "-no-progress",
+		"-isolate", isolatePath, "-isolated", isolated}
+	r := cmdArchive.CommandRun()
+	assert.NoError(t, r.GetFlags().Parse(args))
+	assert.Equal(t, 0, r.Run(application, r.GetFlags().Args()))
+
+	// The .isolated file and its content are on the server.
+	content, err := ioutil.ReadFile(isolated)
+	assert.NoError(t, err)
+	items := []*isolateserver.DigestItem{
+		{Digest: isolateserver.Hash(sha1.New(), content), Size: int64(len(content))},
+		{Digest: isolateserver.Hash(sha1.New(), []byte("data")), Size: 4},
+	}
+	client := isolateserver.New(nil, ts.URL, "default-gzip", "sha-1", "flate")
+	states, err := client.Contains(context.Background(), items)
+	assert.NoError(t, err)
+	assert.Equal(t, []*isolateserver.PushState{nil, nil}, states)
+}
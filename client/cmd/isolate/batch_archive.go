@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"strings"
@@ -36,7 +37,8 @@ isolate. Format of files is:
 		c.commonFlags.Init(&c.CommandRunBase)
 		c.commonServerFlags.Init(&c.CommandRunBase)
 		c.Flags.StringVar(&c.dumpJson, "dump-json", "",
-			"Write isolated Digestes of archived trees to this file as JSON")
+			"Write isolated Digestes of archived trees to this file as JSON; "+
+				"it is only written once all the trees are archived")
 		return &c
 	},
 }
@@ -49,6 +51,9 @@ type batchArchiveRun struct {
 }
 
 func (c *batchArchiveRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
 	if err := c.commonServerFlags.Parse(); err != nil {
 		return err
 	}
@@ -72,7 +77,7 @@ func parseArchiveCMD(args []string, cwd string) (*isolate.ArchiveOptions, error)
 	if err := base.GetFlags().Parse(args); err != nil {
 		return nil, err
 	}
-	if err := i.Parse(); err != nil {
+	if err := i.Parse(cwd); err != nil {
 		return nil, err
 	}
 	if base.GetFlags().NArg() > 0 {
@@ -85,7 +90,7 @@ func parseArchiveCMD(args []string, cwd string) (*isolate.ArchiveOptions, error)
 // Essentially converts "--X key value" into "--X key=value".
 func convertPyToGoArchiveCMDArgs(args []string) []string {
 	kvars := map[string]bool{
-		"--path-variable": true, "--config-variable": true, "--extra-vriable": true}
+		"--path-variable": true, "--config-variable": true, "--extra-variable": true}
 	newArgs := []string{}
 	for i := 0; i < len(args); {
 		newArgs = append(newArgs, args[i])
@@ -111,6 +116,8 @@ func convertPyToGoArchiveCMDArgs(args []string) []string {
 }
 
 func (c *batchArchiveRun) main(a subcommands.Application, args []string) error {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
 	trees := []isolate.Tree{}
 	for _, genJsonPath := range args {
 		data := &struct {
@@ -130,21 +137,30 @@ func (c *batchArchiveRun) main(a subcommands.Application, args []string) error {
 		if opts, err := parseArchiveCMD(data.Args, data.Dir); err != nil {
 			return fmt.Errorf("Invalid archive command in %s: %s", genJsonPath, err)
 		} else {
-			trees = append(trees, isolate.Tree{data.Dir, *opts})
+			trees = append(trees, isolate.Tree{Cwd: data.Dir, Opts: *opts})
 		}
 	}
-	isolatedHashes, err := isolate.IsolateAndArchive(trees, c.serverURL, c.namespace)
-	if err != nil && c.dumpJson != "" {
-		if isolatedHashes != nil {
-			return common.WriteJSONFile(c.dumpJson, isolatedHashes)
-		} else {
-			return common.WriteJSONFile(c.dumpJson, make(map[string]string))
-		}
+	client, err := c.createAuthClient()
+	if err != nil {
+		return err
 	}
-	return err
+	p := c.startProgress(a.GetErr())
+	isolatedHashes, stats, err := isolate.IsolateAndArchive(ctx, client, trees, c.namespace, c.serverURL, c.concurrency, p)
+	p.Stop()
+	if err2 := c.dumpStats(stats); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	if c.dumpJson != "" {
+		return common.WriteJSONFile(c.dumpJson, isolatedHashes)
+	}
+	return nil
 }
 
 func (c *batchArchiveRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
 	if err := c.Parse(a, args); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
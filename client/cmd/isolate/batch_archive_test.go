@@ -5,10 +5,19 @@
 package main
 
 import (
+	"crypto/sha1"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/luci/luci-go/client/isolateserver/localserver"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -38,6 +47,10 @@ func TestConvertPyToGoArchiveCMDArgs(t *testing.T) {
 			[]string{"--path-variable", "key", "value", "posarg"},
 			[]string{"--path-variable", "key=value", "posarg"},
 		},
+		{
+			[]string{"--extra-variable", "EXECUTABLE_SUFFIX", ".exe"},
+			[]string{"--extra-variable", "EXECUTABLE_SUFFIX=.exe"},
+		},
 		// Too few args are just ignored.
 		{
 			[]string{"--path-variable"},
@@ -63,3 +76,50 @@ func TestArchiveCMDParsing(t *testing.T) {
 	assert.Equal(t, opts.ConfigVariables, common.KeyValVars{"OS": "linux"})
 	assert.Equal(t, opts.ExtraVariables, common.KeyValVars{"version_full": "42.0.2284.0"})
 }
+
+func TestBatchArchiveDumpJSON(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	assert.NoError(t, err)
+	defer os.RemoveAll(td)
+	s, err := localserver.New(filepath.Join(td, "store"))
+	assert.NoError(t, err)
+	// The uploads fail on the broken server; lookups still work.
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/store_inline") {
+			http.Error(w, "uploads are disabled", http.StatusForbidden)
+			return
+		}
+		s.ServeHTTP(w, r)
+	}))
+	defer broken.Close()
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(td, "foo.isolate"), []byte(`{'variables': {'files': ['data']}}`), 0600))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(td, "data"), []byte("data"), 0600))
+	genJSON := filepath.Join(td, "foo.isolated.gen.json")
+	assert.NoError(t, common.WriteJSONFile(genJSON, map[string]interface{}{
+		"version": isolate.IsolatedGenJSONVersion,
+		"dir":     td,
+		"args":    []string{"--isolate", "foo.isolate", "--isolated", "foo.isolated"},
+	}))
+	dump := filepath.Join(td, "dump.json")
+	run := func(url string) int {
+		r := cmdBatchArchive.CommandRun()
+		args := []string{"-isolate-server", url, "-namespace", "default", "-no-progress", "-dump-json", dump, genJSON}
+		assert.NoError(t, r.GetFlags().Parse(args))
+		return r.Run(application, r.GetFlags().Args())
+	}
+
+	// No digest is dumped when the trees couldn't be uploaded.
+	assert.Equal(t, 1, run(broken.URL))
+	_, err = os.Stat(dump)
+	assert.True(t, os.IsNotExist(err))
+
+	assert.Equal(t, 0, run(ts.URL))
+	hashes := map[string]string{}
+	assert.NoError(t, common.ReadJSONFile(dump, &hashes))
+	content, err := ioutil.ReadFile(filepath.Join(td, "foo.isolated"))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"foo": string(isolateserver.Hash(sha1.New(), content))}, hashes)
+}
@@ -5,8 +5,11 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
+
+	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/isolate"
 	"github.com/maruel/subcommands"
 )
@@ -30,14 +33,17 @@ type checkRun struct {
 }
 
 func (c *checkRun) Parse(a subcommands.Application, args []string) error {
-	if err := c.isolateFlags.Parse(); err != nil {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.Parse("."); err != nil {
 		return err
 	}
 	if err := c.isolateFlags.RequireIsolateFile(); err != nil {
-		return err;
+		return err
 	}
 	if err := c.isolateFlags.RequireIsolatedFile(); err != nil {
-		return err;
+		return err
 	}
 	if len(args) != 0 {
 		return errors.New("position arguments not expected")
@@ -46,25 +52,26 @@ func (c *checkRun) Parse(a subcommands.Application, args []string) error {
 }
 
 func (c *checkRun) main(a subcommands.Application, args []string) error {
-	if c.verbose {
-		fmt.Printf("Isolate:   %s\n", c.Isolate)
-		fmt.Printf("Isolated:  %s\n", c.Isolated)
-		fmt.Printf("Blacklist: %s\n", c.Blacklist)
-		fmt.Printf("Config:    %s\n", c.ConfigVariables)
-		fmt.Printf("Path:      %s\n", c.PathVariables)
-		fmt.Printf("Extra:     %s\n", c.ExtraVariables)
-	}
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	common.Infof("Isolate:   %s", c.Isolate)
+	common.Infof("Isolated:  %s", c.Isolated)
+	common.Infof("Blacklist: %s", c.Blacklist)
+	common.Infof("Config:    %s", c.ConfigVariables)
+	common.Infof("Path:      %s", c.PathVariables)
+	common.Infof("Extra:     %s", c.ExtraVariables)
 
 	tree := isolate.Tree{
-		Cwd: ".",
+		Cwd:  ".",
 		Opts: c.ArchiveOptions,
 	}
 
-	_, err := isolate.IsolateAndArchive([]isolate.Tree{tree}, "", "")
+	_, _, err := isolate.IsolateAndArchive(ctx, nil, []isolate.Tree{tree}, "", "", isolate.DefaultConcurrency(), nil)
 	return err
 }
 
 func (c *checkRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
 	if err := c.Parse(a, args); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
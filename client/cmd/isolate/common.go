@@ -7,27 +7,53 @@ package main
 import (
 	"errors"
 	"fmt"
+	"io"
+	"net/http"
 	"os"
+	"path/filepath"
 
+	"github.com/luci/luci-go/client/internal/auth"
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/progress"
 	"github.com/luci/luci-go/client/isolate"
+	"github.com/luci/luci-go/client/isolateserver"
 	"github.com/maruel/subcommands"
 )
 
 type commonFlags struct {
 	verbose bool
 	logFile string
-	noLog   bool
+	// logCloser closes the log file; it is set by Parse.
+	logCloser io.Closer
 }
 
 func (c *commonFlags) Init(b *subcommands.CommandRunBase) {
 	b.Flags.BoolVar(&c.verbose, "verbose", false, "Get more output")
-	b.Flags.StringVar(&c.logFile, "log", "", "Name of log file")
+	b.Flags.StringVar(&c.logFile, "log", "", "Name of log file; it is rotated when it grows too large")
+}
+
+// Parse sets up the logging as requested by the flags. Close must be called
+// once the command is done.
+func (c *commonFlags) Parse() error {
+	var err error
+	c.logCloser, err = common.SetupLogging(c.verbose, c.logFile)
+	return err
+}
+
+// Close closes the log file opened by Parse, if any.
+func (c *commonFlags) Close() {
+	if c.logCloser != nil {
+		c.logCloser.Close()
+	}
 }
 
 type commonServerFlags struct {
-	serverURL string
-	namespace string
+	serverURL   string
+	namespace   string
+	authFlags   auth.Flags
+	concurrency isolate.Concurrency
+	noProgress  bool
+	statsFile   string
 }
 
 func (c *commonServerFlags) Init(b *subcommands.CommandRunBase) {
@@ -36,6 +62,18 @@ func (c *commonServerFlags) Init(b *subcommands.CommandRunBase) {
 		"Isolate server to use; defaults to value of $ISOLATE_SERVER")
 	b.Flags.StringVar(&c.serverURL, "I", i, "Alias for -isolate-server")
 	b.Flags.StringVar(&c.namespace, "namespace", "testing", "")
+	c.authFlags.Init(&b.Flags)
+	c.concurrency = isolate.DefaultConcurrency()
+	b.Flags.IntVar(&c.concurrency.Hash, "hash-jobs", c.concurrency.Hash,
+		"Number of files hashed concurrently")
+	b.Flags.IntVar(&c.concurrency.Compress, "compress-jobs", c.concurrency.Compress,
+		"Number of files compressed concurrently")
+	b.Flags.IntVar(&c.concurrency.Network, "network-jobs", c.concurrency.Network,
+		"Number of concurrent uploads")
+	b.Flags.BoolVar(&c.noProgress, "no-progress", false,
+		"Do not print the progress of the hashing and the uploads")
+	b.Flags.StringVar(&c.statsFile, "dump-stats", "",
+		"Write the statistics of the hashing and the uploads to this file as JSON")
 }
 
 func (c *commonServerFlags) Parse() error {
@@ -53,6 +91,28 @@ func (c *commonServerFlags) Parse() error {
 	return nil
 }
 
+// createAuthClient returns the *http.Client to use to talk to the server.
+func (c *commonServerFlags) createAuthClient() (*http.Client, error) {
+	return auth.NewClient(c.authFlags.Options)
+}
+
+// startProgress starts rendering the progress to w. It returns a nil
+// *progress.Renderer if -no-progress was specified.
+func (c *commonServerFlags) startProgress(w io.Writer) *progress.Renderer {
+	if c.noProgress {
+		return nil
+	}
+	return progress.NewAuto(w)
+}
+
+// dumpStats writes stats to the file specified with -dump-stats, if any.
+func (c *commonServerFlags) dumpStats(stats *isolateserver.Stats) error {
+	if c.statsFile == "" {
+		return nil
+	}
+	return common.WriteJSONFile(c.statsFile, stats)
+}
+
 type isolateFlags struct {
 	// TODO(tandrii): move ArchiveOptions from isolate pkg to here.
 	isolate.ArchiveOptions
@@ -66,6 +126,15 @@ func (c *isolateFlags) Init(b *subcommands.CommandRunBase) {
 	b.Flags.StringVar(&c.Isolated, "isolated", "",
 		".isolated file to generate or read")
 	b.Flags.StringVar(&c.Isolated, "s", "", "Alias for --isolated")
+	b.Flags.BoolVar(&c.SplitByDir, "split-by-dir", false,
+		"Put the files of each top level directory in a separate .isolated file "+
+			"included by the main one, so shared subtrees are uploaded once")
+	b.Flags.IntVar(&c.MaxFilesPerIsolated, "max-files-per-isolated", 0,
+		"Split the files in multiple .isolated files included by the main one "+
+			"with at most this many files each; 0 to disable")
+	b.Flags.StringVar(&c.RootDir, "root-dir", "",
+		"Directory all the dependencies must be in; defaults to the deepest "+
+			"directory containing all of them and the .isolate file")
 	b.Flags.Var(&c.Blacklist, "blacklist",
 		"List of regexp to use as blacklist filter when uploading directories")
 	b.Flags.Var(c.ConfigVariables, "config-variable",
@@ -87,7 +156,21 @@ func (c *isolateFlags) Init(b *subcommands.CommandRunBase) {
 		considered relative paths.`)
 }
 
-func (c *isolateFlags) Parse() error {
+// Parse validates the flags and completes them with the state saved by a
+// previous run in <.isolated>.state, if any. Relative paths are relative to
+// cwd.
+func (c *isolateFlags) Parse(cwd string) error {
+	if c.Isolated != "" {
+		isolated := c.Isolated
+		if !filepath.IsAbs(isolated) {
+			isolated = filepath.Join(cwd, isolated)
+		}
+		state, err := isolate.LoadSavedState(isolated)
+		if err != nil {
+			return err
+		}
+		state.ApplyTo(&c.ArchiveOptions, filepath.Dir(isolated))
+	}
 	varss := [](common.KeyValVars){c.ConfigVariables, c.ExtraVariables, c.PathVariables}
 	for _, vars := range varss {
 		for k := range vars {
@@ -111,4 +194,4 @@ func (c *isolateFlags) RequireIsolatedFile() error {
 		return errors.New("-isolated must be specified")
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,354 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/maruel/subcommands"
+)
+
+var cmdConfigs = &subcommands.Command{
+	UsageLine: "configs <options>",
+	ShortDesc: "lists the configurations of a .isolate file",
+	LongDesc: `Lists the configurations of a .isolate file.
+
+Prints the command, read_only, isolate_dir and files of every combination of
+the values the config variables are compared to in the conditions of the
+.isolate file and its includes.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := configsRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.Flags.StringVar(&c.isolate, "isolate", "", ".isolate file to load")
+		c.Flags.StringVar(&c.isolate, "i", "", "Alias for -isolate")
+		c.Flags.BoolVar(&c.json, "json", false, "Print the configurations as JSON")
+		return &c
+	},
+}
+
+type configsRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolate string
+	json    bool
+}
+
+func (c *configsRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if c.isolate == "" {
+		return errors.New("-isolate must be specified")
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *configsRun) main(a subcommands.Application, args []string) error {
+	configs, err := loadConfigs(c.isolate, "")
+	if err != nil {
+		return err
+	}
+	all, err := configs.Configurations()
+	if err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(a.GetOut(), all)
+	}
+	w := a.GetOut()
+	for _, config := range all {
+		fmt.Fprintf(w, "%s\n", configTitle(config.ConfigVariables))
+		fmt.Fprintf(w, "  command:     %s\n", strings.Join(config.Settings.Command, " "))
+		fmt.Fprintf(w, "  read_only:   %d\n", config.Settings.ReadOnly)
+		fmt.Fprintf(w, "  isolate_dir: %s\n", config.Settings.IsolateDir)
+		fmt.Fprintf(w, "  files:\n")
+		for _, f := range config.Settings.Files {
+			fmt.Fprintf(w, "    %s\n", f)
+		}
+	}
+	return nil
+}
+
+func (c *configsRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+var cmdConfigDiff = &subcommands.Command{
+	UsageLine: "configdiff <options>",
+	ShortDesc: "compares two configurations of a .isolate file",
+	LongDesc: `Compares two configurations of a .isolate file, or two revisions of it.
+
+Compares the configuration selected by -config-variable with the one selected
+by -other-config-variable, which defaults to the same values.
+
+With -against, the configurations of an older revision of the same file, e.g.
+extracted with git show, are compared with the ones of -isolate. Its includes
+are loaded relative to -isolate. When no config variable is specified, every
+configuration of both revisions is compared.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := configDiffRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.configVariables = common.KeyValVars{}
+		c.otherConfigVariables = common.KeyValVars{}
+		c.Flags.StringVar(&c.isolate, "isolate", "", ".isolate file to load")
+		c.Flags.StringVar(&c.isolate, "i", "", "Alias for -isolate")
+		c.Flags.StringVar(&c.against, "against", "",
+			"Content of the old revision of the .isolate file to compare -isolate with")
+		c.Flags.Var(c.configVariables, "config-variable",
+			"Config variables selecting the old configuration")
+		c.Flags.Var(c.otherConfigVariables, "other-config-variable",
+			"Config variables selecting the new configuration; defaults to -config-variable")
+		c.Flags.BoolVar(&c.json, "json", false, "Print the differences as JSON")
+		return &c
+	},
+}
+
+type configDiffRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolate              string
+	against              string
+	configVariables      common.KeyValVars
+	otherConfigVariables common.KeyValVars
+	json                 bool
+}
+
+func (c *configDiffRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if c.isolate == "" {
+		return errors.New("-isolate must be specified")
+	}
+	if c.against == "" && len(c.otherConfigVariables) == 0 {
+		return errors.New("-against or -other-config-variable must be specified")
+	}
+	if len(c.configVariables) == 0 && len(c.otherConfigVariables) != 0 {
+		return errors.New("-other-config-variable requires -config-variable")
+	}
+	if len(c.otherConfigVariables) == 0 {
+		for k, v := range c.configVariables {
+			c.otherConfigVariables[k] = v
+		}
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+// configDiff is the difference of one configuration. Old or New is nil when
+// the configuration only exists in the other revision.
+type configDiff struct {
+	Old  common.KeyValVars           `json:"old"`
+	New  common.KeyValVars           `json:"new"`
+	Diff *isolate.ConfigSettingsDiff `json:"diff,omitempty"`
+}
+
+func (c *configDiffRun) main(a subcommands.Application, args []string) error {
+	newConfigs, err := loadConfigs(c.isolate, "")
+	if err != nil {
+		return err
+	}
+	// -against is the old revision, the working copy the new one.
+	oldConfigs := newConfigs
+	if c.against != "" {
+		if oldConfigs, err = loadConfigs(c.isolate, c.against); err != nil {
+			return err
+		}
+	}
+	var diffs []*configDiff
+	if len(c.configVariables) != 0 {
+		d := &configDiff{Old: c.configVariables, New: c.otherConfigVariables}
+		if d.Diff, err = diffConfigs(oldConfigs, newConfigs, d.Old, d.New); err != nil {
+			return err
+		}
+		diffs = append(diffs, d)
+	} else if diffs, err = diffAllConfigs(oldConfigs, newConfigs); err != nil {
+		return err
+	}
+	if c.json {
+		return printJSON(a.GetOut(), diffs)
+	}
+	for _, d := range diffs {
+		printConfigDiff(a.GetOut(), d)
+	}
+	return nil
+}
+
+func (c *configDiffRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+// loadConfigs loads the .isolate file isolatePath. If contentPath is set, the
+// content is read from it instead, e.g. for another revision of the file.
+func loadConfigs(isolatePath, contentPath string) (*isolate.Configs, error) {
+	isolatePath, err := filepath.Abs(isolatePath)
+	if err != nil {
+		return nil, err
+	}
+	if contentPath == "" {
+		contentPath = isolatePath
+	}
+	content, err := ioutil.ReadFile(contentPath)
+	if err != nil {
+		return nil, err
+	}
+	return isolate.LoadIsolateAsConfig(filepath.Dir(isolatePath), content, nil)
+}
+
+func diffConfigs(oldConfigs, newConfigs *isolate.Configs, oldVars, newVars common.KeyValVars) (
+	*isolate.ConfigSettingsDiff, error) {
+	oldSettings, err := oldConfigs.GetConfigForVariables(oldVars)
+	if err != nil {
+		return nil, err
+	}
+	newSettings, err := newConfigs.GetConfigForVariables(newVars)
+	if err != nil {
+		return nil, err
+	}
+	return isolate.DiffConfigSettings(oldSettings, newSettings)
+}
+
+// diffAllConfigs compares the configurations with the same variables in
+// oldConfigs and newConfigs. It returns the ones that differ, including the
+// ones only found on one side.
+func diffAllConfigs(oldConfigs, newConfigs *isolate.Configs) ([]*configDiff, error) {
+	oldAll, err := oldConfigs.Configurations()
+	if err != nil {
+		return nil, err
+	}
+	newAll, err := newConfigs.Configurations()
+	if err != nil {
+		return nil, err
+	}
+	type pair struct {
+		old, new *isolate.Configuration
+	}
+	byName := map[string]*pair{}
+	for _, config := range oldAll {
+		byName[config.Name()] = &pair{old: config}
+	}
+	for _, config := range newAll {
+		p := byName[config.Name()]
+		if p == nil {
+			p = &pair{}
+			byName[config.Name()] = p
+		}
+		p.new = config
+	}
+	names := make([]string, 0, len(byName))
+	for name := range byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var out []*configDiff
+	for _, name := range names {
+		p := byName[name]
+		d := &configDiff{}
+		if p.old != nil {
+			d.Old = p.old.ConfigVariables
+		}
+		if p.new != nil {
+			d.New = p.new.ConfigVariables
+		}
+		if p.old != nil && p.new != nil {
+			// Unbound variables are omitted from ConfigVariables, so compare the
+			// settings already computed instead of looking them up again.
+			if d.Diff, err = isolate.DiffConfigSettings(p.old.Settings, p.new.Settings); err != nil {
+				return nil, err
+			}
+			if d.Diff.IsEmpty() {
+				continue
+			}
+		}
+		out = append(out, d)
+	}
+	return out, nil
+}
+
+func printConfigDiff(w io.Writer, d *configDiff) {
+	switch {
+	case d.Old == nil:
+		fmt.Fprintf(w, "+++ %s: only in the new revision\n", configTitle(d.New))
+		return
+	case d.New == nil:
+		fmt.Fprintf(w, "--- %s: only in the old revision\n", configTitle(d.Old))
+		return
+	}
+	fmt.Fprintf(w, "--- %s\n+++ %s\n", configTitle(d.Old), configTitle(d.New))
+	if d.Diff.IsEmpty() {
+		fmt.Fprintf(w, "no difference\n")
+		return
+	}
+	if d.Diff.CommandChanged() {
+		fmt.Fprintf(w, "-command: %s\n", strings.Join(d.Diff.OldCommand, " "))
+		fmt.Fprintf(w, "+command: %s\n", strings.Join(d.Diff.NewCommand, " "))
+	}
+	if d.Diff.OldReadOnly != d.Diff.NewReadOnly {
+		fmt.Fprintf(w, "-read_only: %d\n", d.Diff.OldReadOnly)
+		fmt.Fprintf(w, "+read_only: %d\n", d.Diff.NewReadOnly)
+	}
+	for _, f := range d.Diff.Removed {
+		fmt.Fprintf(w, "-%s\n", f)
+	}
+	for _, f := range d.Diff.Added {
+		fmt.Fprintf(w, "+%s\n", f)
+	}
+	for _, f := range d.Diff.RemovedTouched {
+		fmt.Fprintf(w, "-touched: %s\n", f)
+	}
+	for _, f := range d.Diff.AddedTouched {
+		fmt.Fprintf(w, "+touched: %s\n", f)
+	}
+}
+
+// configTitle returns the name of a configuration for display.
+func configTitle(vars common.KeyValVars) string {
+	c := isolate.Configuration{ConfigVariables: vars}
+	if name := c.Name(); name != "" {
+		return name
+	}
+	return "(all)"
+}
+
+func printJSON(w io.Writer, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
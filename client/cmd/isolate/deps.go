@@ -0,0 +1,130 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/progress"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/maruel/subcommands"
+)
+
+var cmdDeps = &subcommands.Command{
+	UsageLine: "deps <options>",
+	ShortDesc: "prints the dependencies a .isolate file resolves to",
+	LongDesc: `Prints the dependencies a .isolate file resolves to.
+
+Prints the command, read_only, isolate_dir and files of the configuration
+selected by the variables, once the includes are merged, without archiving
+anything.
+
+With -expand, the files are walked and hashed, and each dependency is listed
+with the files it resolves to, largest first, with their size and digest.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := depsRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.isolateFlags.Init(&c.CommandRunBase)
+		c.Flags.BoolVar(&c.expand, "expand", false,
+			"List the files each dependency resolves to, with their size and digest")
+		c.Flags.BoolVar(&c.json, "json", false, "Print the dependencies as JSON")
+		return &c
+	},
+}
+
+type depsRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolateFlags
+	expand bool
+	json   bool
+}
+
+func (c *depsRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.Parse("."); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolateFile(); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *depsRun) main(a subcommands.Application, args []string) error {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	deps, err := isolate.LoadDependencies(isolate.Tree{Cwd: ".", Opts: c.ArchiveOptions})
+	if err != nil {
+		return err
+	}
+	if c.expand {
+		loader := isolate.LoadOrCreateCache()
+		defer loader.Save()
+		if err := deps.Expand(ctx, loader); err != nil {
+			return err
+		}
+	}
+	if c.json {
+		return printJSON(a.GetOut(), deps)
+	}
+	printDeps(a.GetOut(), deps)
+	return nil
+}
+
+// printDeps prints deps in a human readable form.
+func printDeps(w io.Writer, deps *isolate.Dependencies) {
+	fmt.Fprintf(w, "command:     %s\n", strings.Join(deps.Command, " "))
+	fmt.Fprintf(w, "read_only:   %d\n", deps.ReadOnly)
+	fmt.Fprintf(w, "isolate_dir: %s\n", deps.IsolateDir)
+	fmt.Fprintf(w, "root_dir:    %s\n", deps.RootDir)
+	if len(deps.Touched) != 0 {
+		fmt.Fprintf(w, "touched:\n")
+		for _, f := range deps.Touched {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+	}
+	if deps.Expanded == nil {
+		fmt.Fprintf(w, "files:\n")
+		for _, f := range deps.Files {
+			fmt.Fprintf(w, "  %s\n", f)
+		}
+		return
+	}
+	fmt.Fprintf(w, "files:       %d files, %s\n", deps.FileCount, progress.Size(deps.Size))
+	for _, e := range deps.Expanded {
+		fmt.Fprintf(w, "  %s: %d files, %s\n", e.Dependency, len(e.Files), progress.Size(e.Size))
+		for _, f := range e.Files {
+			if f.Link != "" {
+				fmt.Fprintf(w, "    %10s  %-40s  %s -> %s\n", "", "", f.Path, f.Link)
+			} else {
+				fmt.Fprintf(w, "    %10s  %-40s  %s\n", progress.Size(f.Size), f.Digest, f.Path)
+			}
+		}
+	}
+}
+
+func (c *depsRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/maruel/subcommands"
+)
+
+var cmdFormat = &subcommands.Command{
+	UsageLine: "format <options> file1.isolate file2.isolate ...",
+	ShortDesc: "reformats .isolate files in canonical style",
+	LongDesc: `Reformats .isolate files in canonical style.
+
+The files are sorted, the conditions yielding the same configurations are
+merged and the comment at the top of the file is kept. Other comments are lost.
+The result is printed, unless -w is specified.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := formatRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.Flags.BoolVar(&c.write, "w", false, "Write the result to the files instead of printing it")
+		return &c
+	},
+}
+
+type formatRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	write bool
+}
+
+func (c *formatRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("at least one .isolate file required")
+	}
+	return nil
+}
+
+func (c *formatRun) main(a subcommands.Application, args []string) error {
+	for _, arg := range args {
+		if err := rewriteIsolate(a, arg, arg, !c.write, isolate.FormatIsolate); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *formatRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+var cmdMerge = &subcommands.Command{
+	UsageLine: "merge <options>",
+	ShortDesc: "folds the includes of a .isolate file into a single file",
+	LongDesc: `Folds the includes of a .isolate file into a single file.
+
+The files of the includes are made relative to the directory of the .isolate
+file, so the result must be stored next to it. It is in the same canonical
+style as 'format'. The result is printed, unless -output is specified.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := mergeRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.Flags.StringVar(&c.isolate, "isolate", "", ".isolate file to merge")
+		c.Flags.StringVar(&c.isolate, "i", "", "Alias for -isolate")
+		c.Flags.StringVar(&c.output, "output", "", "File to write the result to")
+		c.Flags.StringVar(&c.output, "o", "", "Alias for -output")
+		return &c
+	},
+}
+
+type mergeRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolate string
+	output  string
+}
+
+func (c *mergeRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if c.isolate == "" {
+		return errors.New("-isolate must be specified")
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *mergeRun) main(a subcommands.Application, args []string) error {
+	return rewriteIsolate(a, c.isolate, c.output, c.output == "", isolate.MergeIsolate)
+}
+
+func (c *mergeRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
+
+// rewriteIsolate applies f to the .isolate file src and writes the result to
+// dst, or prints it if print is true.
+func rewriteIsolate(a subcommands.Application, src, dst string, print bool,
+	f func(isolateDir string, content []byte) ([]byte, error)) error {
+	src, err := filepath.Abs(src)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(src)
+	if err != nil {
+		return err
+	}
+	out, err := f(filepath.Dir(src), content)
+	if err != nil {
+		return fmt.Errorf("%s: %s", src, err)
+	}
+	if print {
+		_, err = a.GetOut().Write(out)
+		return err
+	}
+	return ioutil.WriteFile(dst, out, 0644)
+}
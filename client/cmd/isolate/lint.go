@@ -0,0 +1,93 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/maruel/subcommands"
+)
+
+var cmdLint = &subcommands.Command{
+	UsageLine: "lint <options>",
+	ShortDesc: "checks a .isolate file for common mistakes",
+	LongDesc: `Checks a .isolate file and its includes for common mistakes.
+
+Reports, for all the configurations, the dependencies that don't exist,
+directories without a trailing '/', files with one, dependencies listed more
+than once for the same configuration, conditions that match no configuration,
+and includes that are absolute or don't exist.
+
+Dependencies referencing variables are only checked if the variables are
+specified. Exits with 1 if anything is found.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := lintRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.isolateFlags.Init(&c.CommandRunBase)
+		c.Flags.BoolVar(&c.json, "json", false, "Print the issues as JSON")
+		return &c
+	},
+}
+
+type lintRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolateFlags
+	json bool
+}
+
+func (c *lintRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.Parse("."); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolateFile(); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *lintRun) main(a subcommands.Application, args []string) error {
+	issues, err := isolate.Lint(isolate.Tree{Cwd: ".", Opts: c.ArchiveOptions})
+	if err != nil {
+		return err
+	}
+	if c.json {
+		if issues == nil {
+			issues = []*isolate.LintIssue{}
+		}
+		if err := printJSON(a.GetOut(), issues); err != nil {
+			return err
+		}
+	} else {
+		for _, issue := range issues {
+			fmt.Fprintf(a.GetOut(), "%s\n", issue)
+		}
+	}
+	if len(issues) != 0 {
+		return fmt.Errorf("%d issues found", len(issues))
+	}
+	return nil
+}
+
+func (c *lintRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -5,9 +5,10 @@
 package main
 
 import (
-	"log"
 	"os"
 
+	"github.com/luci/luci-go/client/internal/auth"
+	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -19,11 +20,24 @@ var application = &subcommands.DefaultApplication{
 		cmdArchive,
 		cmdBatchArchive,
 		cmdCheck,
+		cmdConfigDiff,
+		cmdConfigs,
+		cmdDeps,
+		cmdFormat,
 		subcommands.CmdHelp,
+		auth.SubcommandInfo,
+		cmdLint,
+		auth.SubcommandLogin,
+		auth.SubcommandLogout,
+		cmdMerge,
+		cmdRemap,
+		cmdRewrite,
+		cmdRun,
 	},
 }
 
 func main() {
-	log.SetFlags(log.Lmicroseconds)
+	// Commands cancel their context on Ctrl-C.
+	interrupt.HandleCtrlC()
 	os.Exit(subcommands.Run(application, nil))
 }
@@ -0,0 +1,106 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/maruel/subcommands"
+)
+
+var cmdRemap = &subcommands.Command{
+	UsageLine: "remap <options>",
+	ShortDesc: "creates a directory with all the dependencies mapped into it",
+	LongDesc: `Creates a directory with all the dependencies mapped into it.
+
+Useful to test manually if all the dependencies are present. The .isolated and
+its <.isolated>.state are updated first, so the .isolate file and the variables
+can be omitted if they were saved by a previous run.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := remapRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.isolateFlags.Init(&c.CommandRunBase)
+		c.Flags.StringVar(&c.outdir, "outdir", "",
+			"Directory used to recreate the tree; defaults to a new temporary directory")
+		return &c
+	},
+}
+
+type remapRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolateFlags
+	outdir string
+}
+
+func (c *remapRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.Parse("."); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolateFile(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolatedFile(); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *remapRun) main(a subcommands.Application, args []string) error {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	tree := isolate.Tree{
+		Cwd:  ".",
+		Opts: c.ArchiveOptions,
+	}
+	if _, _, err := isolate.IsolateAndArchive(ctx, nil, []isolate.Tree{tree}, "", "", isolate.DefaultConcurrency(), nil); err != nil {
+		return err
+	}
+	state, err := isolate.LoadSavedState(c.Isolated)
+	if err != nil {
+		return err
+	}
+	if c.outdir == "" {
+		if c.outdir, err = ioutil.TempDir("", "isolate"); err != nil {
+			return err
+		}
+	} else {
+		if err := os.MkdirAll(c.outdir, 0755); err != nil {
+			return err
+		}
+		if entries, err := ioutil.ReadDir(c.outdir); err != nil {
+			return err
+		} else if len(entries) != 0 {
+			return fmt.Errorf("can only remap to an empty directory; %s is not empty", c.outdir)
+		}
+	}
+	fmt.Fprintf(a.GetOut(), "Remapping into %s\n", c.outdir)
+	return isolate.Remap(ctx, state, c.outdir)
+}
+
+func (c *remapRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
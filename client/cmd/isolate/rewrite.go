@@ -0,0 +1,81 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/maruel/subcommands"
+)
+
+var cmdRewrite = &subcommands.Command{
+	UsageLine: "rewrite <options>",
+	ShortDesc: "regenerates a .isolated file from its saved state",
+	LongDesc: `Regenerates a .isolated file and its <.isolated>.state from the state saved by a previous run.
+
+The .isolate file and all the variables are taken from <.isolated>.state.
+Variables specified on the command line override the saved ones and are saved
+for the next runs.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := rewriteRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.isolateFlags.Init(&c.CommandRunBase)
+		return &c
+	},
+}
+
+type rewriteRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolateFlags
+}
+
+func (c *rewriteRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolatedFile(); err != nil {
+		return err
+	}
+	if _, err := os.Stat(isolate.StatePath(c.Isolated)); err != nil {
+		return fmt.Errorf("no saved state for %s: %s", c.Isolated, err)
+	}
+	if err := c.isolateFlags.Parse("."); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *rewriteRun) main(a subcommands.Application, args []string) error {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	tree := isolate.Tree{
+		Cwd:  ".",
+		Opts: c.ArchiveOptions,
+	}
+	_, _, err := isolate.IsolateAndArchive(ctx, nil, []isolate.Tree{tree}, "", "", isolate.DefaultConcurrency(), nil)
+	return err
+}
+
+func (c *rewriteRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolate"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/subcommands"
+)
+
+var cmdRun = &subcommands.Command{
+	UsageLine: "run <options> [-- <args>...]",
+	ShortDesc: "runs the command in a temporary directory with the dependencies mapped into it",
+	LongDesc: `Runs the command in a temporary directory with all the dependencies mapped into it.
+
+The .isolated and its <.isolated>.state are updated first, like for remap. The
+command is run from its relative_cwd inside the temporary directory, which is
+deleted once the command exits. The arguments are appended to the command.
+Exits with the exit code of the command.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := runRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.isolateFlags.Init(&c.CommandRunBase)
+		return &c
+	},
+}
+
+type runRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	isolateFlags
+}
+
+func (c *runRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.Parse("."); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolateFile(); err != nil {
+		return err
+	}
+	if err := c.isolateFlags.RequireIsolatedFile(); err != nil {
+		return err
+	}
+	return nil
+}
+
+// main returns the exit code of the command.
+func (c *runRun) main(a subcommands.Application, args []string) (int, error) {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	tree := isolate.Tree{
+		Cwd:  ".",
+		Opts: c.ArchiveOptions,
+	}
+	if _, _, err := isolate.IsolateAndArchive(ctx, nil, []isolate.Tree{tree}, "", "", isolate.DefaultConcurrency(), nil); err != nil {
+		return 1, err
+	}
+	state, err := isolate.LoadSavedState(c.Isolated)
+	if err != nil {
+		return 1, err
+	}
+	if len(state.Command) == 0 {
+		return 1, errors.New("no command to run")
+	}
+	outDir, err := ioutil.TempDir("", "isolate")
+	if err != nil {
+		return 1, err
+	}
+	defer func() {
+		if err := isolateserver.RemoveTree(outDir); err != nil {
+			common.Warningf("failed to delete %s: %s", outDir, err)
+		}
+	}()
+	if err := isolate.Remap(ctx, state, outDir); err != nil {
+		return 1, err
+	}
+
+	command := append(append([]string{}, state.Command...), args...)
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Dir = filepath.Join(outDir, filepath.FromSlash(state.RelativeCwd))
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = a.GetOut()
+	cmd.Stderr = a.GetErr()
+	common.Infof("running %v in %s", command, cmd.Dir)
+	if err := cmd.Run(); err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return exitErr.ExitCode(), nil
+		}
+		return 1, err
+	}
+	return 0, nil
+}
+
+func (c *runRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	exitCode, err := c.main(a, args)
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+	}
+	return exitCode
+}
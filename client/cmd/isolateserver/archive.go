@@ -5,6 +5,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 
@@ -39,6 +40,9 @@ type archiveRun struct {
 }
 
 func (c *archiveRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
 	if err := c.commonServerFlags.Parse(); err != nil {
 		return err
 	}
@@ -49,22 +53,29 @@ func (c *archiveRun) Parse(a subcommands.Application, args []string) error {
 }
 
 func (c *archiveRun) main(a subcommands.Application, args []string) error {
-	i := isolateserver.New(c.serverURL, c.namespace, c.compression, c.hashing)
-	caps, err := i.ServerCapabilities()
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	client, err := c.createAuthClient()
+	if err != nil {
+		return err
+	}
+	i := isolateserver.New(client, c.serverURL, c.namespace, c.hashing, c.compression)
+	caps, err := i.ServerCapabilities(ctx)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Server:       %s\n", c.serverURL)
-	fmt.Printf("Capabilities: %#v\n", caps)
-	fmt.Printf("Namespace:    %s\n", c.namespace)
-	fmt.Printf("Dirs:         %s\n", c.dirs)
-	fmt.Printf("Files:        %s\n", c.files)
-	fmt.Printf("Blacklist:    %s\n", c.blacklist)
+	common.Infof("Server:       %s", c.serverURL)
+	common.Infof("Capabilities: %#v", caps)
+	common.Infof("Namespace:    %s", c.namespace)
+	common.Infof("Dirs:         %s", c.dirs)
+	common.Infof("Files:        %s", c.files)
+	common.Infof("Blacklist:    %s", c.blacklist)
 	return errors.New("TODO")
 }
 
 func (c *archiveRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
 	if err := c.Parse(a, args); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
@@ -6,20 +6,42 @@ package main
 
 import (
 	"errors"
+	"io"
+	"net/http"
 
+	"github.com/luci/luci-go/client/internal/auth"
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/internal/progress"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/luci/luci-go/client/isolateserver/localserver"
 	"github.com/maruel/subcommands"
 )
 
 type commonFlags struct {
 	verbose bool
 	logFile string
-	noLog   bool
+	// logCloser closes the log file; it is set by Parse.
+	logCloser io.Closer
 }
 
 func (c *commonFlags) Init(b *subcommands.CommandRunBase) {
 	b.Flags.BoolVar(&c.verbose, "verbose", false, "Get more output")
-	b.Flags.StringVar(&c.logFile, "log", "", "Name of log file")
+	b.Flags.StringVar(&c.logFile, "log", "", "Name of log file; it is rotated when it grows too large")
+}
+
+// Parse sets up the logging as requested by the flags. Close must be called
+// once the command is done.
+func (c *commonFlags) Parse() error {
+	var err error
+	c.logCloser, err = common.SetupLogging(c.verbose, c.logFile)
+	return err
+}
+
+// Close closes the log file opened by Parse, if any.
+func (c *commonFlags) Close() {
+	if c.logCloser != nil {
+		c.logCloser.Close()
+	}
 }
 
 type commonServerFlags struct {
@@ -27,6 +49,9 @@ type commonServerFlags struct {
 	namespace   string
 	compression string
 	hashing     string
+	authFlags   auth.Flags
+	noProgress  bool
+	statsFile   string
 }
 
 func (c *commonServerFlags) Init(b *subcommands.CommandRunBase) {
@@ -35,6 +60,9 @@ func (c *commonServerFlags) Init(b *subcommands.CommandRunBase) {
 	b.Flags.StringVar(&c.namespace, "namespace", "testing", "")
 	b.Flags.StringVar(&c.compression, "compression", "flate", "")
 	b.Flags.StringVar(&c.hashing, "hashing", "sha-1", "")
+	c.authFlags.Init(&b.Flags)
+	b.Flags.BoolVar(&c.noProgress, "no-progress", false, "Do not print the progress of the transfers")
+	b.Flags.StringVar(&c.statsFile, "dump-stats", "", "Write the statistics of the transfers to this file as JSON")
 }
 
 func (c *commonServerFlags) Parse() error {
@@ -51,3 +79,56 @@ func (c *commonServerFlags) Parse() error {
 	}
 	return nil
 }
+
+// createAuthClient returns the *http.Client to use to talk to the server.
+func (c *commonServerFlags) createAuthClient() (*http.Client, error) {
+	return auth.NewClient(c.authFlags.Options)
+}
+
+// startProgress starts rendering the progress to w. It returns a nil
+// *progress.Renderer if -no-progress was specified.
+func (c *commonServerFlags) startProgress(w io.Writer) *progress.Renderer {
+	if c.noProgress {
+		return nil
+	}
+	return progress.NewAuto(w)
+}
+
+// dumpStats writes stats to the file specified with -dump-stats, if any.
+func (c *commonServerFlags) dumpStats(stats *isolateserver.Stats) error {
+	if c.statsFile == "" {
+		return nil
+	}
+	return common.WriteJSONFile(c.statsFile, stats)
+}
+
+// storeFlags select a namespace in the directory of a local isolate server.
+type storeFlags struct {
+	storeDir  string
+	namespace string
+}
+
+func (c *storeFlags) Init(b *subcommands.CommandRunBase) {
+	b.Flags.StringVar(&c.storeDir, "store", "", "Directory of the local isolate server")
+	b.Flags.StringVar(&c.namespace, "namespace", "default-gzip", "")
+}
+
+func (c *storeFlags) Parse() error {
+	if c.storeDir == "" {
+		return errors.New("-store must be specified")
+	}
+	if c.namespace == "" {
+		return errors.New("-namespace must be specified")
+	}
+	return nil
+}
+
+// openStore returns the store of the namespace. The compression is the one
+// used by convention by the namespace.
+func (c *storeFlags) openStore() (*localserver.Store, error) {
+	return localserver.NewStore(c.storeDir, isolateserver.Namespace{
+		Namespace:   c.namespace,
+		DigestAlgo:  "sha-1",
+		Compression: isolateserver.CompressionForNamespace(c.namespace),
+	})
+}
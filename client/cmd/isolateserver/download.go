@@ -5,9 +5,17 @@
 package main
 
 import (
+	"context"
+	"crypto/sha1"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
 
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
 	"github.com/maruel/subcommands"
 )
 
@@ -16,11 +24,34 @@ var cmdDownload = &subcommands.Command{
 	ShortDesc: "downloads a file or a .isolated tree from an isolate server.",
 	LongDesc: `Downloads one or multiple files, or a isolated tree from the isolate server.
 
-Files are referenced by their hash`,
+Files are referenced by their hash.
+
+With -lazy, only the manifest is written, to -manifest, and the files are
+fetched on demand. Opening a file doesn't fetch it: there is no FUSE mount, so
+the process using the tree must cooperate and request each file through the
+Unix socket -socket before opening it, either with the "request" command or by
+sending the path relative to -target followed by a newline. The reply is "ok"
+once the file is mapped, or "error <message>". Files listed in the manifest
+but never requested are absent from -target.
+
+The command serves the requests until interrupted, then writes the files
+requested to -record-profile. That profile can be passed back with
+-access-profile to prefetch the files.`,
 	CommandRun: func() subcommands.CommandRun {
 		c := downloadRun{}
 		c.commonFlags.Init(&c.CommandRunBase)
 		c.commonServerFlags.Init(&c.CommandRunBase)
+		c.Flags.StringVar(&c.isolated, "isolated", "", "Hash of an .isolated tree to download")
+		c.Flags.StringVar(&c.isolated, "s", "", "Alias for -isolated")
+		c.Flags.StringVar(&c.target, "target", "", "Destination directory")
+		c.Flags.StringVar(&c.target, "t", "", "Alias for -target")
+		c.Flags.StringVar(&c.cacheDir, "cache", "", "Directory to keep the downloaded items in; a temporary directory by default")
+		c.Flags.IntVar(&c.jobs, "jobs", 8, "Number of concurrent downloads")
+		c.Flags.BoolVar(&c.lazy, "lazy", false, "Fetch the files on demand instead of downloading the whole tree")
+		c.Flags.StringVar(&c.socket, "socket", "", "Unix socket to serve the file requests on, with -lazy")
+		c.Flags.StringVar(&c.manifest, "manifest", "", "File to write the manifest of the tree to, with -lazy; defaults to <target>.isolated")
+		c.Flags.StringVar(&c.accessProfile, "access-profile", "", "Access profile listing the files to prefetch, with -lazy")
+		c.Flags.StringVar(&c.recordProfile, "record-profile", "", "File to write the access profile of the files requested to, with -lazy")
 		return &c
 	},
 }
@@ -29,12 +60,44 @@ type downloadRun struct {
 	subcommands.CommandRunBase
 	commonFlags
 	commonServerFlags
+	isolated string
+	target   string
+	cacheDir string
+	jobs     int
+
+	lazy          bool
+	socket        string
+	manifest      string
+	accessProfile string
+	recordProfile string
 }
 
 func (c *downloadRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
 	if err := c.commonServerFlags.Parse(); err != nil {
 		return err
 	}
+	if c.isolated == "" {
+		return errors.New("-isolated must be specified")
+	}
+	if c.target == "" {
+		return errors.New("-target must be specified")
+	}
+	if c.lazy {
+		if c.socket == "" {
+			return errors.New("-socket must be specified with -lazy")
+		}
+		if c.manifest == "" {
+			c.manifest = filepath.Clean(c.target) + ".isolated"
+		}
+		// The command runs until interrupted; a progress line would only get in
+		// the way.
+		c.noProgress = true
+	} else if c.socket != "" || c.accessProfile != "" || c.recordProfile != "" {
+		return errors.New("-socket, -access-profile and -record-profile require -lazy")
+	}
 	if len(args) != 0 {
 		return errors.New("position arguments not expected")
 	}
@@ -42,10 +105,101 @@ func (c *downloadRun) Parse(a subcommands.Application, args []string) error {
 }
 
 func (c *downloadRun) main(a subcommands.Application, args []string) error {
-	return errors.New("TODO")
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	if c.hashing != "sha-1" {
+		return fmt.Errorf("unsupported hashing %s", c.hashing)
+	}
+	httpClient, err := c.createAuthClient()
+	if err != nil {
+		return err
+	}
+	cacheDir := c.cacheDir
+	if cacheDir == "" {
+		if cacheDir, err = ioutil.TempDir("", "isolateserver"); err != nil {
+			return err
+		}
+		defer os.RemoveAll(cacheDir)
+	}
+	// Items are streamed to disk so large files don't need to fit in memory.
+	cache, err := isolateserver.MakeDiskCache(cacheDir, sha1.New)
+	if err != nil {
+		return err
+	}
+	p := c.startProgress(a.GetErr())
+	recorder := isolateserver.NewStatsRecorder(p)
+	opts := isolateserver.DefaultTransferOptions()
+	opts.Progress = recorder
+	client := isolateserver.NewWithOptions(httpClient, c.serverURL, c.namespace, c.hashing, c.compression, opts)
+	var stats *isolateserver.Stats
+	if c.lazy {
+		err = c.serveLazy(ctx, client, cache, recorder)
+		stats = recorder.Stats()
+	} else {
+		stats, err = isolateserver.DownloadTree(ctx, client, cache, isolateserver.HexDigest(c.isolated), c.target, c.jobs, recorder)
+	}
+	p.Stop()
+	if err2 := c.dumpStats(stats); err == nil {
+		err = err2
+	}
+	if err != nil {
+		return err
+	}
+	common.Infof("Downloaded %d items into %s", stats.ItemsDownloaded, c.target)
+	return nil
+}
+
+// serveLazy writes the manifest of the tree and maps its files on demand until
+// ctx is canceled.
+func (c *downloadRun) serveLazy(ctx context.Context, client isolateserver.IsolateServer, cache isolateserver.LocalCache,
+	stats *isolateserver.StatsRecorder) error {
+	done := stats.Phase("fetch_isolated")
+	tree, err := isolateserver.NewLazyTree(ctx, client, cache, isolateserver.HexDigest(c.isolated), c.target, stats)
+	done()
+	if err != nil {
+		return err
+	}
+	data, err := tree.Isolated().Encode()
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(c.manifest, data, 0644); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.target, 0755); err != nil {
+		return err
+	}
+	if c.accessProfile != "" {
+		profile, err := isolateserver.ReadAccessProfile(c.accessProfile)
+		if err != nil {
+			return err
+		}
+		done = stats.Phase("prefetch")
+		err = tree.Prefetch(ctx, profile.Files, c.jobs)
+		done()
+		if err != nil {
+			return err
+		}
+	}
+	l, err := net.Listen("unix", c.socket)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(c.socket)
+	common.Infof("Serving %s on %s", c.target, c.socket)
+	done = stats.Phase("serve")
+	err = tree.Serve(ctx, l)
+	done()
+	if c.recordProfile != "" {
+		if err2 := isolateserver.WriteAccessProfile(c.recordProfile, tree.Accessed()); err == nil {
+			err = err2
+		}
+	}
+	return err
 }
 
 func (c *downloadRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
 	if err := c.Parse(a, args); err != nil {
 		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
 		return 1
@@ -0,0 +1,67 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/luci/luci-go/client/isolateserver/localserver"
+	"github.com/maruel/ut"
+)
+
+// pushTree uploads a tree containing the file a/b to the isolate server at
+// url and returns the digest of its .isolated file.
+func pushTree(t *testing.T, url string, content []byte) isolateserver.HexDigest {
+	ctx := context.Background()
+	client := isolateserver.New(nil, url, "default-gzip", "sha-1", "flate")
+	isolated := isolateserver.NewIsolated()
+	size := int64(len(content))
+	isolated.Files["a/b"] = isolateserver.File{Digest: isolateserver.Hash(sha1.New(), content), Size: &size}
+	data, err := isolated.Encode()
+	ut.AssertEqual(t, nil, err)
+	for _, c := range [][]byte{content, data} {
+		c := c
+		items := []*isolateserver.DigestItem{{Digest: isolateserver.Hash(sha1.New(), c), Size: int64(len(c))}}
+		states, err := client.Contains(ctx, items)
+		ut.AssertEqual(t, nil, err)
+		err = client.Push(ctx, states[0], func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(c)), nil
+		})
+		ut.AssertEqual(t, nil, err)
+	}
+	return isolateserver.Hash(sha1.New(), data)
+}
+
+// TestDownloadLocalServer downloads a tree from a local isolate server through
+// the command line flags, like an offline workflow would.
+func TestDownloadLocalServer(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer isolateserver.RemoveTree(td)
+	s, err := localserver.New(filepath.Join(td, "store"))
+	ut.AssertEqual(t, nil, err)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	content := []byte("content of a/b")
+	digest := pushTree(t, ts.URL, content)
+
+	out := filepath.Join(td, "out")
+	args := []string{"-isolate-server", ts.URL, "-namespace", "default-gzip", "-no-progress",
+		"-isolated", string(digest), "-target", out}
+	r := cmdDownload.CommandRun()
+	ut.AssertEqual(t, nil, r.GetFlags().Parse(args))
+	ut.AssertEqual(t, 0, r.Run(application, r.GetFlags().Args()))
+	actual, err := ioutil.ReadFile(filepath.Join(out, "a", "b"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, actual)
+}
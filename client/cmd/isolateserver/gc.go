@@ -0,0 +1,113 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/subcommands"
+)
+
+var cmdGC = &subcommands.Command{
+	UsageLine: "gc <options>",
+	ShortDesc: "deletes the unreachable items stored by a local isolate server",
+	LongDesc: `Deletes the items of a namespace stored by a local isolate server that are
+not reachable from the root .isolated files, and the abandoned uploads.
+
+Only the files not modified for the grace period are deleted, so items uploaded
+for an archive whose root is not registered yet are kept.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := gcRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.storeFlags.Init(&c.CommandRunBase)
+		c.Flags.Var(&c.roots, "root", "Digest of a .isolated file to keep with everything it references; can be repeated")
+		c.Flags.StringVar(&c.rootsFile, "roots-file", "", "File listing the digests of the .isolated files to keep, separated by whitespace")
+		c.Flags.DurationVar(&c.grace, "grace", 24*time.Hour, "Only delete the files not modified for this long")
+		c.Flags.BoolVar(&c.dryRun, "dry-run", false, "Only list the files that would be deleted")
+		return &c
+	},
+}
+
+type gcRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	storeFlags
+	roots     common.Strings
+	rootsFile string
+	grace     time.Duration
+	dryRun    bool
+}
+
+func (c *gcRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.storeFlags.Parse(); err != nil {
+		return err
+	}
+	if c.grace < 0 {
+		return errors.New("-grace must not be negative")
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *gcRun) main(a subcommands.Application, args []string) error {
+	roots := make([]isolateserver.HexDigest, 0, len(c.roots))
+	for _, r := range c.roots {
+		roots = append(roots, isolateserver.HexDigest(r))
+	}
+	if c.rootsFile != "" {
+		content, err := ioutil.ReadFile(c.rootsFile)
+		if err != nil {
+			return err
+		}
+		for _, r := range strings.Fields(string(content)) {
+			roots = append(roots, isolateserver.HexDigest(r))
+		}
+	}
+	if len(roots) == 0 {
+		// Deleting everything is more likely a mistake than intended.
+		return errors.New("-root or -roots-file must be specified")
+	}
+	store, err := c.openStore()
+	if err != nil {
+		return err
+	}
+	deleted, err := store.Collect(roots, c.grace, c.dryRun)
+	for _, name := range deleted {
+		fmt.Fprintln(a.GetOut(), name)
+	}
+	if err != nil {
+		return err
+	}
+	if c.dryRun {
+		common.Infof("%d files would be deleted", len(deleted))
+	} else {
+		common.Infof("%d files deleted", len(deleted))
+	}
+	return nil
+}
+
+func (c *gcRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -5,9 +5,10 @@
 package main
 
 import (
-	"log"
 	"os"
 
+	"github.com/luci/luci-go/client/internal/auth"
+	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -18,11 +19,18 @@ var application = &subcommands.DefaultApplication{
 	Commands: []*subcommands.Command{
 		cmdArchive,
 		cmdDownload,
+		cmdGC,
 		subcommands.CmdHelp,
+		auth.SubcommandInfo,
+		auth.SubcommandLogin,
+		auth.SubcommandLogout,
+		cmdRequest,
+		cmdVerify,
 	},
 }
 
 func main() {
-	log.SetFlags(log.Lmicroseconds)
+	// Commands cancel their context on Ctrl-C.
+	interrupt.HandleCtrlC()
 	os.Exit(subcommands.Run(application, nil))
 }
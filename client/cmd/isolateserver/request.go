@@ -0,0 +1,68 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/subcommands"
+)
+
+var cmdRequest = &subcommands.Command{
+	UsageLine: "request <options> <path>...",
+	ShortDesc: "requests files from a tree served by download -lazy",
+	LongDesc: `Asks the tree served by "download -lazy" on the Unix socket -socket to map the
+files listed, relative to the root of the tree. It returns once they can be
+opened, so scripts can call it before reading files of the tree.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := requestRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.Flags.StringVar(&c.socket, "socket", "", "Unix socket the tree is served on")
+		return &c
+	},
+}
+
+type requestRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	socket string
+}
+
+func (c *requestRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if c.socket == "" {
+		return errors.New("-socket must be specified")
+	}
+	if len(args) == 0 {
+		return errors.New("at least one path must be specified")
+	}
+	return nil
+}
+
+func (c *requestRun) main(a subcommands.Application, args []string) error {
+	for _, p := range args {
+		if err := isolateserver.RequestFile(c.socket, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *requestRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,59 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/luci/luci-go/client/isolateserver/localserver"
+	"github.com/maruel/ut"
+)
+
+func TestRequestLazyTree(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer isolateserver.RemoveTree(td)
+	s, err := localserver.New(filepath.Join(td, "store"))
+	ut.AssertEqual(t, nil, err)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	content := []byte("content of a/b")
+	digest := pushTree(t, ts.URL, content)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := isolateserver.New(nil, ts.URL, "default-gzip", "sha-1", "flate")
+	out := filepath.Join(td, "out")
+	tree, err := isolateserver.NewLazyTree(ctx, client, isolateserver.MakeMemoryCache(sha1.New), digest, out, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, os.MkdirAll(out, 0755))
+	socket := filepath.Join(td, "socket")
+	l, err := net.Listen("unix", socket)
+	ut.AssertEqual(t, nil, err)
+	go tree.Serve(ctx, l)
+
+	// Files aren't mapped until requested.
+	_, err = os.Stat(filepath.Join(out, "a", "b"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	r := cmdRequest.CommandRun()
+	ut.AssertEqual(t, nil, r.GetFlags().Parse([]string{"-socket", socket, "a/b"}))
+	ut.AssertEqual(t, 0, r.Run(application, r.GetFlags().Args()))
+	actual, err := ioutil.ReadFile(filepath.Join(out, "a", "b"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, actual)
+	ut.AssertEqual(t, []string{"a/b"}, tree.Accessed().Files)
+
+	r = cmdRequest.CommandRun()
+	ut.AssertEqual(t, nil, r.GetFlags().Parse([]string{"-socket", socket, "missing"}))
+	ut.AssertEqual(t, 1, r.Run(application, r.GetFlags().Args()))
+}
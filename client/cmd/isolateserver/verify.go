@@ -0,0 +1,99 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/maruel/subcommands"
+)
+
+var cmdVerify = &subcommands.Command{
+	UsageLine: "verify <options>",
+	ShortDesc: "verifies the items stored by a local isolate server",
+	LongDesc: `Verifies that the content of each item of a namespace stored by a local
+isolate server matches its digest. Corrupted items are listed, and deleted with
+-delete so they can be uploaded again.`,
+	CommandRun: func() subcommands.CommandRun {
+		c := verifyRun{}
+		c.commonFlags.Init(&c.CommandRunBase)
+		c.storeFlags.Init(&c.CommandRunBase)
+		c.Flags.BoolVar(&c.delete, "delete", false, "Delete the corrupted items")
+		return &c
+	},
+}
+
+type verifyRun struct {
+	subcommands.CommandRunBase
+	commonFlags
+	storeFlags
+	delete bool
+}
+
+func (c *verifyRun) Parse(a subcommands.Application, args []string) error {
+	if err := c.commonFlags.Parse(); err != nil {
+		return err
+	}
+	if err := c.storeFlags.Parse(); err != nil {
+		return err
+	}
+	if len(args) != 0 {
+		return errors.New("position arguments not expected")
+	}
+	return nil
+}
+
+func (c *verifyRun) main(a subcommands.Application, args []string) error {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	store, err := c.openStore()
+	if err != nil {
+		return err
+	}
+	entries, err := store.List()
+	if err != nil {
+		return err
+	}
+	corrupted := 0
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if e.Digest == "" {
+			continue
+		}
+		if err := store.Verify(e.Digest); err != nil {
+			corrupted++
+			fmt.Fprintf(a.GetOut(), "%s: %s\n", e.Digest, err)
+			if c.delete {
+				if err := store.Delete(e.Digest); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		common.Debugf("%s: ok", e.Digest)
+	}
+	if corrupted != 0 {
+		return fmt.Errorf("%d corrupted items out of %d", corrupted, len(entries))
+	}
+	return nil
+}
+
+func (c *verifyRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
+	if err := c.Parse(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	if err := c.main(a, args); err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
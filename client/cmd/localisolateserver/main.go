@@ -0,0 +1,50 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// localisolateserver serves the isolate server API from a local directory,
+// to run the isolate and swarming workflows offline.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver/localserver"
+)
+
+func mainImpl() error {
+	root := flag.String("root", "isolate-store", "Directory to store the items in")
+	addr := flag.String("http", "localhost:8080", "Address to listen on")
+	inlineMax := flag.Int64("inline-max-size", localserver.DefaultInlineMaxSize,
+		"Items larger than this are transferred through signed URLs")
+	verbose := flag.Bool("verbose", false, "Get more output")
+	logFile := flag.String("log", "", "Name of log file; it is rotated when it grows too large")
+	flag.Parse()
+	if flag.NArg() != 0 {
+		return fmt.Errorf("unexpected arguments: %s", flag.Args())
+	}
+	logCloser, err := common.SetupLogging(*verbose, *logFile)
+	if err != nil {
+		return err
+	}
+	defer logCloser.Close()
+	s, err := localserver.New(*root)
+	if err != nil {
+		return err
+	}
+	s.InlineMaxSize = *inlineMax
+	// The clients accept http:// for loopback hosts only.
+	fmt.Fprintf(os.Stderr, "Serving %s on http://%s\n", *root, *addr)
+	return http.ListenAndServe(*addr, s)
+}
+
+func main() {
+	if err := mainImpl(); err != nil {
+		fmt.Fprintf(os.Stderr, "localisolateserver: %s\n", err)
+		os.Exit(1)
+	}
+}
@@ -6,8 +6,11 @@ package main
 
 import (
 	"errors"
+	"io"
+	"net/http"
 	"os"
 
+	"github.com/luci/luci-go/client/internal/auth"
 	"github.com/luci/luci-go/client/internal/common"
 	"github.com/maruel/subcommands"
 )
@@ -16,16 +19,25 @@ type commonFlags struct {
 	subcommands.CommandRunBase
 	serverURL string
 	verbose   bool
+	authFlags auth.Flags
+	// logCloser closes the log output; it is set by Parse.
+	logCloser io.Closer
 }
 
 // Init initializes common flags.
 func (c *commonFlags) Init() {
 	c.Flags.StringVar(&c.serverURL, "server", os.Getenv("SWARMING_SERVER"), "Server URL; required. Set $SWARMING_SERVER to set a default.")
 	c.Flags.BoolVar(&c.verbose, "verbose", false, "Enable logging.")
+	c.authFlags.Init(&c.Flags)
 }
 
-// Parse parses the common flags.
+// Parse parses the common flags. Close must be called once the command is
+// done.
 func (c *commonFlags) Parse(a subcommands.Application) error {
+	var err error
+	if c.logCloser, err = common.SetupLogging(c.verbose, ""); err != nil {
+		return err
+	}
 	if c.serverURL == "" {
 		return errors.New("must provide -server")
 	}
@@ -36,3 +48,15 @@ func (c *commonFlags) Parse(a subcommands.Application) error {
 	c.serverURL = s
 	return nil
 }
+
+// Close closes the log file opened by Parse, if any.
+func (c *commonFlags) Close() {
+	if c.logCloser != nil {
+		c.logCloser.Close()
+	}
+}
+
+// createAuthClient returns the *http.Client to use to talk to the server.
+func (c *commonFlags) createAuthClient() (*http.Client, error) {
+	return auth.NewClient(c.authFlags.Options)
+}
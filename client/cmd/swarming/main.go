@@ -5,9 +5,10 @@
 package main
 
 import (
-	"log"
 	"os"
 
+	"github.com/luci/luci-go/client/internal/auth"
+	"github.com/maruel/interrupt"
 	"github.com/maruel/subcommands"
 )
 
@@ -17,11 +18,15 @@ var application = &subcommands.DefaultApplication{
 	// Keep in alphabetical order of their name.
 	Commands: []*subcommands.Command{
 		subcommands.CmdHelp,
+		auth.SubcommandInfo,
+		auth.SubcommandLogin,
+		auth.SubcommandLogout,
 		cmdRequestShow,
 	},
 }
 
 func main() {
-	log.SetFlags(log.Lmicroseconds)
+	// Commands cancel their context on Ctrl-C.
+	interrupt.HandleCtrlC()
 	os.Exit(subcommands.Run(application, nil))
 }
@@ -5,9 +5,11 @@
 package main
 
 import (
+	"context"
 	"fmt"
 
 	"github.com/kr/pretty"
+	"github.com/luci/luci-go/client/internal/common"
 	"github.com/luci/luci-go/client/swarming"
 	"github.com/maruel/subcommands"
 )
@@ -28,14 +30,20 @@ type requestShowRun struct {
 }
 
 func (c *requestShowRun) main(a subcommands.Application, taskid string) error {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
 	if err := c.Parse(a); err != nil {
 		return err
 	}
-	s, err := swarming.New(c.serverURL)
+	client, err := c.createAuthClient()
 	if err != nil {
 		return err
 	}
-	r, err := s.FetchRequest(swarming.TaskID(taskid))
+	s, err := swarming.New(client, c.serverURL)
+	if err != nil {
+		return err
+	}
+	r, err := s.FetchRequest(ctx, swarming.TaskID(taskid))
 	if err != nil {
 		return fmt.Errorf("failed to load task %s: %s", taskid, err)
 	}
@@ -44,6 +52,7 @@ func (c *requestShowRun) main(a subcommands.Application, taskid string) error {
 }
 
 func (c *requestShowRun) Run(a subcommands.Application, args []string) int {
+	defer c.commonFlags.Close()
 	if len(args) != 1 {
 		fmt.Fprintf(a.GetErr(), "%s: Must only provide a task id.\n", a.GetName())
 		return 1
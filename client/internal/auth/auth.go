@@ -0,0 +1,291 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OAuthScope is the scope requested for the access tokens.
+const OAuthScope = "https://www.googleapis.com/auth/userinfo.email"
+
+// DefaultTokenURL is the OAuth2 token endpoint.
+const DefaultTokenURL = "https://www.googleapis.com/oauth2/v3/token"
+
+// ErrNoCredentials is returned by Authenticator.Token when neither a service
+// account nor a cached refresh token is available.
+var ErrNoCredentials = errors.New("no credentials; use the login subcommand or -service-account-json")
+
+// expiryMargin is how long before its expiration a token is refreshed.
+const expiryMargin = time.Minute
+
+// Token is an OAuth2 access token.
+type Token struct {
+	AccessToken string    `json:"access_token"`
+	Expiry      time.Time `json:"expiry"`
+}
+
+// valid returns true if the token can still be used.
+func (t *Token) valid() bool {
+	return t != nil && t.AccessToken != "" && time.Now().Add(expiryMargin).Before(t.Expiry)
+}
+
+// Options configures an Authenticator.
+type Options struct {
+	// ServiceAccountJSON is the path to a service account JSON key. When set,
+	// it is used instead of the cached refresh token.
+	ServiceAccountJSON string
+	// TokenCache is the path of the file caching the refresh token obtained by
+	// Login. Defaults to ~/.luci-go-auth-token.json.
+	TokenCache string
+	// ClientID and ClientSecret identify the OAuth2 client used by Login.
+	ClientID     string
+	ClientSecret string
+	// TokenURL is the OAuth2 token endpoint. Defaults to DefaultTokenURL, or to
+	// the token_uri of the service account key.
+	TokenURL string
+}
+
+// Flags registers the authentication flags.
+type Flags struct {
+	Options
+}
+
+// Init registers the flags in f.
+func (f *Flags) Init(fs *flag.FlagSet) {
+	fs.StringVar(&f.ServiceAccountJSON, "service-account-json", "",
+		"Path to a service account JSON key to authenticate with")
+	fs.StringVar(&f.TokenCache, "auth-token-cache", "",
+		"Path of the cached refresh token; defaults to ~/.luci-go-auth-token.json")
+	fs.StringVar(&f.ClientID, "auth-client-id", os.Getenv("LUCI_AUTH_CLIENT_ID"),
+		"OAuth2 client ID used by login; defaults to $LUCI_AUTH_CLIENT_ID")
+	fs.StringVar(&f.ClientSecret, "auth-client-secret", os.Getenv("LUCI_AUTH_CLIENT_SECRET"),
+		"OAuth2 client secret used by login; defaults to $LUCI_AUTH_CLIENT_SECRET")
+}
+
+// tokenProvider mints new access tokens.
+type tokenProvider interface {
+	mintToken(ctx context.Context) (*Token, error)
+}
+
+// Authenticator produces authenticated HTTP clients.
+type Authenticator struct {
+	opts Options
+
+	lock     sync.Mutex
+	provider tokenProvider
+	token    *Token
+}
+
+// NewAuthenticator returns an Authenticator using opts.
+func NewAuthenticator(opts Options) *Authenticator {
+	if opts.TokenCache == "" {
+		opts.TokenCache = defaultTokenCache()
+	}
+	return &Authenticator{opts: opts}
+}
+
+// NewClient returns an *http.Client for opts.
+//
+// It returns http.DefaultClient when no credentials are available so
+// unauthenticated servers keep working.
+func NewClient(opts Options) (*http.Client, error) {
+	a := NewAuthenticator(opts)
+	if _, err := a.Token(context.Background(), false); err != nil {
+		if err == ErrNoCredentials {
+			return http.DefaultClient, nil
+		}
+		return nil, err
+	}
+	return a.Client(), nil
+}
+
+// Client returns an *http.Client adding a bearer token to every request.
+//
+// When the server replies with 401, the token is refreshed and the request is
+// retried once.
+func (a *Authenticator) Client() *http.Client {
+	return &http.Client{Transport: &transport{auth: a, base: http.DefaultTransport}}
+}
+
+// Token returns a valid access token, minting a new one if needed or if
+// forceRefresh is true.
+func (a *Authenticator) Token(ctx context.Context, forceRefresh bool) (*Token, error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if !forceRefresh && a.token.valid() {
+		return a.token, nil
+	}
+	if a.provider == nil {
+		p, err := a.loadProvider()
+		if err != nil {
+			return nil, err
+		}
+		a.provider = p
+	}
+	t, err := a.provider.mintToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	a.token = t
+	return t, nil
+}
+
+// loadProvider returns the token provider matching the options.
+func (a *Authenticator) loadProvider() (tokenProvider, error) {
+	if a.opts.ServiceAccountJSON != "" {
+		return loadServiceAccount(a.opts.ServiceAccountJSON, a.opts.TokenURL)
+	}
+	c, err := loadTokenCache(a.opts.TokenCache)
+	if err != nil {
+		return nil, err
+	}
+	if c == nil {
+		return nil, ErrNoCredentials
+	}
+	return &refreshTokenProvider{cache: c, tokenURL: a.tokenURL()}, nil
+}
+
+func (a *Authenticator) tokenURL() string {
+	if a.opts.TokenURL != "" {
+		return a.opts.TokenURL
+	}
+	return DefaultTokenURL
+}
+
+// TokenInfo describes an access token as returned by the tokeninfo endpoint.
+type TokenInfo struct {
+	Email     string `json:"email"`
+	Scope     string `json:"scope"`
+	ExpiresIn int    `json:"expires_in"`
+}
+
+// Info returns information about the current access token.
+func (a *Authenticator) Info(ctx context.Context, tokenInfoURL string) (*TokenInfo, error) {
+	t, err := a.Token(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenInfoURL+"?access_token="+url.QueryEscape(t.AccessToken), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tokeninfo returned http status %d", resp.StatusCode)
+	}
+	info := &TokenInfo{}
+	if err := json.NewDecoder(resp.Body).Decode(info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// transport adds the access token to requests.
+type transport struct {
+	auth *Authenticator
+	base http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.auth.Token(req.Context(), false)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(withToken(req, token))
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	// The token may have been revoked or expired early. Refresh it and retry
+	// once, if the body can be sent again.
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil
+	}
+	retry := req
+	if req.Body != nil {
+		body, err := req.GetBody()
+		if err != nil {
+			return resp, nil
+		}
+		retry = req.Clone(req.Context())
+		retry.Body = body
+	}
+	if token, err = t.auth.Token(req.Context(), true); err != nil {
+		return resp, nil
+	}
+	resp.Body.Close()
+	return t.base.RoundTrip(withToken(retry, token))
+}
+
+// withToken returns a copy of req with the Authorization header set, as a
+// RoundTripper must not modify its request.
+func withToken(req *http.Request, token *Token) *http.Request {
+	out := req.Clone(req.Context())
+	out.Header.Set("Authorization", "Bearer "+token.AccessToken)
+	return out
+}
+
+func defaultTokenCache() string {
+	usr, err := user.Current()
+	if err != nil {
+		return ".luci-go-auth-token.json"
+	}
+	return filepath.Join(usr.HomeDir, ".luci-go-auth-token.json")
+}
+
+// tokenResponse is the reply of the OAuth2 token endpoint.
+type tokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	TokenType    string `json:"token_type"`
+	Error        string `json:"error"`
+	Description  string `json:"error_description"`
+}
+
+// postTokenRequest sends a form to the OAuth2 token endpoint.
+func postTokenRequest(ctx context.Context, tokenURL string, form url.Values) (*tokenResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't resolve %s: %s", tokenURL, err)
+	}
+	defer resp.Body.Close()
+	out := &tokenResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return nil, fmt.Errorf("bad response from %s: %s", tokenURL, err)
+	}
+	if resp.StatusCode != http.StatusOK || out.AccessToken == "" {
+		return nil, fmt.Errorf("failed to get a token (http status %d): %s %s", resp.StatusCode, out.Error, out.Description)
+	}
+	return out, nil
+}
+
+func (t *tokenResponse) token() *Token {
+	return &Token{
+		AccessToken: t.AccessToken,
+		Expiry:      time.Now().Add(time.Duration(t.ExpiresIn) * time.Second),
+	}
+}
@@ -0,0 +1,128 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/maruel/ut"
+)
+
+// fakeOAuthServer mints sequential tokens and serves /api, which only accepts
+// the latest token.
+type fakeOAuthServer struct {
+	t   *testing.T
+	key *rsa.PublicKey
+
+	lock   sync.Mutex
+	minted int
+	bodies []string
+}
+
+func (f *fakeOAuthServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	switch r.URL.Path {
+	case "/token":
+		ut.AssertEqual(f.t, nil, r.ParseForm())
+		ut.AssertEqual(f.t, jwtGrantType, r.PostForm.Get("grant_type"))
+		parts := strings.Split(r.PostForm.Get("assertion"), ".")
+		ut.AssertEqual(f.t, 3, len(parts))
+		sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+		ut.AssertEqual(f.t, nil, err)
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		ut.AssertEqual(f.t, nil, rsa.VerifyPKCS1v15(f.key, crypto.SHA256, digest[:], sig))
+		f.minted++
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token": fmt.Sprintf("token%d", f.minted),
+			"expires_in":   3600,
+		})
+	case "/api":
+		body, _ := ioutil.ReadAll(r.Body)
+		f.bodies = append(f.bodies, string(body))
+		if r.Header.Get("Authorization") != fmt.Sprintf("Bearer token%d", f.minted) || f.minted < 2 {
+			// Pretend the first token was revoked.
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func writeServiceAccount(t *testing.T, dir, tokenURI string) *rsa.PrivateKey {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	ut.AssertEqual(t, nil, err)
+	encoded := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	k := &serviceAccountKey{
+		Type:         "service_account",
+		ClientEmail:  "bot@example.com",
+		PrivateKeyID: "key1",
+		PrivateKey:   string(encoded),
+		TokenURI:     tokenURI,
+	}
+	ut.AssertEqual(t, nil, common.WriteJSONFile(filepath.Join(dir, "key.json"), k))
+	return key
+}
+
+func TestServiceAccountRefreshOn401(t *testing.T) {
+	t.Parallel()
+	td, err := ioutil.TempDir("", "auth")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+
+	f := &fakeOAuthServer{t: t}
+	ts := httptest.NewServer(f)
+	defer ts.Close()
+	f.key = &writeServiceAccount(t, td, ts.URL+"/token").PublicKey
+
+	c, err := NewClient(Options{ServiceAccountJSON: filepath.Join(td, "key.json")})
+	ut.AssertEqual(t, nil, err)
+	resp, err := c.Post(ts.URL+"/api", "text/plain", strings.NewReader("payload"))
+	ut.AssertEqual(t, nil, err)
+	resp.Body.Close()
+	ut.AssertEqual(t, http.StatusOK, resp.StatusCode)
+	ut.AssertEqual(t, 2, f.minted)
+	// The body was sent again with the new token.
+	ut.AssertEqual(t, []string{"payload", "payload"}, f.bodies)
+}
+
+func TestNewClientWithoutCredentials(t *testing.T) {
+	t.Parallel()
+	c, err := NewClient(Options{TokenCache: filepath.Join(os.TempDir(), "does-not-exist.json")})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, http.DefaultClient, c)
+}
+
+func TestLoadServiceAccountInvalid(t *testing.T) {
+	t.Parallel()
+	td, err := ioutil.TempDir("", "auth")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+
+	p := filepath.Join(td, "key.json")
+	ut.AssertEqual(t, nil, common.WriteJSONFile(p, &serviceAccountKey{Type: "authorized_user"}))
+	_, err = loadServiceAccount(p, "")
+	ut.AssertEqual(t, true, err != nil)
+}
@@ -0,0 +1,10 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package auth implements OAuth2 authentication for the HTTP clients used to
+// talk to the Isolate and Swarming servers.
+//
+// Credentials come either from a service account JSON key or from a refresh
+// token obtained with the 'login' subcommand and cached on disk.
+package auth
@@ -0,0 +1,127 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// jwtGrantType is the grant type of the OAuth2 JWT bearer flow.
+const jwtGrantType = "urn:ietf:params:oauth:grant-type:jwt-bearer"
+
+// serviceAccountKey is the JSON key of a service account as downloaded from
+// the cloud console.
+type serviceAccountKey struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKeyID string `json:"private_key_id"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// serviceAccount mints access tokens by signing JWT assertions with the
+// service account private key.
+type serviceAccount struct {
+	email    string
+	keyID    string
+	key      *rsa.PrivateKey
+	tokenURL string
+}
+
+// loadServiceAccount reads a service account JSON key. tokenURL overrides the
+// token_uri of the key when not empty.
+func loadServiceAccount(path, tokenURL string) (*serviceAccount, error) {
+	k := &serviceAccountKey{}
+	if err := common.ReadJSONFile(path, k); err != nil {
+		return nil, err
+	}
+	if k.Type != "service_account" || k.ClientEmail == "" {
+		return nil, fmt.Errorf("%s is not a service account JSON key", path)
+	}
+	key, err := parsePrivateKey(k.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key in %s: %s", path, err)
+	}
+	if tokenURL == "" {
+		tokenURL = k.TokenURI
+	}
+	if tokenURL == "" {
+		tokenURL = DefaultTokenURL
+	}
+	return &serviceAccount{k.ClientEmail, k.PrivateKeyID, key, tokenURL}, nil
+}
+
+func (s *serviceAccount) mintToken(ctx context.Context) (*Token, error) {
+	assertion, err := s.assertion(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{"grant_type": {jwtGrantType}, "assertion": {assertion}}
+	resp, err := postTokenRequest(ctx, s.tokenURL, form)
+	if err != nil {
+		return nil, err
+	}
+	return resp.token(), nil
+}
+
+// assertion returns a signed JWT valid for one hour from now.
+func (s *serviceAccount) assertion(now time.Time) (string, error) {
+	header := map[string]string{"alg": "RS256", "typ": "JWT"}
+	if s.keyID != "" {
+		header["kid"] = s.keyID
+	}
+	claims := map[string]interface{}{
+		"iss":   s.email,
+		"scope": OAuthScope,
+		"aud":   s.tokenURL,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	}
+	h, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	c, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(h) + "." + base64.RawURLEncoding.EncodeToString(c)
+	digest := sha256.Sum256([]byte(payload))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, s.key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// parsePrivateKey decodes a PEM encoded PKCS#8 or PKCS#1 RSA private key.
+func parsePrivateKey(data string) (*rsa.PrivateKey, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	if key, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := key.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("not a RSA key")
+		}
+		return rsaKey, nil
+	}
+	return x509.ParsePKCS1PrivateKey(block.Bytes)
+}
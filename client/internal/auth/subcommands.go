@@ -0,0 +1,112 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/maruel/subcommands"
+)
+
+// TokenInfoURL is the endpoint describing an access token.
+const TokenInfoURL = "https://www.googleapis.com/oauth2/v1/tokeninfo"
+
+// SubcommandLogin caches a refresh token for the user.
+var SubcommandLogin = &subcommands.Command{
+	UsageLine: "login <options>",
+	ShortDesc: "performs interactive login flow",
+	LongDesc:  "Performs the interactive OAuth2 login flow and caches the resulting refresh token.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &loginRun{}
+		c.authFlags.Init(&c.Flags)
+		return c
+	},
+}
+
+// SubcommandLogout deletes the cached refresh token.
+var SubcommandLogout = &subcommands.Command{
+	UsageLine: "logout <options>",
+	ShortDesc: "removes cached credentials",
+	LongDesc:  "Removes the refresh token cached by login.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &logoutRun{}
+		c.authFlags.Init(&c.Flags)
+		return c
+	},
+}
+
+// SubcommandInfo prints the identity the other subcommands authenticate as.
+var SubcommandInfo = &subcommands.Command{
+	UsageLine: "info <options>",
+	ShortDesc: "prints the current identity",
+	LongDesc:  "Prints the email and scopes of the credentials used by the other subcommands.",
+	CommandRun: func() subcommands.CommandRun {
+		c := &infoRun{}
+		c.authFlags.Init(&c.Flags)
+		return c
+	},
+}
+
+type loginRun struct {
+	subcommands.CommandRunBase
+	authFlags Flags
+}
+
+func (c *loginRun) Run(a subcommands.Application, args []string) int {
+	return runAuth(a, args, func(ctx context.Context) error {
+		if err := NewAuthenticator(c.authFlags.Options).Login(ctx, os.Stdin, a.GetOut()); err != nil {
+			return err
+		}
+		fmt.Fprintln(a.GetOut(), "Login successful.")
+		return nil
+	})
+}
+
+type logoutRun struct {
+	subcommands.CommandRunBase
+	authFlags Flags
+}
+
+func (c *logoutRun) Run(a subcommands.Application, args []string) int {
+	return runAuth(a, args, func(ctx context.Context) error {
+		return NewAuthenticator(c.authFlags.Options).Logout()
+	})
+}
+
+type infoRun struct {
+	subcommands.CommandRunBase
+	authFlags Flags
+}
+
+func (c *infoRun) Run(a subcommands.Application, args []string) int {
+	return runAuth(a, args, func(ctx context.Context) error {
+		info, err := NewAuthenticator(c.authFlags.Options).Info(ctx, TokenInfoURL)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(a.GetOut(), "Logged in as %s.\nScopes: %s\nExpires in %ds.\n", info.Email, info.Scope, info.ExpiresIn)
+		return nil
+	})
+}
+
+func runAuth(a subcommands.Application, args []string, f func(ctx context.Context) error) int {
+	ctx, cancel := common.CancelOnInterrupt(context.Background())
+	defer cancel()
+	var err error
+	if len(args) != 0 {
+		err = errors.New("position arguments not expected")
+	} else {
+		err = f(ctx)
+	}
+	if err != nil {
+		fmt.Fprintf(a.GetErr(), "%s: %s\n", a.GetName(), err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,129 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package auth
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// Endpoints and redirect URI of the OAuth2 installed application flow.
+const (
+	authURL     = "https://accounts.google.com/o/oauth2/auth"
+	redirectURI = "urn:ietf:wg:oauth:2.0:oob"
+)
+
+// tokenCache is the content of the token cache file written by Login.
+type tokenCache struct {
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// loadTokenCache returns the cached refresh token, or nil if there is none.
+func loadTokenCache(path string) (*tokenCache, error) {
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return nil, nil
+	}
+	c := &tokenCache{}
+	if err := common.ReadJSONFile(path, c); err != nil {
+		return nil, err
+	}
+	if c.RefreshToken == "" {
+		return nil, nil
+	}
+	return c, nil
+}
+
+// refreshTokenProvider mints access tokens from a cached refresh token.
+type refreshTokenProvider struct {
+	cache    *tokenCache
+	tokenURL string
+}
+
+func (r *refreshTokenProvider) mintToken(ctx context.Context) (*Token, error) {
+	form := url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {r.cache.ClientID},
+		"client_secret": {r.cache.ClientSecret},
+		"refresh_token": {r.cache.RefreshToken},
+	}
+	resp, err := postTokenRequest(ctx, r.tokenURL, form)
+	if err != nil {
+		return nil, fmt.Errorf("failed to refresh the token, try to login again: %s", err)
+	}
+	return resp.token(), nil
+}
+
+// Login runs the OAuth2 installed application flow: the user opens the printed
+// URL, grants access and pastes back the code read from in. The resulting
+// refresh token is cached in the token cache.
+func (a *Authenticator) Login(ctx context.Context, in io.Reader, out io.Writer) error {
+	if a.opts.ServiceAccountJSON != "" {
+		return errors.New("login is not needed with a service account")
+	}
+	if a.opts.ClientID == "" || a.opts.ClientSecret == "" {
+		return errors.New("login requires -auth-client-id and -auth-client-secret")
+	}
+	v := url.Values{
+		"client_id":     {a.opts.ClientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {OAuthScope},
+		"access_type":   {"offline"},
+	}
+	fmt.Fprintf(out, "Visit the following URL and paste the code:\n\n  %s?%s\n\nCode: ", authURL, v.Encode())
+	code, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return err
+	}
+	code = strings.TrimSpace(code)
+	if code == "" {
+		return errors.New("no code entered")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {a.opts.ClientID},
+		"client_secret": {a.opts.ClientSecret},
+		"redirect_uri":  {redirectURI},
+		"code":          {code},
+	}
+	resp, err := postTokenRequest(ctx, a.tokenURL(), form)
+	if err != nil {
+		return err
+	}
+	if resp.RefreshToken == "" {
+		return errors.New("the server didn't return a refresh token")
+	}
+	c := &tokenCache{a.opts.ClientID, a.opts.ClientSecret, resp.RefreshToken}
+	if err := common.WriteJSONFile(a.opts.TokenCache, c); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.provider = &refreshTokenProvider{cache: c, tokenURL: a.tokenURL()}
+	a.token = resp.token()
+	return nil
+}
+
+// Logout deletes the cached refresh token.
+func (a *Authenticator) Logout() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.provider = nil
+	a.token = nil
+	if err := os.Remove(a.opts.TokenCache); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
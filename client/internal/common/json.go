@@ -6,66 +6,172 @@ package common
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"time"
 )
 
 const jsonContentType = "application/json; charset=utf-8"
 
 // GetJSON does a simple HTTP GET on a JSON endpoint.
 //
-// Returns the status code and the error, if any.
-func GetJSON(c *http.Client, url string, out interface{}) (int, error) {
-	if c == nil {
-		c = http.DefaultClient
-	}
-	resp, err := c.Get(url)
-	if err != nil {
-		return 0, fmt.Errorf("couldn't resolve %s: %s", url, err)
-	}
-	return decodeJSONResponse(resp, url, out)
+// Returns the status code and the error, if any. The request is aborted when
+// ctx is canceled.
+func GetJSON(ctx context.Context, c *http.Client, url string, out interface{}) (int, error) {
+	return GetJSONWithRetry(ctx, c, nil, url, out)
+}
+
+// GetJSONWithRetry is GetJSON retrying transient errors according to p.
+func GetJSONWithRetry(ctx context.Context, c *http.Client, p *RetryPolicy, url string, out interface{}) (int, error) {
+	return doJSON(ctx, c, p, "GET", url, nil, out)
 }
 
 // PostJSON does a HTTP POST on a JSON endpoint.
 //
-// Returns the status code and the error, if any.
-func PostJSON(c *http.Client, url string, in, out interface{}) (int, error) {
-	if c == nil {
-		c = http.DefaultClient
-	}
+// Returns the status code and the error, if any. The request is aborted when
+// ctx is canceled.
+func PostJSON(ctx context.Context, c *http.Client, url string, in, out interface{}) (int, error) {
+	return PostJSONWithRetry(ctx, c, nil, url, in, out)
+}
+
+// PostJSONWithRetry is PostJSON retrying transient errors according to p.
+//
+// It must only be used for idempotent calls.
+func PostJSONWithRetry(ctx context.Context, c *http.Client, p *RetryPolicy, url string, in, out interface{}) (int, error) {
 	if in == nil {
 		in = map[string]string{}
 	}
 	encoded, err := json.Marshal(in)
 	if err != nil {
-		return 0, nil
+		return 0, fmt.Errorf("failed to encode request for %s: %s", url, err)
 	}
-	resp, err := c.Post(url, jsonContentType, bytes.NewBuffer(encoded))
-	if err != nil {
-		return 0, fmt.Errorf("couldn't resolve %s: %s", url, err)
+	return doJSON(ctx, c, p, "POST", url, encoded, out)
+}
+
+// doJSON sends a request with an optional JSON body and decodes the JSON
+// response, retrying according to p.
+func doJSON(ctx context.Context, c *http.Client, p *RetryPolicy, method, url string, body []byte, out interface{}) (int, error) {
+	if c == nil {
+		c = http.DefaultClient
 	}
-	return decodeJSONResponse(resp, url, out)
+	status := 0
+	err := p.Do(ctx, method+" "+url, func() error {
+		var r io.Reader
+		if body != nil {
+			r = bytes.NewReader(body)
+		}
+		req, err := http.NewRequestWithContext(ctx, method, url, r)
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			req.Header.Set("Content-Type", jsonContentType)
+		}
+		resp, err := c.Do(req)
+		if err != nil {
+			status = 0
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &RetriableError{Err: fmt.Errorf("couldn't resolve %s: %s", url, err)}
+		}
+		retryAfter := ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())
+		status, err = decodeJSONResponse(resp, method, url, out)
+		if err != nil && IsRetriableStatus(status) {
+			return &RetriableError{Err: err, RetryAfter: retryAfter}
+		}
+		return err
+	})
+	return status, err
 }
 
-func decodeJSONResponse(resp *http.Response, url string, out interface{}) (int, error) {
+// maxErrorBody is the maximum number of bytes of a response body kept in an
+// APIError.
+const maxErrorBody = 1024
+
+// APIError is returned when a server replies with an error status or with a
+// response that is not the expected JSON.
+type APIError struct {
+	Method      string
+	URL         string
+	StatusCode  int
+	ContentType string
+	// Body is the beginning of the response body.
+	Body string
+	// Reason describes the failure.
+	Reason string
+}
+
+func (a *APIError) Error() string {
+	msg := fmt.Sprintf("%s %s: %s", a.Method, a.URL, a.Reason)
+	if a.Body != "" {
+		msg += ": " + a.Body
+	}
+	return msg
+}
+
+// IsNotFound returns true if err is or wraps an APIError with status 404.
+func IsNotFound(err error) bool {
+	var a *APIError
+	return errors.As(err, &a) && a.StatusCode == http.StatusNotFound
+}
+
+// IsAuthError returns true if err is or wraps an APIError with status 401 or
+// 403.
+func IsAuthError(err error) bool {
+	var a *APIError
+	return errors.As(err, &a) && (a.StatusCode == http.StatusUnauthorized || a.StatusCode == http.StatusForbidden)
+}
+
+// IsServerError returns true if err is or wraps an APIError with a 5xx status.
+func IsServerError(err error) bool {
+	var a *APIError
+	return errors.As(err, &a) && a.StatusCode >= 500
+}
+
+// newAPIError returns an APIError for resp, reading the beginning of its body.
+func newAPIError(resp *http.Response, method, url, reason string) *APIError {
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBody))
+	return &APIError{
+		Method:      method,
+		URL:         url,
+		StatusCode:  resp.StatusCode,
+		ContentType: resp.Header.Get("Content-Type"),
+		Body:        strings.TrimSpace(string(body)),
+		Reason:      reason,
+	}
+}
+
+func decodeJSONResponse(resp *http.Response, method, url string, out interface{}) (int, error) {
 	defer resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, newAPIError(resp, method, url, fmt.Sprintf("http status %d", resp.StatusCode))
+	}
+	ct := strings.ToLower(resp.Header.Get("Content-Type"))
+	if ct != jsonContentType {
+		reason := fmt.Sprintf("unexpected Content-Type, expected \"%s\", got \"%s\"", jsonContentType, ct)
+		return resp.StatusCode, newAPIError(resp, method, url, reason)
+	}
 	if out == nil {
 		// The client doesn't care about the response. Still ensure the response is
 		// valid json.
 		out = &map[string]interface{}{}
 	}
 	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
-		return resp.StatusCode, fmt.Errorf("bad response %s: %s", url, err)
-	}
-	ct := strings.ToLower(resp.Header.Get("Content-Type"))
-	if ct != jsonContentType {
-		return resp.StatusCode, fmt.Errorf("unexpected Content-Type, expected \"%s\", got \"%s\"", jsonContentType, ct)
-	}
-	if resp.StatusCode >= 400 {
-		return resp.StatusCode, fmt.Errorf("http status %d", resp.StatusCode)
+		return resp.StatusCode, &APIError{
+			Method:      method,
+			URL:         url,
+			StatusCode:  resp.StatusCode,
+			ContentType: ct,
+			Reason:      fmt.Sprintf("bad response: %s", err),
+		}
 	}
 	return resp.StatusCode, nil
 }
@@ -0,0 +1,56 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestGetJSONErrorPage(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte("<html>" + strings.Repeat("x", 2*maxErrorBody) + "</html>"))
+	}))
+	defer ts.Close()
+	status, err := GetJSON(context.Background(), nil, ts.URL, &map[string]string{})
+	ut.AssertEqual(t, http.StatusNotFound, status)
+	apiErr, ok := err.(*APIError)
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, "GET", apiErr.Method)
+	ut.AssertEqual(t, ts.URL, apiErr.URL)
+	ut.AssertEqual(t, "text/html", apiErr.ContentType)
+	ut.AssertEqual(t, maxErrorBody, len(apiErr.Body))
+	ut.AssertEqual(t, true, IsNotFound(err))
+	ut.AssertEqual(t, false, IsAuthError(err))
+	ut.AssertEqual(t, false, IsServerError(err))
+}
+
+func TestGetJSONBadContentType(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = w.Write([]byte("hello"))
+	}))
+	defer ts.Close()
+	status, err := GetJSON(context.Background(), nil, ts.URL, nil)
+	ut.AssertEqual(t, http.StatusOK, status)
+	apiErr, ok := err.(*APIError)
+	ut.AssertEqual(t, true, ok)
+	ut.AssertEqual(t, "hello", apiErr.Body)
+}
+
+func TestPostJSONEncodeError(t *testing.T) {
+	t.Parallel()
+	_, err := PostJSON(context.Background(), nil, "https://localhost:1", make(chan int), nil)
+	ut.AssertEqual(t, true, err != nil)
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Level is the severity of a log message.
+type Level int
+
+// Log levels, from the most to the least severe.
+const (
+	LevelError Level = iota
+	LevelWarning
+	LevelInfo
+	LevelDebug
+)
+
+var levelNames = []string{"E", "W", "I", "D"}
+
+func (l Level) String() string {
+	if l >= 0 && int(l) < len(levelNames) {
+		return levelNames[l]
+	}
+	return "?"
+}
+
+// Logger writes leveled messages to the console and optionally to a file.
+//
+// The console only receives the messages up to Level; the file receives all
+// of them.
+type Logger struct {
+	lock    sync.Mutex
+	console io.Writer
+	level   Level
+	file    io.Writer
+}
+
+// NewLogger returns a Logger writing the messages up to level to console and
+// all of them to file, if not nil.
+func NewLogger(console io.Writer, level Level, file io.Writer) *Logger {
+	return &Logger{console: console, level: level, file: file}
+}
+
+// Logf logs a message at the given level.
+func (l *Logger) Logf(level Level, format string, args ...interface{}) {
+	msg := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(msg, "\n") {
+		msg += "\n"
+	}
+	line := fmt.Sprintf("%s %s: %s", time.Now().Format("15:04:05.000000"), level, msg)
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.console != nil && level <= l.level {
+		_, _ = io.WriteString(l.console, line)
+	}
+	if l.file != nil {
+		_, _ = io.WriteString(l.file, line)
+	}
+}
+
+// Write implements io.Writer by logging p at LevelInfo, so the standard
+// logger can be redirected to a Logger.
+func (l *Logger) Write(p []byte) (int, error) {
+	l.Logf(LevelInfo, "%s", p)
+	return len(p), nil
+}
+
+// logger is used by the package level logging functions. By default it only
+// prints warnings and errors to stderr.
+var (
+	loggerLock sync.Mutex
+	logger     = NewLogger(os.Stderr, LevelWarning, nil)
+)
+
+// SetLogger replaces the logger used by the package level logging functions
+// and the standard logger.
+func SetLogger(l *Logger) {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+	log.SetFlags(0)
+	log.SetOutput(l)
+}
+
+func getLogger() *Logger {
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	return logger
+}
+
+// Errorf logs an error.
+func Errorf(format string, args ...interface{}) {
+	getLogger().Logf(LevelError, format, args...)
+}
+
+// Warningf logs a warning.
+func Warningf(format string, args ...interface{}) {
+	getLogger().Logf(LevelWarning, format, args...)
+}
+
+// Infof logs an informational message, printed on the console in verbose
+// mode.
+func Infof(format string, args ...interface{}) {
+	getLogger().Logf(LevelInfo, format, args...)
+}
+
+// Debugf logs a debugging message, printed on the console in verbose mode.
+func Debugf(format string, args ...interface{}) {
+	getLogger().Logf(LevelDebug, format, args...)
+}
+
+// Default rotation settings of the log file.
+const (
+	MaxLogSize    = 10 * 1024 * 1024
+	MaxLogBackups = 3
+)
+
+// SetupLogging configures the package level logger for a command line tool.
+//
+// Warnings and errors are printed to stderr, and all the messages when verbose
+// is true. If logFile is not empty, all the messages are appended to it; it is
+// rotated when it reaches MaxLogSize. The returned io.Closer closes the log
+// file.
+func SetupLogging(verbose bool, logFile string) (io.Closer, error) {
+	level := LevelWarning
+	if verbose {
+		level = LevelDebug
+	}
+	var file io.WriteCloser
+	if logFile != "" {
+		f, err := OpenRotatingFile(logFile, MaxLogSize, MaxLogBackups)
+		if err != nil {
+			return nil, err
+		}
+		file = f
+	}
+	if file == nil {
+		SetLogger(NewLogger(os.Stderr, level, nil))
+		return nopCloser{}, nil
+	}
+	SetLogger(NewLogger(os.Stderr, level, file))
+	return file, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+// RotatingFile is an io.WriteCloser appending to a file that is rotated once
+// it reaches a maximum size: path is renamed to path.1, path.1 to path.2 and
+// so on, keeping at most a given number of backups.
+type RotatingFile struct {
+	path    string
+	maxSize int64
+	backups int
+
+	lock sync.Mutex
+	f    *os.File
+	size int64
+}
+
+// OpenRotatingFile opens path for appending.
+func OpenRotatingFile(path string, maxSize int64, backups int) (*RotatingFile, error) {
+	r := &RotatingFile{path: path, maxSize: maxSize, backups: backups}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *RotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f = f
+	r.size = info.Size()
+	return nil
+}
+
+func (r *RotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	r.f = nil
+	if r.backups <= 0 {
+		if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return r.open()
+	}
+	for i := r.backups - 1; i > 0; i-- {
+		src := fmt.Sprintf("%s.%d", r.path, i)
+		if err := os.Rename(src, fmt.Sprintf("%s.%d", r.path, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		return err
+	}
+	return r.open()
+}
+
+func (r *RotatingFile) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *RotatingFile) Close() error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
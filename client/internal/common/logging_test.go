@@ -0,0 +1,66 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestLoggerLevels(t *testing.T) {
+	console := &bytes.Buffer{}
+	file := &bytes.Buffer{}
+	l := NewLogger(console, LevelWarning, file)
+	l.Logf(LevelError, "error %d", 1)
+	l.Logf(LevelInfo, "info\n")
+	l.Logf(LevelDebug, "debug")
+
+	lines := strings.Split(strings.TrimSpace(console.String()), "\n")
+	ut.AssertEqual(t, 1, len(lines))
+	ut.AssertEqual(t, true, strings.HasSuffix(lines[0], " E: error 1"))
+	lines = strings.Split(strings.TrimSpace(file.String()), "\n")
+	ut.AssertEqual(t, 3, len(lines))
+	ut.AssertEqual(t, true, strings.HasSuffix(lines[1], " I: info"))
+	ut.AssertEqual(t, true, strings.HasSuffix(lines[2], " D: debug"))
+}
+
+func TestRotatingFile(t *testing.T) {
+	td, err := ioutil.TempDir("", "logging")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	p := filepath.Join(td, "log")
+
+	r, err := OpenRotatingFile(p, 10, 2)
+	ut.AssertEqual(t, nil, err)
+	for _, s := range []string{"aaaaaa", "bbbbbb", "cccccc", "dddddd"} {
+		_, err := r.Write([]byte(s))
+		ut.AssertEqual(t, nil, err)
+	}
+	ut.AssertEqual(t, nil, r.Close())
+
+	for name, expected := range map[string]string{"log": "dddddd", "log.1": "cccccc", "log.2": "bbbbbb"} {
+		content, err := ioutil.ReadFile(filepath.Join(td, name))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, expected, string(content))
+	}
+	_, err = os.Stat(filepath.Join(td, "log.3"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// Reopening appends.
+	r, err = OpenRotatingFile(p, 10, 2)
+	ut.AssertEqual(t, nil, err)
+	_, err = r.Write([]byte("e"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, r.Close())
+	content, err := ioutil.ReadFile(p)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "dddddde", string(content))
+}
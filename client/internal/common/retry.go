@@ -0,0 +1,181 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/maruel/interrupt"
+)
+
+// DefaultRetryPolicy is the policy used for idempotent calls to the servers.
+var DefaultRetryPolicy = &RetryPolicy{
+	MaxAttempts:  5,
+	InitialDelay: 200 * time.Millisecond,
+	MaxDelay:     10 * time.Second,
+	Multiplier:   2,
+	Jitter:       0.2,
+	Deadline:     2 * time.Minute,
+	OnAttempt:    LogAttempt,
+}
+
+// Attempt describes a single attempt done by RetryPolicy.Do. It is passed to
+// RetryPolicy.OnAttempt.
+type Attempt struct {
+	// Name is the name of the operation, e.g. "GET https://host/path".
+	Name string
+	// Number is the 1-based number of the attempt.
+	Number int
+	// Err is the error returned by the attempt, nil on success.
+	Err error
+	// Delay is the time waited before the next attempt; 0 if the attempt is the
+	// last one.
+	Delay time.Duration
+}
+
+// RetryPolicy defines how an operation is retried on transient errors.
+//
+// Delays grow exponentially from InitialDelay up to MaxDelay with a random
+// jitter. A nil *RetryPolicy does a single attempt.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// InitialDelay is the delay before the second attempt.
+	InitialDelay time.Duration
+	// MaxDelay caps the delay between two attempts.
+	MaxDelay time.Duration
+	// Multiplier is the factor applied to the delay after each attempt.
+	Multiplier float64
+	// Jitter is the fraction of the delay randomly added or removed.
+	Jitter float64
+	// Deadline is the overall time budget for all the attempts; 0 means no
+	// deadline.
+	Deadline time.Duration
+	// OnAttempt, if set, is called after each attempt.
+	OnAttempt func(a *Attempt)
+}
+
+// LogAttempt logs the failed attempts as warnings.
+func LogAttempt(a *Attempt) {
+	if a.Err == nil {
+		return
+	}
+	if a.Delay != 0 {
+		Warningf("%s: attempt %d failed, retrying in %s: %s", a.Name, a.Number, a.Delay, a.Err)
+	} else {
+		Warningf("%s: attempt %d failed: %s", a.Name, a.Number, a.Err)
+	}
+}
+
+// RetriableError marks an error as transient so RetryPolicy.Do retries the
+// operation.
+type RetriableError struct {
+	Err error
+	// RetryAfter is the delay requested by the server, as per the Retry-After
+	// header; 0 if none.
+	RetryAfter time.Duration
+}
+
+func (r *RetriableError) Error() string {
+	return r.Err.Error()
+}
+
+// IsRetriableStatus returns true if an HTTP status code denotes a transient
+// error.
+func IsRetriableStatus(status int) bool {
+	switch status {
+	case http.StatusRequestTimeout, http.StatusTooManyRequests:
+		return true
+	}
+	return status >= 500 && status != http.StatusNotImplemented
+}
+
+// ParseRetryAfter returns the delay requested by a Retry-After header, which is
+// either a number of seconds or an HTTP date. It returns 0 if the header is
+// absent or invalid.
+func ParseRetryAfter(header string, now time.Time) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if s, err := strconv.Atoi(header); err == nil {
+		if s < 0 {
+			return 0
+		}
+		return time.Duration(s) * time.Second
+	}
+	if t, err := http.ParseTime(header); err == nil && t.After(now) {
+		return t.Sub(now)
+	}
+	return 0
+}
+
+// Do calls f until it succeeds, returns an error that is not a
+// *RetriableError, or the attempts or the deadline are exhausted.
+//
+// The returned error is the one of the last attempt, unwrapped. Returns
+// ctx.Err() if ctx is canceled and interrupt.ErrInterrupted if interrupted
+// while waiting.
+func (p *RetryPolicy) Do(ctx context.Context, name string, f func() error) error {
+	if p == nil {
+		return unwrapRetriable(f())
+	}
+	start := time.Now()
+	for attempt := 1; ; attempt++ {
+		err := f()
+		a := &Attempt{Name: name, Number: attempt, Err: unwrapRetriable(err)}
+		r, ok := err.(*RetriableError)
+		if ok && attempt < p.MaxAttempts {
+			a.Delay = p.delay(attempt)
+			if r.RetryAfter > a.Delay {
+				a.Delay = r.RetryAfter
+			}
+			if p.Deadline != 0 && time.Since(start)+a.Delay > p.Deadline {
+				a.Delay = 0
+			}
+			if d, ok := ctx.Deadline(); ok && time.Now().Add(a.Delay).After(d) {
+				a.Delay = 0
+			}
+		}
+		if p.OnAttempt != nil {
+			p.OnAttempt(a)
+		}
+		if a.Delay == 0 {
+			return a.Err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-interrupt.Channel:
+			return interrupt.ErrInterrupted
+		case <-time.After(a.Delay):
+		}
+	}
+}
+
+// delay returns the jittered delay to wait after the attempt-th attempt.
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	d := float64(p.InitialDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay != 0 && d > float64(p.MaxDelay) {
+		d = float64(p.MaxDelay)
+	}
+	d *= 1 + p.Jitter*(2*rand.Float64()-1)
+	if d < 1 {
+		// A zero delay means no retry.
+		d = 1
+	}
+	return time.Duration(d)
+}
+
+func unwrapRetriable(err error) error {
+	if r, ok := err.(*RetriableError); ok {
+		return r.Err
+	}
+	return err
+}
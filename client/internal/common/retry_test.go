@@ -0,0 +1,149 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/maruel/ut"
+)
+
+func testPolicy(attempts *[]*Attempt) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts:  3,
+		InitialDelay: time.Millisecond,
+		MaxDelay:     time.Millisecond,
+		Multiplier:   2,
+		OnAttempt:    func(a *Attempt) { *attempts = append(*attempts, a) },
+	}
+}
+
+func TestRetryPolicyDo(t *testing.T) {
+	t.Parallel()
+	var attempts []*Attempt
+	p := testPolicy(&attempts)
+	calls := 0
+	err := p.Do(context.Background(), "op", func() error {
+		calls++
+		if calls < 3 {
+			return &RetriableError{Err: errors.New("transient")}
+		}
+		return nil
+	})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, calls)
+	ut.AssertEqual(t, 3, len(attempts))
+	ut.AssertEqual(t, "transient", attempts[0].Err.Error())
+	ut.AssertEqual(t, true, attempts[0].Delay != 0)
+	ut.AssertEqual(t, nil, attempts[2].Err)
+	ut.AssertEqual(t, time.Duration(0), attempts[2].Delay)
+}
+
+func TestRetryPolicyDoFatal(t *testing.T) {
+	t.Parallel()
+	var attempts []*Attempt
+	calls := 0
+	err := testPolicy(&attempts).Do(context.Background(), "op", func() error {
+		calls++
+		return errors.New("fatal")
+	})
+	ut.AssertEqual(t, "fatal", err.Error())
+	ut.AssertEqual(t, 1, calls)
+
+	// A nil policy does a single attempt and unwraps the error.
+	var p *RetryPolicy
+	err = p.Do(context.Background(), "op", func() error {
+		calls++
+		return &RetriableError{Err: errors.New("transient")}
+	})
+	ut.AssertEqual(t, "transient", err.Error())
+	ut.AssertEqual(t, 2, calls)
+}
+
+func TestRetryPolicyDeadline(t *testing.T) {
+	t.Parallel()
+	var attempts []*Attempt
+	p := testPolicy(&attempts)
+	p.Deadline = time.Second
+	calls := 0
+	err := p.Do(context.Background(), "op", func() error {
+		calls++
+		return &RetriableError{Err: errors.New("transient"), RetryAfter: time.Hour}
+	})
+	ut.AssertEqual(t, "transient", err.Error())
+	ut.AssertEqual(t, 1, calls)
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	t.Parallel()
+	now := time.Date(2015, 6, 1, 0, 0, 0, 0, time.UTC)
+	ut.AssertEqual(t, time.Duration(0), ParseRetryAfter("", now))
+	ut.AssertEqual(t, 3*time.Second, ParseRetryAfter("3", now))
+	ut.AssertEqual(t, time.Duration(0), ParseRetryAfter("junk", now))
+	ut.AssertEqual(t, time.Minute, ParseRetryAfter("Mon, 01 Jun 2015 00:01:00 GMT", now))
+}
+
+func TestIsRetriableStatus(t *testing.T) {
+	t.Parallel()
+	data := map[int]bool{200: false, 400: false, 403: false, 404: false, 408: true, 429: true, 500: true, 501: false, 503: true}
+	for status, expected := range data {
+		ut.AssertEqualf(t, expected, IsRetriableStatus(status), "%d", status)
+	}
+}
+
+func TestGetJSONWithRetry(t *testing.T) {
+	t.Parallel()
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", jsonContentType)
+		_, _ = w.Write([]byte(`{"a":"b"}`))
+	}))
+	defer ts.Close()
+	var attempts []*Attempt
+	out := map[string]string{}
+	status, err := GetJSONWithRetry(context.Background(), nil, testPolicy(&attempts), ts.URL, &out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 200, status)
+	ut.AssertEqual(t, map[string]string{"a": "b"}, out)
+	ut.AssertEqual(t, 2, calls)
+}
+
+func TestRetryPolicyDoCanceled(t *testing.T) {
+	t.Parallel()
+	var attempts []*Attempt
+	p := testPolicy(&attempts)
+	p.InitialDelay = time.Hour
+	p.MaxDelay = time.Hour
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := p.Do(ctx, "op", func() error {
+		calls++
+		cancel()
+		return &RetriableError{Err: errors.New("transient")}
+	})
+	ut.AssertEqual(t, context.Canceled, err)
+	ut.AssertEqual(t, 1, calls)
+}
+
+func TestSemaphoreWaitContext(t *testing.T) {
+	t.Parallel()
+	s := NewSemaphore(1)
+	ut.AssertEqual(t, nil, s.WaitContext(context.Background()))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ut.AssertEqual(t, context.Canceled, s.WaitContext(ctx))
+	s.Signal()
+	ut.AssertEqual(t, nil, s.WaitContext(context.Background()))
+}
@@ -5,7 +5,9 @@
 package common
 
 import (
+	"context"
 	"errors"
+	"net"
 	"net/url"
 	"os"
 	"runtime"
@@ -15,13 +17,19 @@ import (
 )
 
 // URLToHTTPS ensures the url is https://.
+//
+// http:// is accepted for loopback hosts, e.g. a localisolateserver, since the
+// traffic doesn't leave the machine.
 func URLToHTTPS(s string) (string, error) {
 	u, err := url.Parse(s)
 	if err != nil {
 		return "", err
 	}
+	if u.Scheme == "http" && isLoopback(u.Hostname()) {
+		return s, nil
+	}
 	if u.Scheme != "" && u.Scheme != "https" {
-		return "", errors.New("Only https:// scheme is accepted. It can be omitted.")
+		return "", errors.New("Only https:// scheme is accepted, or http:// for localhost. It can be omitted.")
 	}
 	if !strings.HasPrefix(s, "https://") {
 		s = "https://" + s
@@ -32,6 +40,15 @@ func URLToHTTPS(s string) (string, error) {
 	return s, nil
 }
 
+// isLoopback returns true if host is localhost or a loopback IP address.
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
 // IsDirectory returns true if path is a directory and is accessible.
 func IsDirectory(path string) bool {
 	fileInfo, err := os.Stat(path)
@@ -49,6 +66,8 @@ type Semaphore interface {
 	// Returns interrupt.ErrInterrupted if interrupt was triggered. It may return
 	// nil even if the interrupt signal is set.
 	Wait() error
+	// WaitContext is Wait that also returns ctx.Err() when ctx is canceled.
+	WaitContext(ctx context.Context) error
 	// Signal adds 1 to the semaphore.
 	Signal()
 }
@@ -75,6 +94,31 @@ func (s semaphore) Wait() error {
 	}
 }
 
+func (s semaphore) WaitContext(ctx context.Context) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-interrupt.Channel:
+		return interrupt.ErrInterrupted
+	case <-s:
+		return nil
+	}
+}
+
 func (s semaphore) Signal() {
 	s <- true
 }
+
+// CancelOnInterrupt returns a context canceled when the interrupt signal is
+// set, e.g. on Ctrl-C once interrupt.HandleCtrlC() was called.
+func CancelOnInterrupt(parent context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-interrupt.Channel:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
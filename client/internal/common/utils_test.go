@@ -0,0 +1,34 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package common
+
+import (
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestURLToHTTPS(t *testing.T) {
+	t.Parallel()
+	data := []struct {
+		in       string
+		expected string
+		failed   bool
+	}{
+		{"isolate.example.com", "https://isolate.example.com", false},
+		{"https://isolate.example.com", "https://isolate.example.com", false},
+		{"http://isolate.example.com", "", true},
+		{"ftp://localhost", "", true},
+		// Loopback hosts can use http.
+		{"http://localhost:8080", "http://localhost:8080", false},
+		{"http://127.0.0.1:8080", "http://127.0.0.1:8080", false},
+		{"http://[::1]:8080", "http://[::1]:8080", false},
+	}
+	for i, line := range data {
+		actual, err := URLToHTTPS(line.in)
+		ut.AssertEqualIndex(t, i, line.failed, err != nil)
+		ut.AssertEqualIndex(t, i, line.expected, actual)
+	}
+}
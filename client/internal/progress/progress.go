@@ -0,0 +1,177 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package progress renders the progress of isolate operations for the command
+// line tools.
+package progress
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/luci/luci-go/client/isolateserver"
+)
+
+// Renderer implements isolateserver.Progress by printing the counters.
+//
+// On a terminal, a single line is updated in place. Otherwise a log line is
+// printed periodically when the counters changed. A nil *Renderer discards
+// the updates.
+type Renderer struct {
+	w        io.Writer
+	tty      bool
+	start    time.Time
+	counters [isolateserver.NumCounters]int64
+
+	stop     chan struct{}
+	done     chan struct{}
+	stopOnce sync.Once
+	// last is the last line printed, only used by the rendering goroutine.
+	last string
+}
+
+// IsTerminal returns true if f is a terminal.
+func IsTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// New starts rendering the progress to w until Stop is called.
+//
+// interval is the delay between updates. It defaults to 200ms on a terminal
+// and 10s otherwise.
+func New(w io.Writer, tty bool, interval time.Duration) *Renderer {
+	if interval == 0 {
+		interval = 10 * time.Second
+		if tty {
+			interval = 200 * time.Millisecond
+		}
+	}
+	r := &Renderer{
+		w:     w,
+		tty:   tty,
+		start: time.Now(),
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go r.run(interval)
+	return r
+}
+
+// NewAuto returns a Renderer printing to w, updating a single line if w is a
+// terminal.
+func NewAuto(w io.Writer) *Renderer {
+	f, ok := w.(*os.File)
+	return New(w, ok && IsTerminal(f), 0)
+}
+
+// Add implements isolateserver.Progress.
+func (r *Renderer) Add(c isolateserver.Counter, delta int64) {
+	if r == nil {
+		return
+	}
+	atomic.AddInt64(&r.counters[c], delta)
+}
+
+// Get returns the current value of the counter c.
+func (r *Renderer) Get(c isolateserver.Counter) int64 {
+	return atomic.LoadInt64(&r.counters[c])
+}
+
+// Stop prints the final state and stops the rendering.
+func (r *Renderer) Stop() {
+	if r == nil {
+		return
+	}
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		<-r.done
+	})
+}
+
+func (r *Renderer) run(interval time.Duration) {
+	defer close(r.done)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			r.print(false)
+		case <-r.stop:
+			r.print(true)
+			return
+		}
+	}
+}
+
+func (r *Renderer) print(final bool) {
+	line := r.Line(time.Since(r.start))
+	if line == "" || (line == r.last && !final) {
+		return
+	}
+	if r.tty {
+		// Rewrite the line in place and clear the rest of it.
+		fmt.Fprintf(r.w, "\r%s\033[K", line)
+		if final {
+			fmt.Fprintln(r.w)
+		}
+	} else if line != r.last {
+		fmt.Fprintln(r.w, line)
+	}
+	r.last = line
+}
+
+// Line returns the progress as a single line, given the elapsed time.
+func (r *Renderer) Line(elapsed time.Duration) string {
+	var parts []string
+	if files := r.Get(isolateserver.FilesHashed); files != 0 {
+		parts = append(parts, fmt.Sprintf("hashed %d files (%d cached, %s)",
+			files, r.Get(isolateserver.HashCacheHits), Size(r.Get(isolateserver.BytesHashed))))
+	}
+	if total := r.Get(isolateserver.ItemsToUpload); total != 0 {
+		done := r.Get(isolateserver.ItemsUploaded)
+		present := r.Get(isolateserver.ItemsPresent)
+		parts = append(parts, fmt.Sprintf("uploaded %d/%d items (%d present), %s",
+			done, total-present, present, transfer(r.Get(isolateserver.BytesUploaded), elapsed)))
+	}
+	if total := r.Get(isolateserver.ItemsToDownload); total != 0 {
+		done := r.Get(isolateserver.ItemsDownloaded)
+		present := r.Get(isolateserver.ItemsPresent)
+		parts = append(parts, fmt.Sprintf("downloaded %d/%d items (%d cached), %s",
+			done, total-present, present, transfer(r.Get(isolateserver.BytesDownloaded), elapsed)))
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("[%s] %s", elapsed/time.Second*time.Second, strings.Join(parts, "; "))
+}
+
+// transfer formats an amount of bytes transferred and the throughput.
+func transfer(bytes int64, elapsed time.Duration) string {
+	if elapsed < time.Millisecond {
+		return Size(bytes)
+	}
+	return fmt.Sprintf("%s at %s/s", Size(bytes), Size(int64(float64(bytes)/elapsed.Seconds())))
+}
+
+// Size formats a number of bytes in human readable form.
+func Size(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	value := float64(bytes)
+	for _, suffix := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.1f%s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1fPiB", value/unit)
+}
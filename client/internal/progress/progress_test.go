@@ -0,0 +1,73 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/ut"
+)
+
+func TestSize(t *testing.T) {
+	data := []struct {
+		in  int64
+		out string
+	}{
+		{0, "0B"},
+		{1023, "1023B"},
+		{1024, "1.0KiB"},
+		{1536, "1.5KiB"},
+		{3 * 1024 * 1024, "3.0MiB"},
+	}
+	for i, line := range data {
+		ut.AssertEqualIndex(t, i, line.out, Size(line.in))
+	}
+}
+
+func TestLine(t *testing.T) {
+	r := &Renderer{}
+	ut.AssertEqual(t, "", r.Line(time.Second))
+	r.Add(isolateserver.FilesHashed, 3)
+	r.Add(isolateserver.HashCacheHits, 1)
+	r.Add(isolateserver.BytesHashed, 2048)
+	r.Add(isolateserver.ItemsToUpload, 3)
+	r.Add(isolateserver.ItemsPresent, 1)
+	r.Add(isolateserver.ItemsUploaded, 1)
+	r.Add(isolateserver.BytesUploaded, 4096)
+	expected := "[2s] hashed 3 files (1 cached, 2.0KiB); uploaded 1/2 items (1 present), 4.0KiB at 2.0KiB/s"
+	ut.AssertEqual(t, expected, r.Line(2*time.Second))
+}
+
+func TestRendererLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := New(buf, false, time.Hour)
+	r.Add(isolateserver.ItemsToDownload, 2)
+	r.Add(isolateserver.ItemsDownloaded, 2)
+	r.Stop()
+	r.Stop()
+	out := buf.String()
+	ut.AssertEqual(t, 1, strings.Count(out, "\n"))
+	ut.AssertEqual(t, true, strings.Contains(out, "downloaded 2/2 items (0 cached)"))
+}
+
+func TestRendererTerminal(t *testing.T) {
+	buf := &bytes.Buffer{}
+	r := New(buf, true, time.Hour)
+	r.Add(isolateserver.FilesHashed, 1)
+	r.Stop()
+	out := buf.String()
+	ut.AssertEqual(t, true, strings.HasPrefix(out, "\r[0s] hashed 1 files"))
+	ut.AssertEqual(t, true, strings.HasSuffix(out, "\033[K\n"))
+}
+
+func TestRendererNil(t *testing.T) {
+	var r *Renderer
+	r.Add(isolateserver.FilesHashed, 1)
+	r.Stop()
+}
@@ -0,0 +1,244 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// Configuration is a combination of values of the config variables of an
+// .isolate file and the settings it yields.
+type Configuration struct {
+	ConfigVariables common.KeyValVars `json:"config_variables"`
+	Settings        *ConfigSettings   `json:"settings"`
+}
+
+// Name returns the config variables as "k1=v1 k2=v2", sorted by name.
+func (c *Configuration) Name() string {
+	return configVariablesName(c.ConfigVariables)
+}
+
+func configVariablesName(vars common.KeyValVars) string {
+	parts := make([]string, 0, len(vars))
+	for k, v := range vars {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// configName returns the configName of the values of vars, which must define
+// all of c.ConfigVariables.
+func (c *Configs) configName(vars common.KeyValVars) (configName, error) {
+	name := configName{}
+	var missing []string
+	for _, variable := range c.ConfigVariables {
+		if value, ok := vars[variable]; ok {
+			name = append(name, createVariableValueTryInt(value))
+		} else {
+			missing = append(missing, variable)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return nil, fmt.Errorf("these configuration variables were missing from the command line: %v", missing)
+	}
+	return name, nil
+}
+
+// GetConfigForVariables returns the settings for the values of the config
+// variables in vars, which must define all of c.ConfigVariables.
+func (c *Configs) GetConfigForVariables(vars common.KeyValVars) (*ConfigSettings, error) {
+	name, err := c.configName(vars)
+	if err != nil {
+		return nil, err
+	}
+	return c.GetConfig(name)
+}
+
+// Configurations returns the settings of every combination of the values the
+// config variables are compared to in the conditions, sorted by their values.
+//
+// The conditions only cover the values they are compared to, so each variable
+// also takes an unbound value standing for any other value, listed last. An
+// unbound variable is omitted from ConfigVariables.
+func (c *Configs) Configurations() ([]*Configuration, error) {
+	// The values are the ones bound in the keys of byConfig.
+	values := make([]map[variableValueKey]variableValue, len(c.ConfigVariables))
+	for i := range values {
+		values[i] = map[variableValueKey]variableValue{}
+	}
+	for _, pair := range c.byConfig {
+		for i, v := range pair.key {
+			if v.isBound() {
+				values[i][v.key()] = v
+			}
+		}
+	}
+	sorted := make([][]variableValue, len(values))
+	for i, set := range values {
+		for _, v := range set {
+			sorted[i] = append(sorted[i], v)
+		}
+		sort.Sort(variableValues(sorted[i]))
+		// Any value not compared to in the conditions.
+		sorted[i] = append(sorted[i], variableValue{})
+	}
+	names := []configName{{}}
+	for _, vs := range sorted {
+		next := make([]configName, 0, len(names)*len(vs))
+		for _, name := range names {
+			for _, v := range vs {
+				n := make(configName, len(name), len(name)+1)
+				copy(n, name)
+				next = append(next, append(n, v))
+			}
+		}
+		names = next
+	}
+	out := make([]*Configuration, 0, len(names))
+	for _, name := range names {
+		settings, err := c.GetConfig(name)
+		if err != nil {
+			return nil, err
+		}
+		vars := common.KeyValVars{}
+		for i, v := range name {
+			if v.isBound() {
+				vars[c.ConfigVariables[i]] = v.String()
+			}
+		}
+		out = append(out, &Configuration{ConfigVariables: vars, Settings: settings})
+	}
+	return out, nil
+}
+
+// variableValues sorts variableValue with bound values first.
+type variableValues []variableValue
+
+func (v variableValues) Len() int {
+	return len(v)
+}
+
+func (v variableValues) Less(i, j int) bool {
+	return v[i].compare(v[j]) < 0
+}
+
+func (v variableValues) Swap(i, j int) {
+	v[i], v[j] = v[j], v[i]
+}
+
+// ConfigSettingsDiff is the difference between two ConfigSettings.
+type ConfigSettingsDiff struct {
+	OldCommand  []string      `json:"old_command"`
+	NewCommand  []string      `json:"new_command"`
+	OldReadOnly ReadOnlyValue `json:"old_read_only"`
+	NewReadOnly ReadOnlyValue `json:"new_read_only"`
+	// IsolateDir is the directory the files are relative to, the one of the old
+	// settings.
+	IsolateDir     string   `json:"isolate_dir"`
+	Added          []string `json:"added"`
+	Removed        []string `json:"removed"`
+	AddedTouched   []string `json:"added_touched"`
+	RemovedTouched []string `json:"removed_touched"`
+}
+
+// CommandChanged returns true if the command differs.
+func (d *ConfigSettingsDiff) CommandChanged() bool {
+	return !reflect.DeepEqual(d.OldCommand, d.NewCommand)
+}
+
+// IsEmpty returns true if both settings are the same.
+func (d *ConfigSettingsDiff) IsEmpty() bool {
+	return !d.CommandChanged() && d.OldReadOnly == d.NewReadOnly && len(d.Added) == 0 && len(d.Removed) == 0 &&
+		len(d.AddedTouched) == 0 && len(d.RemovedTouched) == 0
+}
+
+// DiffConfigSettings returns the difference between oldSettings and
+// newSettings. When their isolate_dir differ, the files of newSettings are
+// made relative to the one of oldSettings before being compared.
+func DiffConfigSettings(oldSettings, newSettings *ConfigSettings) (*ConfigSettingsDiff, error) {
+	d := &ConfigSettingsDiff{
+		OldCommand:  oldSettings.Command,
+		NewCommand:  newSettings.Command,
+		OldReadOnly: oldSettings.ReadOnly,
+		NewReadOnly: newSettings.ReadOnly,
+		IsolateDir:  oldSettings.IsolateDir,
+	}
+	if len(d.OldCommand) == 0 && len(d.NewCommand) == 0 {
+		// nil and empty commands are the same.
+		d.OldCommand, d.NewCommand = nil, nil
+	}
+	newFiles, err := relToOldDir(oldSettings.IsolateDir, newSettings.IsolateDir, newSettings.Files)
+	if err != nil {
+		return nil, err
+	}
+	newTouched, err := relToOldDir(oldSettings.IsolateDir, newSettings.IsolateDir, newSettings.Touched)
+	if err != nil {
+		return nil, err
+	}
+	d.Added, d.Removed = diffFiles(oldSettings.Files, newFiles)
+	d.AddedTouched, d.RemovedTouched = diffFiles(oldSettings.Touched, newTouched)
+	return d, nil
+}
+
+// relToOldDir makes files, relative to newDir, relative to oldDir instead.
+// Files starting with a variable are left as is.
+func relToOldDir(oldDir, newDir string, files []string) ([]string, error) {
+	if oldDir == "" || newDir == "" || oldDir == newDir {
+		return files, nil
+	}
+	// Resolve each file first, so a file reached through a sibling directory is
+	// compared by its shortest path.
+	out := make([]string, len(files))
+	for i, f := range files {
+		if strings.HasPrefix(f, "<(") {
+			out[i] = f
+			continue
+		}
+		rel, err := posixRel(oldDir, filepath.Join(newDir, filepath.FromSlash(f)))
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasSuffix(f, "/") {
+			rel += "/"
+		}
+		out[i] = rel
+	}
+	return out, nil
+}
+
+// diffFiles returns the sorted files only in newFiles and only in oldFiles.
+func diffFiles(oldFiles, newFiles []string) ([]string, []string) {
+	oldSet := map[string]bool{}
+	for _, f := range oldFiles {
+		oldSet[f] = true
+	}
+	newSet := map[string]bool{}
+	for _, f := range newFiles {
+		newSet[f] = true
+	}
+	added := []string{}
+	for f := range newSet {
+		if !oldSet[f] {
+			added = append(added, f)
+		}
+	}
+	removed := []string{}
+	for f := range oldSet {
+		if !newSet[f] {
+			removed = append(removed, f)
+		}
+	}
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed
+}
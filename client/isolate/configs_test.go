@@ -0,0 +1,124 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"testing"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/maruel/ut"
+)
+
+const configsIsolateData = `{
+	'variables': {
+		'files': ['common/'],
+	},
+	'conditions': [
+		['OS=="linux" or OS=="mac"', {
+			'variables': {
+				'command': ['run_test', '<(OS)'],
+				'files': ['posix'],
+			},
+		}],
+		['OS=="linux" and asan==1', {
+			'variables': {
+				'files': ['asan/'],
+				'read_only': 0,
+			},
+		}],
+	],
+}`
+
+func TestConfigurations(t *testing.T) {
+	configs, err := LoadIsolateAsConfig("/s/swarming", []byte(configsIsolateData), nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"OS", "asan"}, configs.ConfigVariables)
+
+	all, err := configs.Configurations()
+	ut.AssertEqual(t, nil, err)
+	posix := &ConfigSettings{
+		Files:      []string{"common/", "posix"},
+		Command:    []string{"run_test", "<(OS)"},
+		ReadOnly:   NotSet,
+		IsolateDir: "/s/swarming",
+	}
+	asan := &ConfigSettings{
+		Files:      []string{"asan/", "common/", "posix"},
+		Command:    []string{"run_test", "<(OS)"},
+		ReadOnly:   Writeable,
+		IsolateDir: "/s/swarming",
+	}
+	other := &ConfigSettings{
+		Files:      []string{"common/"},
+		ReadOnly:   NotSet,
+		IsolateDir: "/s/swarming",
+	}
+	expected := []*Configuration{
+		{common.KeyValVars{"OS": "linux", "asan": "1"}, asan},
+		{common.KeyValVars{"OS": "linux"}, posix},
+		{common.KeyValVars{"OS": "mac", "asan": "1"}, posix},
+		{common.KeyValVars{"OS": "mac"}, posix},
+		{common.KeyValVars{"asan": "1"}, other},
+		{common.KeyValVars{}, other},
+	}
+	ut.AssertEqual(t, expected, all)
+	ut.AssertEqual(t, "OS=linux asan=1", all[0].Name())
+
+	settings, err := configs.GetConfigForVariables(common.KeyValVars{"OS": "win", "asan": "0"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"common/"}, settings.Files)
+	ut.AssertEqual(t, 0, len(settings.Command))
+
+	_, err = configs.GetConfigForVariables(common.KeyValVars{"OS": "linux"})
+	ut.AssertEqual(t, true, err != nil)
+}
+
+func TestDiffConfigSettings(t *testing.T) {
+	oldSettings := &ConfigSettings{
+		Files:      []string{"a", "b/", "<(PRODUCT_DIR)/c"},
+		Command:    []string{"run"},
+		ReadOnly:   FilesReadOnly,
+		IsolateDir: "/s/swarming",
+	}
+	d, err := DiffConfigSettings(oldSettings, oldSettings)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, d.IsEmpty())
+
+	newSettings := &ConfigSettings{
+		Files:      []string{"../b/", "d", "<(PRODUCT_DIR)/c"},
+		Command:    []string{"run", "-v"},
+		ReadOnly:   FilesReadOnly,
+		IsolateDir: "/s/swarming/sub",
+	}
+	d, err = DiffConfigSettings(oldSettings, newSettings)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, d.IsEmpty())
+	ut.AssertEqual(t, true, d.CommandChanged())
+	ut.AssertEqual(t, []string{"sub/d"}, d.Added)
+	ut.AssertEqual(t, []string{"a"}, d.Removed)
+	ut.AssertEqual(t, "/s/swarming", d.IsolateDir)
+
+	// The same file reached from a sibling directory.
+	newSettings = &ConfigSettings{
+		Files:      []string{"../swarming/a", "../swarming/b/", "<(PRODUCT_DIR)/c"},
+		Command:    []string{"run"},
+		ReadOnly:   FilesReadOnly,
+		IsolateDir: "/s/other",
+	}
+	d, err = DiffConfigSettings(oldSettings, newSettings)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, d.IsEmpty())
+
+	// Touched files are compared separately from the files.
+	oldSettings.Touched = []string{"t1", "t2"}
+	newSettings.Touched = []string{"../swarming/t1", "../swarming/a"}
+	d, err = DiffConfigSettings(oldSettings, newSettings)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, false, d.IsEmpty())
+	ut.AssertEqual(t, []string{}, d.Added)
+	ut.AssertEqual(t, []string{}, d.Removed)
+	ut.AssertEqual(t, []string{"a"}, d.AddedTouched)
+	ut.AssertEqual(t, []string{"t2"}, d.RemovedTouched)
+}
@@ -0,0 +1,137 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/luci/luci-go/client/isolateserver"
+)
+
+// Dependencies is what a .isolate file resolves to for a configuration, with
+// its includes merged and its variables replaced.
+type Dependencies struct {
+	Command    []string      `json:"command"`
+	ReadOnly   ReadOnlyValue `json:"read_only"`
+	IsolateDir string        `json:"isolate_dir"`
+	// RootDir is the directory containing IsolateDir and all the dependencies.
+	RootDir string `json:"root_dir"`
+	// Files are the dependencies listed in the .isolate files, relative to
+	// RootDir and using '/' as separator. Directories end with '/'.
+	Files []string `json:"files"`
+	// Touched are the files only expected to exist, relative to RootDir and
+	// using '/' as separator. They are not expanded.
+	Touched []string `json:"touched,omitempty"`
+
+	// Expanded is set by Expand.
+	Expanded []*ExpandedDependency `json:"expanded,omitempty"`
+	// FileCount and Size are the number of distinct files in Expanded and
+	// their total size.
+	FileCount int   `json:"file_count,omitempty"`
+	Size      int64 `json:"size,omitempty"`
+}
+
+// ExpandedDependency is an item of Dependencies.Files with the files it
+// resolves to.
+type ExpandedDependency struct {
+	Dependency string            `json:"dependency"`
+	Size       int64             `json:"size"`
+	Files      []*DependencyFile `json:"files"`
+}
+
+// DependencyFile is a file of an ExpandedDependency. Path is relative to
+// RootDir and uses '/' as separator. Symlinks have Link set instead of
+// Digest.
+type DependencyFile struct {
+	Path   string                  `json:"path"`
+	Size   int64                   `json:"size"`
+	Digest isolateserver.HexDigest `json:"digest,omitempty"`
+	Link   string                  `json:"link,omitempty"`
+}
+
+// LoadDependencies loads the .isolate file of tree for its configuration
+// variables, without touching the dependencies themselves.
+func LoadDependencies(tree Tree) (*Dependencies, error) {
+	loaded, err := loadIsolate(tree)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dependencies{
+		Command:    loaded.Command,
+		ReadOnly:   loaded.ReadOnly,
+		IsolateDir: loaded.IsolateDir,
+		RootDir:    loaded.RootDir,
+		Files:      make([]string, len(loaded.Dependencies)),
+	}
+	for i, dep := range loaded.Dependencies {
+		d.Files[i] = filepath.ToSlash(dep)
+	}
+	for _, touched := range loaded.Touched {
+		d.Touched = append(d.Touched, filepath.ToSlash(touched))
+	}
+	return d, nil
+}
+
+// Expand walks and hashes the dependencies with loader and fills Expanded.
+// The files of each dependency are sorted by decreasing size.
+func (d *Dependencies) Expand(ctx context.Context, loader *FileInfoLoader) error {
+	d.Expanded = make([]*ExpandedDependency, 0, len(d.Files))
+	d.FileCount = 0
+	d.Size = 0
+	seen := map[string]bool{}
+	for _, dep := range d.Files {
+		infos, err := lookupDependency(ctx, loader, d.RootDir, filepath.FromSlash(dep))
+		if err != nil {
+			return err
+		}
+		e := &ExpandedDependency{Dependency: dep, Files: []*DependencyFile{}}
+		for _, info := range infos {
+			relPath, err := filepath.Rel(d.RootDir, info.Path)
+			if err != nil {
+				return err
+			}
+			f := &DependencyFile{Path: filepath.ToSlash(relPath), Size: info.FileSize}
+			if info.Mode&os.ModeSymlink != 0 {
+				if f.Link, err = os.Readlink(info.Path); err != nil {
+					return err
+				}
+				f.Size = 0
+			} else {
+				f.Digest = isolateserver.HexDigest(info.Hash)
+			}
+			e.Files = append(e.Files, f)
+			e.Size += f.Size
+			if !seen[f.Path] {
+				seen[f.Path] = true
+				d.FileCount++
+				d.Size += f.Size
+			}
+		}
+		sort.Sort(bySize(e.Files))
+		d.Expanded = append(d.Expanded, e)
+	}
+	return nil
+}
+
+// bySize sorts files by decreasing size, then by path.
+type bySize []*DependencyFile
+
+func (b bySize) Len() int {
+	return len(b)
+}
+
+func (b bySize) Swap(i, j int) {
+	b[i], b[j] = b[j], b[i]
+}
+
+func (b bySize) Less(i, j int) bool {
+	if b[i].Size != b[j].Size {
+		return b[i].Size > b[j].Size
+	}
+	return b[i].Path < b[j].Path
+}
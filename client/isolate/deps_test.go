@@ -0,0 +1,78 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/ut"
+)
+
+func TestLoadDependencies(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	td, err = filepath.EvalSymlinks(td)
+	ut.AssertEqual(t, nil, err)
+	files := map[string]string{
+		"base/base.isolate": `{
+			'variables': {'files': ['data/small']},
+		}`,
+		"base/data/big":   "0123456789",
+		"base/data/small": "0",
+		"foo/foo.isolate": `{
+			'includes': ['../base/base.isolate'],
+			'conditions': [
+				['OS=="linux"', {'variables': {
+					'command': ['foo', '<(OS)'],
+					'files': ['foo', '../base/data/'],
+					'read_only': 1,
+				}}],
+				['OS=="mac"', {'variables': {'files': ['foo.app/']}}],
+			],
+		}`,
+		"foo/foo": "foo",
+	}
+	writeTree(t, td, files)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = filepath.Join("foo", "foo.isolate")
+	opts.ConfigVariables["OS"] = "linux"
+
+	deps, err := LoadDependencies(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"foo", "linux"}, deps.Command)
+	ut.AssertEqual(t, FilesReadOnly, deps.ReadOnly)
+	ut.AssertEqual(t, filepath.Join(td, "foo"), deps.IsolateDir)
+	ut.AssertEqual(t, td, deps.RootDir)
+	ut.AssertEqual(t, []string{"base/data/", "base/data/small", "foo/foo"}, deps.Files)
+	ut.AssertEqual(t, ([]*ExpandedDependency)(nil), deps.Expanded)
+
+	ut.AssertEqual(t, nil, deps.Expand(context.Background(), newCache()))
+	digest := func(s string) isolateserver.HexDigest {
+		return isolateserver.Hash(sha1.New(), []byte(s))
+	}
+	big := &DependencyFile{Path: "base/data/big", Size: 10, Digest: digest("0123456789")}
+	small := &DependencyFile{Path: "base/data/small", Size: 1, Digest: digest("0")}
+	expected := []*ExpandedDependency{
+		{Dependency: "base/data/", Size: 11, Files: []*DependencyFile{big, small}},
+		{Dependency: "base/data/small", Size: 1, Files: []*DependencyFile{small}},
+		{Dependency: "foo/foo", Size: 3, Files: []*DependencyFile{{Path: "foo/foo", Size: 3, Digest: digest("foo")}}},
+	}
+	ut.AssertEqual(t, expected, deps.Expanded)
+	ut.AssertEqual(t, 3, deps.FileCount)
+	ut.AssertEqual(t, int64(14), deps.Size)
+
+	opts.ConfigVariables = common.KeyValVars{}
+	_, err = LoadDependencies(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, true, err != nil)
+}
@@ -1,26 +1,38 @@
 package isolate
 
 import (
+	"context"
 	"crypto/sha1"
 	"encoding/gob"
+	"fmt"
 	"io"
 	"os"
 	"os/user"
 	"path"
 	"path/filepath"
-	"fmt"
+	"runtime"
+	"sync"
 	"syscall"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
 )
 
 type FileInfoLoader struct {
+	// Concurrency is the number of files hashed concurrently.
+	Concurrency int
+	// Progress, if set, receives the hashing counters.
+	Progress isolateserver.Progress
+
+	lock  sync.Mutex
 	cache map[shaCacheKey]shaCacheValue
 }
 
 type FileInfo struct {
-	Path string
-	Hash  string
-	Mode os.FileMode
-	FileSize int64
+	Path            string
+	Hash            string
+	Mode            os.FileMode
+	FileSize        int64
 	LinkDestination string
 }
 
@@ -33,7 +45,6 @@ type shaCacheValue struct {
 	Sha1  string
 }
 
-
 func LoadOrCreateCache() *FileInfoLoader {
 	c := newCache()
 	cache_file, err := os.Open(cache_path())
@@ -48,45 +59,70 @@ func LoadOrCreateCache() *FileInfoLoader {
 
 	parser := gob.NewDecoder(cache_file)
 	if err = parser.Decode(&c.cache); err != nil {
-		fmt.Println("parsing config file", err.Error())
+		common.Warningf("ignoring invalid hash cache %s: %s", cache_path(), err)
 	}
 
 	return c
 }
 
-func (cache *FileInfoLoader) LookupRecursive(path string) ([]*FileInfo, error) {
+// LookupRecursive walks path and returns the information of all the files
+// found, in walk order. Directories are walked but not returned. Files are
+// hashed by up to cache.Concurrency goroutines. The walk stops when ctx is
+// canceled.
+func (cache *FileInfoLoader) LookupRecursive(ctx context.Context, path string) ([]*FileInfo, error) {
 	type walkEntry struct {
-		path string
+		path      string
 		file_info os.FileInfo
-		err error
 	}
 
-	ch := make(chan *walkEntry)
-	go func() {
-		filepath.Walk(path,
-			func(path string, info os.FileInfo, err error) error {
-				ch <- &walkEntry{path, info, err}
+	var entries []walkEntry
+	err := filepath.Walk(path,
+		func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			if info.IsDir() {
 				return nil
-			})
-		close(ch)
-	}()
-
-	ret := make([]*FileInfo, 0)
+			}
+			entries = append(entries, walkEntry{path, info})
+			return nil
+		})
+	if err != nil {
+		return nil, err
+	}
 
-	for {
-		entry, available := <-ch
-		if ! available {
+	workers := cache.Concurrency
+	if workers < 1 {
+		workers = 1
+	}
+	sem := common.NewSemaphore(workers)
+	ret := make([]*FileInfo, len(entries))
+	errs := make(chan error, len(entries)+1)
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		if err := sem.WaitContext(ctx); err != nil {
+			errs <- err
 			break
 		}
-		if entry.err != nil {
-			return nil, entry.err
-		}
-
-		s, err := cache.LookupInfo(entry.path, entry.file_info)
-		if err != nil {
-			return nil, err
-		}
-		ret = append(ret, s)
+		wg.Add(1)
+		go func(i int, entry walkEntry) {
+			defer wg.Done()
+			defer sem.Signal()
+			s, err := cache.LookupInfo(entry.path, entry.file_info)
+			if err != nil {
+				errs <- err
+				return
+			}
+			ret[i] = s
+		}(i, entry)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
 	}
 	return ret, nil
 }
@@ -103,38 +139,60 @@ func (cache *FileInfoLoader) LookupInfo(path string, fileinfo os.FileInfo) (*Fil
 	stat := fileinfo.Sys().(*syscall.Stat_t)
 
 	key := shaCacheKey{Inum: stat.Ino, Devnum: stat.Dev}
+	cache.lock.Lock()
 	result, found_in_cache := cache.cache[key]
+	cache.lock.Unlock()
 	if !found_in_cache || result.Mtime != stat.Mtim {
 		s := sha1_file(path)
 		result = shaCacheValue{Mtime: stat.Mtim, Sha1: s}
+		cache.lock.Lock()
 		cache.cache[key] = result
+		cache.lock.Unlock()
+		isolateserver.AddProgress(cache.Progress, isolateserver.BytesHashed, fileinfo.Size())
+	} else {
+		isolateserver.AddProgress(cache.Progress, isolateserver.HashCacheHits, 1)
 	}
+	isolateserver.AddProgress(cache.Progress, isolateserver.FilesHashed, 1)
 
 	ret := &FileInfo{
-		Path: path,
-		Hash: result.Sha1,
-		Mode: fileinfo.Mode(),
+		Path:     path,
+		Hash:     result.Sha1,
+		Mode:     fileinfo.Mode(),
 		FileSize: fileinfo.Size()}
 	// TODO: handle symlinks
 
 	return ret, nil
 }
 
-func (c* FileInfoLoader) Save() {
+// prime records sha1 as the digest of the file described by fileinfo without
+// reading it.
+func (cache *FileInfoLoader) prime(fileinfo os.FileInfo, sha1 string) {
+	stat := fileinfo.Sys().(*syscall.Stat_t)
+	key := shaCacheKey{Inum: stat.Ino, Devnum: stat.Dev}
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	if _, ok := cache.cache[key]; !ok {
+		cache.cache[key] = shaCacheValue{Mtime: stat.Mtim, Sha1: sha1}
+	}
+}
+
+func (c *FileInfoLoader) Save() {
 	cache_file, err := os.Create(cache_path())
 	if err != nil {
 		panic(err)
 	}
 	defer cache_file.Close()
 
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	enc := gob.NewEncoder(cache_file)
 	enc.Encode(c.cache)
 }
 
-
 func newCache() *FileInfoLoader {
 	return &FileInfoLoader{
-		cache: make(map[shaCacheKey]shaCacheValue),
+		Concurrency: runtime.NumCPU(),
+		cache:       make(map[shaCacheKey]shaCacheValue),
 	}
 }
 
@@ -162,4 +220,3 @@ func sha1_file(path string) string {
 	io.Copy(hash, f)
 	return fmt.Sprintf("%x", hash.Sum(nil))
 }
-
@@ -84,7 +84,7 @@ func (v variableValue) key() variableValueKey {
 		return variableValueKey("S" + *v.S)
 	}
 	if v.I != nil {
-		return variableValueKey(string(*v.I))
+		return variableValueKey("I" + strconv.Itoa(*v.I))
 	}
 	return variableValueKey("")
 }
@@ -148,8 +148,6 @@ func (v variablesAndValues) cartesianProductOfValues(orderedKeys []string) [][]v
 		out = append(out, next)
 		indices[0]++
 	}
-	panic("unreachable code")
-	return nil
 }
 
 func matchConfigs(condition string, configVariables []string, allConfigs [][]variableValue) [][]variableValue {
@@ -303,7 +301,7 @@ def verify_ast(expr, variables_and_values):
 			val = {'I': rhs.n}
 		else:
 			val = {'S': rhs.s}
-			var_values.append(val)
+		var_values.append(val)
 
 test_ast = compile(sys.stdin.read(), '<condition>', 'eval', ast.PyCF_ONLY_AST)
 variables_and_values = {}
@@ -339,13 +337,16 @@ print json.dumps(variables_and_values)
 type variables struct {
 	Command []string `json:"command"`
 	Files   []string `json:"files"`
+	// Touched lists files that must exist but whose content is ignored; it is
+	// the legacy isolate_dependency_touched variable.
+	Touched []string `json:"isolate_dependency_touched,omitempty"`
 	// read_only has 1 as default, according to specs.
 	// Just as Python-isolate also uses None as default, this code uses nil.
 	ReadOnly *int `json:"read_only"`
 }
 
 func (p *variables) isEmpty() bool {
-	return len(p.Command) == 0 && len(p.Files) == 0 && p.ReadOnly == nil
+	return len(p.Command) == 0 && len(p.Files) == 0 && len(p.Touched) == 0 && p.ReadOnly == nil
 }
 
 func (p *variables) verify() error {
@@ -401,7 +402,7 @@ func (c configName) Equals(o configName) bool {
 func (c configName) key() string {
 	parts := make([]string, 0, len(c))
 	for _, v := range c {
-		if c == nil {
+		if !v.isBound() {
 			parts = append(parts, "∀")
 		} else {
 			parts = append(parts, "∃", v.String())
@@ -565,7 +566,7 @@ func mergeStringLists(ls []string, rs []string) []string {
 	sort.Strings(varSet)
 	j := 0
 	for i := 0; i < len(varSet); i++ {
-		if i == 0 || varSet[i] != varSet[j - 1] {
+		if i == 0 || varSet[i] != varSet[j-1] {
 			varSet[j] = varSet[i]
 			j++
 		}
@@ -625,10 +626,11 @@ func createReadOnlyValue(readOnly *int) ReadOnlyValue {
 //  .files is the list of dependencies. The items use '/' as a path separator.
 //  .readOnly describe how to map the files.
 type ConfigSettings struct {
-	Files      []string
-	Command    []string
-	ReadOnly   ReadOnlyValue
-	IsolateDir string
+	Files      []string      `json:"files"`
+	Touched    []string      `json:"touched,omitempty"`
+	Command    []string      `json:"command"`
+	ReadOnly   ReadOnlyValue `json:"read_only"`
+	IsolateDir string        `json:"isolate_dir"`
 }
 
 func createConfigSettings(values variables, isolateDir string) *ConfigSettings {
@@ -639,12 +641,18 @@ func createConfigSettings(values variables, isolateDir string) *ConfigSettings {
 		assert(filepath.IsAbs(isolateDir))
 	}
 	c := &ConfigSettings{
-		make([]string, len(values.Files)),
-		values.Command,
-		createReadOnlyValue(values.ReadOnly),
-		isolateDir}
+		Files:      make([]string, len(values.Files)),
+		Command:    values.Command,
+		ReadOnly:   createReadOnlyValue(values.ReadOnly),
+		IsolateDir: isolateDir,
+	}
 	copy(c.Files, values.Files)
 	sort.Strings(c.Files)
+	if len(values.Touched) != 0 {
+		c.Touched = make([]string, len(values.Touched))
+		copy(c.Touched, values.Touched)
+		sort.Strings(c.Touched)
+	}
 	return c
 }
 
@@ -667,10 +675,6 @@ func (lhs *ConfigSettings) union(rhs *ConfigSettings) (*ConfigSettings, error) {
 		return lhs, nil
 	}
 
-	if common.IsWindows() {
-		assert(strings.ToLower(lhs.IsolateDir) == strings.ToLower(rhs.IsolateDir))
-	}
-
 	// Takes the difference between the two isolate_dir. Note that while
 	// isolate_dir is in native path case, all other references are in posix.
 	useRhs := false
@@ -683,7 +687,7 @@ func (lhs *ConfigSettings) union(rhs *ConfigSettings) (*ConfigSettings, error) {
 		command = rhs.Command
 	} else {
 		// If self doesn't define any file, use rhs.
-		useRhs = len(lhs.Files) == 0
+		useRhs = len(lhs.Files) == 0 && len(lhs.Touched) == 0
 	}
 
 	readOnly := rhs.ReadOnly
@@ -693,30 +697,56 @@ func (lhs *ConfigSettings) union(rhs *ConfigSettings) (*ConfigSettings, error) {
 
 	lRelCwd, rRelCwd := lhs.IsolateDir, rhs.IsolateDir
 	lFiles, rFiles := lhs.Files, rhs.Files
+	lTouched, rTouched := lhs.Touched, rhs.Touched
 	if useRhs {
 		// Rebase files in rhs.
 		lRelCwd, rRelCwd = rhs.IsolateDir, lhs.IsolateDir
 		lFiles, rFiles = rhs.Files, lhs.Files
+		lTouched, rTouched = rhs.Touched, lhs.Touched
 	}
 
-	// TODO(tandrii): implement path.Rel equivalent, as these paths are POSIX.
-	rebasePath, err := filepath.Rel(lRelCwd, rRelCwd)
+	// The isolate directories are native paths but the files use '/'.
+	rebasePath, err := posixRel(lRelCwd, rRelCwd)
 	if err != nil {
 		return nil, err
 	}
-	rebasePath = strings.Replace(rebasePath, string(os.PathSeparator), "/", 0)
 
-	files := make([]string, len(lFiles)+len(rFiles))
-	copy(files, lFiles)
-	for i, f := range rFiles {
-		// Rebase item.
-		if !(strings.HasPrefix(f, "<(") || rebasePath == ".") {
-			f = path.Join(rebasePath, f)
-		}
-		files[i+len(lFiles)] = f
+	out := &ConfigSettings{
+		// A file listed by multiple configurations is listed once.
+		Files:      mergeStringLists(lFiles, rebaseFiles(rebasePath, rFiles)),
+		Command:    command,
+		ReadOnly:   readOnly,
+		IsolateDir: lRelCwd,
 	}
-	sort.Strings(files)
-	return &ConfigSettings{files, command, readOnly, lRelCwd}, nil
+	if len(lTouched) != 0 || len(rTouched) != 0 {
+		out.Touched = mergeStringLists(lTouched, rebaseFiles(rebasePath, rTouched))
+	}
+	return out, nil
+}
+
+// rebaseFiles returns files rebased with rebaseFile.
+func rebaseFiles(rebasePath string, files []string) []string {
+	out := make([]string, len(files))
+	for i, f := range files {
+		out[i] = rebaseFile(rebasePath, f)
+	}
+	return out
+}
+
+// rebaseFile returns the dependency f, relative to a directory, made relative
+// to its parent directory rebasePath. Both use '/' as separator.
+//
+// Dependencies starting with a path variable are not relative to the
+// directory and are returned as is. The trailing '/' of directories is kept.
+func rebaseFile(rebasePath, f string) string {
+	if strings.HasPrefix(f, "<(") || rebasePath == "." {
+		return f
+	}
+	rebased := path.Join(rebasePath, f)
+	if strings.HasSuffix(f, "/") {
+		rebased += "/"
+	}
+	return rebased
 }
 
 // LoadIsolateAsConfig parses one .isolate file and returns a Configs instance.
@@ -751,34 +781,24 @@ func (lhs *ConfigSettings) union(rhs *ConfigSettings) (*ConfigSettings, error) {
 //    },
 //  }
 func LoadIsolateAsConfig(isolateDir string, content []byte, fileComment []byte) (*Configs, error) {
-	assert(path.IsAbs(isolateDir), isolateDir)
-	parsed, err := parseIsolate(content)
-	if err != nil {
-		return nil, fmt.Errorf("failed to parse isolate (isolateDir: %s): %s", isolateDir, err)
-	}
-	varsAndValues, err := parsed.verify()
+	l := &includeLoader{rootDir: isolateDir, cache: map[string]*Configs{}}
+	return l.load(isolateDir, content, fileComment)
+}
+
+// includeLoader loads a .isolate file and its includes. Each included file is
+// loaded once, however many files include it.
+type includeLoader struct {
+	rootDir string
+	// cache holds the loaded includes, keyed by their path.
+	cache map[string]*Configs
+	// chain is the path of the includes being loaded, outermost first.
+	chain []string
+}
+
+func (l *includeLoader) load(isolateDir string, content []byte, fileComment []byte) (*Configs, error) {
+	parsed, isolate, err := loadIsolateFile(isolateDir, content, fileComment)
 	if err != nil {
-		return nil, fmt.Errorf("failed to verify isolate (isolateDir: %s): %s", isolateDir, err)
-	}
-	isolate := makeConfigsV(fileComment, varsAndValues)
-	// Add global variables. The global variables are on the empty tuple key.
-	globalconfigName := make([]variableValue, len(isolate.ConfigVariables))
-	if parsed.Variables != nil {
-		isolate.setConfig(globalconfigName, createConfigSettings(*parsed.Variables, isolateDir))
-	} else {
-		isolate.setConfig(globalconfigName, createConfigSettings(variables{}, isolateDir))
-	}
-	// Add configuration-specific variables.
-	allConfigs := varsAndValues.cartesianProductOfValues(isolate.ConfigVariables)
-	for _, cond := range parsed.Conditions {
-		configs := matchConfigs(cond.Condition, isolate.ConfigVariables, allConfigs)
-		newConfigs := makeConfigs(nil, isolate.ConfigVariables)
-		for _, config := range configs {
-			newConfigs.setConfig(configName(config), createConfigSettings(cond.Variables, isolateDir))
-		}
-		if isolate, err = isolate.union(newConfigs); err != nil {
-			return nil, err
-		}
+		return nil, err
 	}
 	// If the .isolate contains command, ignore any command in child .isolate.
 	rootHasCommand := false
@@ -790,26 +810,26 @@ func LoadIsolateAsConfig(isolateDir string, content []byte, fileComment []byte)
 	}
 	// Load the includes. Process them in reverse so the last one take precedence.
 	for i := len(parsed.Includes) - 1; i >= 0; i-- {
-		if included, err := loadIncludedIsolate(isolateDir, parsed.Includes[i]); err != nil {
+		included, err := l.loadInclude(isolateDir, parsed.Includes[i])
+		if err != nil {
+			return nil, err
+		}
+		if rootHasCommand {
+			// Strip any command in the imported isolate. It is because the chosen
+			// command is not related to the one in the top-most .isolate, since the
+			// configuration is flattened.
+			included = included.withoutCommand()
+		}
+		if isolate, err = isolate.union(included); err != nil {
 			return nil, err
-		} else {
-			if rootHasCommand {
-				// Strip any command in the imported isolate. It is because the chosen
-				// command is not related to the one in the top-most .isolate, since the
-				// configuration is flattened.
-				for _, pair := range included.byConfig {
-					pair.value.Command = []string{}
-				}
-			}
-			if isolate, err = isolate.union(included); err != nil {
-				return nil, err
-			}
 		}
 	}
 	return isolate, nil
 }
 
-func loadIncludedIsolate(isolateDir, include string) (*Configs, error) {
+// loadInclude loads the .isolate file include, relative to isolateDir, with
+// its own includes.
+func (l *includeLoader) loadInclude(isolateDir, include string) (*Configs, error) {
 	if filepath.IsAbs(include) {
 		return nil, fmt.Errorf("Failed to load configuration; absolute include path %s", include)
 	}
@@ -817,11 +837,85 @@ func loadIncludedIsolate(isolateDir, include string) (*Configs, error) {
 	if common.IsWindows() && (strings.ToLower(includedIsolate)[0] != strings.ToLower(isolateDir)[0]) {
 		return nil, errors.New("can't reference a .isolate file from another drive")
 	}
+	if included, ok := l.cache[includedIsolate]; ok {
+		return included, nil
+	}
+	for i, p := range l.chain {
+		if p == includedIsolate {
+			return nil, fmt.Errorf("include cycle: %s", l.describeChain(append(l.chain[i:], includedIsolate)))
+		}
+	}
 	content, err := ioutil.ReadFile(includedIsolate)
 	if err != nil {
 		return nil, err
 	}
-	return LoadIsolateAsConfig(filepath.Dir(includedIsolate), content, nil)
+	l.chain = append(l.chain, includedIsolate)
+	included, err := l.load(filepath.Dir(includedIsolate), content, nil)
+	l.chain = l.chain[:len(l.chain)-1]
+	if err != nil {
+		return nil, err
+	}
+	l.cache[includedIsolate] = included
+	return included, nil
+}
+
+// describeChain returns the includes joined by " -> ", relative to the
+// directory of the top-most .isolate file when possible.
+func (l *includeLoader) describeChain(chain []string) string {
+	out := make([]string, len(chain))
+	for i, p := range chain {
+		if rel, err := filepath.Rel(l.rootDir, p); err == nil {
+			p = rel
+		}
+		out[i] = p
+	}
+	return strings.Join(out, " -> ")
+}
+
+// withoutCommand returns a copy of c with no command in any configuration.
+func (c *Configs) withoutCommand() *Configs {
+	out := makeConfigs(c.FileComment, c.ConfigVariables)
+	for key, pair := range c.byConfig {
+		settings := *pair.value
+		settings.Command = []string{}
+		out.byConfig[key] = configPair{pair.key, &settings}
+	}
+	return out
+}
+
+// loadIsolateFile parses one .isolate file and returns it with its Configs,
+// without loading its includes.
+func loadIsolateFile(isolateDir string, content []byte, fileComment []byte) (*parsedIsolate, *Configs, error) {
+	assert(path.IsAbs(isolateDir), isolateDir)
+	parsed, err := parseIsolate(content)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to parse isolate (isolateDir: %s): %s", isolateDir, err)
+	}
+	varsAndValues, err := parsed.verify()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to verify isolate (isolateDir: %s): %s", isolateDir, err)
+	}
+	isolate := makeConfigsV(fileComment, varsAndValues)
+	// Add global variables. The global variables are on the empty tuple key.
+	globalconfigName := make([]variableValue, len(isolate.ConfigVariables))
+	if parsed.Variables != nil {
+		isolate.setConfig(globalconfigName, createConfigSettings(*parsed.Variables, isolateDir))
+	} else {
+		isolate.setConfig(globalconfigName, createConfigSettings(variables{}, isolateDir))
+	}
+	// Add configuration-specific variables.
+	allConfigs := varsAndValues.cartesianProductOfValues(isolate.ConfigVariables)
+	for _, cond := range parsed.Conditions {
+		configs := matchConfigs(cond.Condition, isolate.ConfigVariables, allConfigs)
+		newConfigs := makeConfigs(nil, isolate.ConfigVariables)
+		for _, config := range configs {
+			newConfigs.setConfig(configName(config), createConfigSettings(cond.Variables, isolateDir))
+		}
+		if isolate, err = isolate.union(newConfigs); err != nil {
+			return nil, nil, err
+		}
+	}
+	return parsed, isolate, nil
 }
 
 // LoadIsolateForConfig loads the .isolate file and returns
@@ -832,39 +926,36 @@ func loadIncludedIsolate(isolateDir, include string) (*Configs, error) {
 // The dependencies are fixed to use os.path.sep.
 func LoadIsolateForConfig(isolateDir string, content []byte, configVariables common.KeyValVars) (
 	[]string, []string, ReadOnlyValue, string, error) {
-	// Load the .isolate file, process its conditions, retrieve the command and dependencies.
-	isolate, err := LoadIsolateAsConfig(isolateDir, content, nil)
+	config, err := loadConfigSettings(isolateDir, content, configVariables)
 	if err != nil {
 		return nil, nil, NotSet, "", err
 	}
-	fmt.Print(isolate.ConfigVariables)
-	configName := configName{}
-	missingVars := []string{}
-	for _, variable := range isolate.ConfigVariables {
-		if value, ok := configVariables[variable]; ok {
-			configName = append(configName, createVariableValueTryInt(value))
-		} else {
-			missingVars = append(missingVars, variable)
-		}
-	}
-	if len(missingVars) > 0 {
-		sort.Strings(missingVars)
-		err = fmt.Errorf("these configuration variables were missing from the command line: %v", missingVars)
-		return nil, nil, NotSet, "", err
-	}
-	// A configuration is to be created with all the combinations of free variables.
-	config, err := isolate.GetConfig(configName)
+	return config.Command, nativePaths(config.Files), config.ReadOnly, config.IsolateDir, nil
+}
+
+// loadConfigSettings loads the .isolate file and returns the settings of the
+// configuration selected by configVariables.
+func loadConfigSettings(isolateDir string, content []byte, configVariables common.KeyValVars) (*ConfigSettings, error) {
+	// Load the .isolate file, process its conditions, retrieve the command and dependencies.
+	isolate, err := LoadIsolateAsConfig(isolateDir, content, nil)
 	if err != nil {
-		return nil, nil, NotSet, "", err
+		return nil, err
 	}
-	dependencies := make([]string, len(config.Files))
+	common.Debugf("%s: config variables %v", isolateDir, isolate.ConfigVariables)
+	// A configuration is to be created with all the combinations of free variables.
+	return isolate.GetConfigForVariables(configVariables)
+}
+
+// nativePaths returns paths using '/' as separator with the OS' separator.
+func nativePaths(paths []string) []string {
+	out := make([]string, len(paths))
 	if os.PathSeparator == '/' {
-		copy(dependencies, config.Files)
+		copy(out, paths)
 	} else {
 		osPathSeparator := string(os.PathSeparator)
-		for i, f := range config.Files {
-			dependencies[i] = strings.Replace(f, "/", osPathSeparator, -1)
+		for i, f := range paths {
+			out[i] = strings.Replace(f, "/", osPathSeparator, -1)
 		}
 	}
-	return config.Command, dependencies, config.ReadOnly, config.IsolateDir, nil
+	return out
 }
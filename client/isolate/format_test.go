@@ -8,6 +8,8 @@ import (
 	"encoding/json"
 	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/maruel/ut"
@@ -184,3 +186,46 @@ func TestLoadIsolateAsConfig(t *testing.T) {
 	ut.AssertEqual(t, isolate.FileComment, []byte("# filecomment"))
 	ut.AssertEqual(t, []string{"OS"}, isolate.ConfigVariables)
 }
+
+func TestLoadIsolateAsConfigIncludes(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	files := map[string]string{
+		"b/b.isolate": `{
+			'includes': ['../d/d.isolate'],
+			'variables': {'command': ['b'], 'files': ['b']},
+		}`,
+		"c/c.isolate": `{
+			'includes': ['../d/d.isolate'],
+			'variables': {'files': ['c']},
+		}`,
+		"d/d.isolate": `{
+			'variables': {'command': ['d'], 'files': ['d']},
+		}`,
+		"cycle/x.isolate": `{'includes': ['y.isolate']}`,
+		"cycle/y.isolate": `{'includes': ['z.isolate']}`,
+		"cycle/z.isolate": `{'includes': ['y.isolate']}`,
+	}
+	writeTree(t, td, files)
+
+	// d.isolate is included twice but loaded once. Stripping its command for
+	// b.isolate doesn't affect c.isolate.
+	l := &includeLoader{rootDir: td, cache: map[string]*Configs{}}
+	isolate, err := l.load(td, []byte(`{'includes': ['c/c.isolate', 'b/b.isolate']}`), nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 3, len(l.cache))
+	c, err := l.cache[filepath.Join(td, "c", "c.isolate")].GetConfig(configName{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"d"}, c.Command)
+	// The command comes from d.isolate, so do the files' base directory.
+	ut.AssertEqual(t, []string{"../c/c", "d"}, c.Files)
+	settings, err := isolate.GetConfig(configName{})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"b"}, settings.Command)
+	ut.AssertEqual(t, filepath.Join(td, "b"), settings.IsolateDir)
+	ut.AssertEqual(t, []string{"../c/c", "../d/d", "b"}, settings.Files)
+
+	_, err = LoadIsolateAsConfig(filepath.Join(td, "cycle"), []byte(files["cycle/x.isolate"]), nil)
+	ut.AssertEqual(t, "include cycle: y.isolate -> z.isolate -> y.isolate", err.Error())
+}
@@ -5,14 +5,42 @@
 package isolate
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"fmt"
-	"path/filepath"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
+	"sort"
+	"strings"
 
 	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
 )
 
+// Concurrency configures the parallelism of each stage of IsolateAndArchive.
+//
+// Files are streamed through the stages so memory use is bounded regardless of
+// their size.
+type Concurrency struct {
+	// Hash is the number of files hashed concurrently.
+	Hash int
+	// Compress is the number of items compressed concurrently.
+	Compress int
+	// Network is the number of concurrent uploads to the isolate server.
+	Network int
+}
+
+// DefaultConcurrency returns the default concurrency of each stage.
+func DefaultConcurrency() Concurrency {
+	return Concurrency{Hash: runtime.NumCPU(), Compress: runtime.NumCPU(), Network: 8}
+}
+
 // IsolatedGenJSONVersion is used in the batcharchive json format.
 //
 // TODO(tandrii): Migrate to batch_archive.go.
@@ -21,7 +49,10 @@ const IsolatedGenJSONVersion = 1
 // ValidVariable is the regexp of valid isolate variable name.
 const ValidVariable = "[A-Za-z_][A-Za-z_0-9]*"
 
-var validVariableMatcher = regexp.MustCompile(ValidVariable)
+var validVariableMatcher = regexp.MustCompile("^" + ValidVariable + "$")
+
+// variableReference matches a <(VAR) reference in an .isolate file.
+var variableReference = regexp.MustCompile(`<\((` + ValidVariable + `)\)`)
 
 // IsValidVariable returns true if the variable is a valid symbol name.
 func IsValidVariable(variable string) bool {
@@ -42,6 +73,15 @@ type ArchiveOptions struct {
 	PathVariables   common.KeyValVars `json:"path_variables"`
 	ExtraVariables  common.KeyValVars `json:"extra_variables"`
 	ConfigVariables common.KeyValVars `json:"config_variables"`
+	// SplitByDir puts the files of each top level directory in a separate
+	// .isolated file included by the main one.
+	SplitByDir bool `json:"split_by_dir"`
+	// MaxFilesPerIsolated, if not 0, splits the files in multiple .isolated
+	// files included by the main one, with at most this many files each.
+	MaxFilesPerIsolated int `json:"max_files_per_isolated"`
+	// RootDir, if set, is the directory all the dependencies must be in. It
+	// defaults to the deepest directory containing all of them.
+	RootDir string `json:"root_dir"`
 }
 
 // Init initializes with non-nil values.
@@ -52,79 +92,758 @@ func (a *ArchiveOptions) Init() {
 	a.ConfigVariables = common.KeyValVars{}
 }
 
-func replaceVars(str string, opts ArchiveOptions) string {
-	r := regexp.MustCompile("<\\(" + ValidVariable + "?\\)")
-	return r.ReplaceAllStringFunc(str, func(match string)string {
-		var_name := match[2:len(match) - 1]
-		if v, ok := opts.PathVariables[var_name]; ok {
-			return v
-		}
-		if v, ok := opts.ExtraVariables[var_name]; ok {
-			return v
-		}
-		if v, ok := opts.ConfigVariables[var_name]; ok {
-			return v
+// replaceVars replaces the <(VAR) references in str with the value of VAR in
+// the first of vars that defines it.
+//
+// Returns the names of the variables that have no value.
+func replaceVars(str string, vars ...common.KeyValVars) (string, []string) {
+	var missing []string
+	out := variableReference.ReplaceAllStringFunc(str, func(match string) string {
+		name := match[2 : len(match)-1]
+		for _, v := range vars {
+			if value, ok := v[name]; ok {
+				return value
+			}
 		}
-		panic("No value for variable " + var_name)
+		missing = append(missing, name)
+		return match
 	})
+	return out, missing
+}
 
+// processPathVariables returns a copy of the path variables made relative to
+// isolateDir.
+//
+// The values are relative to cwd and must be existing directories.
+func processPathVariables(cwd, isolateDir string, vars common.KeyValVars) (common.KeyValVars, error) {
+	out := make(common.KeyValVars, len(vars))
+	for k, v := range vars {
+		// Variables could contain / or \ on Windows. Always normalize to the
+		// native separator.
+		p := strings.TrimSpace(v)
+		if common.IsWindows() {
+			p = strings.Replace(p, "/", "\\", -1)
+		}
+		p, err := absPath(cwd, p)
+		if err != nil {
+			return nil, err
+		}
+		if !common.IsDirectory(p) {
+			return nil, fmt.Errorf("path variable %s=%s is not a directory", k, p)
+		}
+		if p, err = filepath.Rel(isolateDir, p); err != nil {
+			return nil, err
+		}
+		out[k] = p
+	}
+	return out, nil
 }
 
 type loadedIsolate struct {
+	Command []string
+	// Dependencies are relative to RootDir. Directories end with a separator.
 	Dependencies []string
+	// Touched are the files only expected to exist, their content is ignored.
+	// They are relative to RootDir.
+	Touched    []string
+	ReadOnly   ReadOnlyValue
 	IsolateDir string
+	// RootDir is the directory containing IsolateDir and all the dependencies.
+	RootDir string
+}
+
+// absPath returns p as an absolute path, relative to cwd if it isn't already.
+func absPath(cwd, p string) (string, error) {
+	if !filepath.IsAbs(p) {
+		p = filepath.Join(cwd, p)
+	}
+	return filepath.Abs(p)
 }
 
 func loadIsolate(tree Tree) (*loadedIsolate, error) {
-	rel_path := filepath.Join(tree.Cwd, tree.Opts.Isolate)
-	content, err := ioutil.ReadFile(rel_path)
+	isolatePath, err := absPath(tree.Cwd, tree.Opts.Isolate)
+	if err != nil {
+		return nil, err
+	}
+	content, err := ioutil.ReadFile(isolatePath)
 	if err != nil {
 		return nil, err
 	}
 
-	_, deps, _, isolate_dir, err := LoadIsolateForConfig(tree.Cwd, content, tree.Opts.ConfigVariables)
+	config, err := loadConfigSettings(filepath.Dir(isolatePath), content, tree.Opts.ConfigVariables)
 	if err != nil {
 		return nil, err
 	}
+	isolateDir := config.IsolateDir
 
-	loaded := new(loadedIsolate)
-	loaded.IsolateDir = isolate_dir
-	loaded.Dependencies = make([]string, len(deps))
-	for i, dep := range deps {
-		loaded.Dependencies[i] = replaceVars(dep, tree.Opts)
+	pathVariables, err := processPathVariables(tree.Cwd, isolateDir, tree.Opts.PathVariables)
+	if err != nil {
+		return nil, err
+	}
+	// Files may only reference path and extra variables. The command may also
+	// reference config variables.
+	missing := map[string]bool{}
+	replace := func(s string, vars ...common.KeyValVars) string {
+		out, names := replaceVars(s, vars...)
+		for _, name := range names {
+			missing[name] = true
+		}
+		return out
+	}
+	loaded := &loadedIsolate{
+		Command:      make([]string, len(config.Command)),
+		Dependencies: make([]string, len(config.Files)),
+		Touched:      make([]string, len(config.Touched)),
+		ReadOnly:     config.ReadOnly,
+		IsolateDir:   isolateDir,
+	}
+	for i, arg := range config.Command {
+		loaded.Command[i] = replace(arg, pathVariables, tree.Opts.ConfigVariables, tree.Opts.ExtraVariables)
+	}
+	for i, dep := range nativePaths(config.Files) {
+		dep = replace(dep, pathVariables, tree.Opts.ExtraVariables)
+		// Keep the trailing separator of directories.
+		cleaned := filepath.Clean(dep)
+		if strings.HasSuffix(dep, string(os.PathSeparator)) && cleaned != string(os.PathSeparator) {
+			cleaned += string(os.PathSeparator)
+		}
+		loaded.Dependencies[i] = cleaned
+	}
+	for i, touched := range nativePaths(config.Touched) {
+		touched = replace(touched, pathVariables, tree.Opts.ExtraVariables)
+		if strings.HasSuffix(touched, string(os.PathSeparator)) {
+			return nil, fmt.Errorf("%s: touched dependency %s can't be a directory", isolatePath, touched)
+		}
+		loaded.Touched[i] = filepath.Clean(touched)
+	}
+	if len(missing) != 0 {
+		names := make([]string, 0, len(missing))
+		for name := range missing {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("%s references undefined variables: %s", isolatePath, strings.Join(names, ", "))
+	}
+	rootDir := ""
+	if tree.Opts.RootDir != "" {
+		if rootDir, err = absPath(tree.Cwd, tree.Opts.RootDir); err != nil {
+			return nil, err
+		}
+	}
+	if err := loaded.setRootDir(rootDir); err != nil {
+		return nil, fmt.Errorf("%s: %s", isolatePath, err)
 	}
+	common.Debugf("%s: %d dependencies, command %v", isolatePath, len(loaded.Dependencies), loaded.Command)
 	return loaded, nil
 }
 
-func IsolateAndArchive(trees []Tree, namespace string, server string) (
-	map[string]string, error) {
+// setRootDir makes the dependencies, relative to IsolateDir, relative to
+// rootDir instead. If rootDir is empty, the deepest directory containing
+// IsolateDir and all the dependencies is used.
+//
+// Returns an error if IsolateDir or a dependency is not in rootDir.
+func (l *loadedIsolate) setRootDir(rootDir string) error {
+	sep := string(os.PathSeparator)
+	deps := make([]string, len(l.Dependencies))
+	for i, dep := range l.Dependencies {
+		deps[i] = filepath.Join(l.IsolateDir, dep)
+	}
+	touched := make([]string, len(l.Touched))
+	for i, t := range l.Touched {
+		touched[i] = filepath.Join(l.IsolateDir, t)
+	}
+	if rootDir == "" {
+		rootDir = l.IsolateDir
+		for i, p := range deps {
+			if !strings.HasSuffix(l.Dependencies[i], sep) {
+				p = filepath.Dir(p)
+			}
+			rootDir = commonDir(rootDir, p)
+		}
+		for _, p := range touched {
+			rootDir = commonDir(rootDir, filepath.Dir(p))
+		}
+	} else {
+		// Compare the resolved paths, so a dependency reached through a
+		// symlinked directory can't escape rootDir. The dependencies themselves
+		// may be symlinks; they are archived as such.
+		resolvedRoot := evalSymlinks(rootDir)
+		if !isAncestor(resolvedRoot, evalSymlinks(l.IsolateDir)) {
+			return fmt.Errorf("isolate directory %s escapes the root directory %s", l.IsolateDir, rootDir)
+		}
+		for i, p := range deps {
+			if !strings.HasSuffix(l.Dependencies[i], sep) {
+				p = filepath.Join(evalSymlinks(filepath.Dir(p)), filepath.Base(p))
+			} else {
+				p = evalSymlinks(p)
+			}
+			if !isAncestor(resolvedRoot, p) {
+				return fmt.Errorf("dependency %s escapes the root directory %s", l.Dependencies[i], rootDir)
+			}
+		}
+		for i, p := range touched {
+			if !isAncestor(resolvedRoot, filepath.Join(evalSymlinks(filepath.Dir(p)), filepath.Base(p))) {
+				return fmt.Errorf("dependency %s escapes the root directory %s", l.Touched[i], rootDir)
+			}
+		}
+	}
+	for i, p := range deps {
+		rel, err := filepath.Rel(rootDir, p)
+		if err != nil {
+			return err
+		}
+		if strings.HasSuffix(l.Dependencies[i], sep) {
+			rel += sep
+		}
+		l.Dependencies[i] = rel
+	}
+	for i, p := range touched {
+		rel, err := filepath.Rel(rootDir, p)
+		if err != nil {
+			return err
+		}
+		l.Touched[i] = rel
+	}
+	l.RootDir = rootDir
+	return nil
+}
+
+// hashDependencies walks and hashes the dependencies of all the loaded
+// .isolate files. Dependencies shared by multiple trees are processed once.
+//
+// Returns the files found for each dependency, keyed by its absolute path.
+func hashDependencies(ctx context.Context, all []*loadedIsolate, loader *FileInfoLoader) (map[string][]*FileInfo, error) {
+	out := map[string][]*FileInfo{}
+	for _, loaded := range all {
+		for _, dep := range loaded.Dependencies {
+			p := filepath.Join(loaded.RootDir, dep)
+			if _, ok := out[p]; ok {
+				continue
+			}
+			infos, err := lookupDependency(ctx, loader, loaded.RootDir, dep)
+			if err != nil {
+				return nil, err
+			}
+			out[p] = infos
+		}
+	}
+	return out, nil
+}
+
+// lookupDependency walks and hashes the dependency dep, relative to rootDir.
+// Directories must end with a path separator and files must not.
+func lookupDependency(ctx context.Context, loader *FileInfoLoader, rootDir, dep string) ([]*FileInfo, error) {
+	p := filepath.Join(rootDir, dep)
+	info, err := os.Lstat(p)
+	if err != nil {
+		return nil, err
+	}
+	isDir := strings.HasSuffix(dep, string(os.PathSeparator))
+	if info.IsDir() && !isDir {
+		return nil, fmt.Errorf("%s is a directory, it must end with %c", dep, os.PathSeparator)
+	}
+	if !info.IsDir() && isDir {
+		return nil, fmt.Errorf("%s is not a directory", dep)
+	}
+	return loader.LookupRecursive(ctx, p)
+}
+
+// buildIsolated returns the .isolated of a loaded .isolate and the state to
+// save alongside it, from the files found by hashDependencies.
+func buildIsolated(tree Tree, loaded *loadedIsolate, depInfos map[string][]*FileInfo) (
+	*isolateserver.Isolated, *SavedState, error) {
+	rootDir := loaded.RootDir
+	relativeCwd, err := filepath.Rel(rootDir, loaded.IsolateDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	isolated := isolateserver.NewIsolated()
+	isolated.Command = loaded.Command
+	state := NewSavedState()
+	state.Command = loaded.Command
+	if loaded.ReadOnly != NotSet {
+		readOnly := int(loaded.ReadOnly)
+		isolated.ReadOnly = &readOnly
+		state.ReadOnly = &readOnly
+	}
+	state.ConfigVariables = tree.Opts.ConfigVariables
+	state.ExtraVariables = tree.Opts.ExtraVariables
+	// They are made relative to the .isolated file when the state is saved.
+	for k, v := range tree.Opts.PathVariables {
+		p, err := absPath(tree.Cwd, filepath.FromSlash(strings.TrimSpace(v)))
+		if err != nil {
+			return nil, nil, err
+		}
+		state.PathVariables[k] = p
+	}
+	state.RootDir = rootDir
+	if relativeCwd != "." {
+		isolated.RelativeCwd = filepath.ToSlash(relativeCwd)
+		state.RelativeCwd = isolated.RelativeCwd
+	}
+	for _, dep := range loaded.Dependencies {
+		for _, info := range depInfos[filepath.Join(rootDir, dep)] {
+			relPath, err := filepath.Rel(rootDir, info.Path)
+			if err != nil {
+				return nil, nil, err
+			}
+			relPath = filepath.ToSlash(relPath)
+			f := isolateserver.File{}
+			if info.Mode&os.ModeSymlink != 0 {
+				link, err := os.Readlink(info.Path)
+				if err != nil {
+					return nil, nil, err
+				}
+				f.Link = &link
+			} else {
+				mode := int(info.Mode.Perm())
+				if loaded.ReadOnly == FilesReadOnly || loaded.ReadOnly == DirsReadOnly {
+					// The files are mapped read-only, strip the write bits.
+					mode &^= 0222
+				}
+				size := info.FileSize
+				f.Digest = isolateserver.HexDigest(info.Hash)
+				f.Mode = &mode
+				f.Size = &size
+			}
+			isolated.Files[relPath] = f
+			saved := SavedFile{File: f}
+			if fi, err := os.Lstat(info.Path); err == nil {
+				saved.Mtime = fi.ModTime().Unix()
+			}
+			state.Files[relPath] = saved
+		}
+	}
+	for _, touched := range loaded.Touched {
+		p := filepath.Join(rootDir, touched)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if fi.IsDir() {
+			return nil, nil, fmt.Errorf("touched dependency %s is a directory", touched)
+		}
+		relPath, err := filepath.Rel(rootDir, p)
+		if err != nil {
+			return nil, nil, err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if _, ok := isolated.Files[relPath]; ok {
+			// Also listed as a regular dependency, its content is needed.
+			continue
+		}
+		mode := int(fi.Mode().Perm())
+		if loaded.ReadOnly == FilesReadOnly || loaded.ReadOnly == DirsReadOnly {
+			mode &^= 0222
+		}
+		size := int64(0)
+		f := isolateserver.File{
+			Touched: true,
+			Digest:  isolateserver.Hash(sha1.New(), nil),
+			Mode:    &mode,
+			Size:    &size,
+		}
+		isolated.Files[relPath] = f
+		state.Files[relPath] = SavedFile{File: f, Mtime: fi.ModTime().Unix()}
+	}
+	return isolated, state, nil
+}
+
+// commonDir returns the deepest directory containing both the absolute
+// cleaned directories a and b. It returns the root of a if there is none, e.g.
+// for paths on different drives.
+func commonDir(a, b string) string {
+	for !isAncestor(a, b) {
+		parent := filepath.Dir(a)
+		if parent == a {
+			break
+		}
+		a = parent
+	}
+	return a
+}
+
+// isAncestor returns true if the absolute cleaned path p is dir or is below
+// it.
+func isAncestor(dir, p string) bool {
+	if dir == p || strings.HasSuffix(dir, string(os.PathSeparator)) {
+		// The filesystem root is the only directory ending with a separator.
+		return strings.HasPrefix(p, dir)
+	}
+	return strings.HasPrefix(p, dir+string(os.PathSeparator))
+}
+
+// evalSymlinks returns p with its symlinks resolved. The trailing parts of p
+// that don't exist are kept as is.
+func evalSymlinks(p string) string {
+	if resolved, err := filepath.EvalSymlinks(p); err == nil {
+		return resolved
+	}
+	parent := filepath.Dir(p)
+	if parent == p {
+		return p
+	}
+	return filepath.Join(evalSymlinks(parent), filepath.Base(p))
+}
+
+// writeIsolated writes the .isolated file and its state, and returns the
+// encoded .isolated file.
+func writeIsolated(isolatedPath, isolatePath string, isolated *isolateserver.Isolated, state *SavedState) (
+	[]byte, error) {
+	data, err := isolated.Encode()
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(isolatedPath, data, 0644); err != nil {
+		return nil, err
+	}
+	relIsolate, err := filepath.Rel(filepath.Dir(isolatedPath), isolatePath)
+	if err != nil {
+		return nil, err
+	}
+	state.IsolateFile = filepath.ToSlash(relIsolate)
+	for k, v := range state.PathVariables {
+		// Keep the absolute path if there is no relative one, e.g. on another
+		// volume.
+		if rel, err := posixRel(filepath.Dir(isolatedPath), v); err == nil {
+			state.PathVariables[k] = rel
+		}
+	}
+	if err := state.Save(isolatedPath); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// childIsolatedPath returns the path of the i-th child .isolated generated
+// when splitting isolatedPath, e.g. foo.0.isolated for foo.isolated.
+func childIsolatedPath(isolatedPath string, i int) string {
+	ext := filepath.Ext(isolatedPath)
+	return fmt.Sprintf("%s.%d%s", strings.TrimSuffix(isolatedPath, ext), i, ext)
+}
+
+// isolatedName returns the name of a target as used in the batcharchive
+// output, i.e. the .isolated file name without its extension.
+func isolatedName(isolatedPath string) string {
+	name := filepath.Base(isolatedPath)
+	return strings.TrimSuffix(name, filepath.Ext(name))
+}
+
+// uploadItem is an item to archive on the server.
+//
+// The content is read from path, unless content is set.
+type uploadItem struct {
+	isolateserver.DigestItem
+	path    string
+	content []byte
+}
+
+// open implements isolateserver.Source.
+func (u *uploadItem) open() (io.ReadCloser, error) {
+	if u.content != nil {
+		return ioutil.NopCloser(bytes.NewReader(u.content)), nil
+	}
+	return os.Open(u.path)
+}
+
+// uploadItems is a set of unique items to archive.
+type uploadItems struct {
+	items []*uploadItem
+	seen  map[isolateserver.HexDigest]bool
+}
+
+func (u *uploadItems) add(item *uploadItem) {
+	if !u.seen[item.Digest] {
+		u.seen[item.Digest] = true
+		u.items = append(u.items, item)
+	}
+}
+
+// archive uploads the items that are missing on the server.
+//
+// A single lookup is done for all the items and each missing item is
+// uploaded once, with up to network concurrent uploads. The transfers are
+// recorded in stats.
+func archive(ctx context.Context, client isolateserver.IsolateServer, items []*uploadItem, network int, stats *isolateserver.StatsRecorder) error {
+	if len(items) == 0 {
+		return nil
+	}
+	digests := make([]*isolateserver.DigestItem, len(items))
+	for i, item := range items {
+		digests[i] = &item.DigestItem
+	}
+	done := stats.Phase("lookup")
+	states, err := client.Contains(ctx, digests)
+	done()
+	if err != nil {
+		return err
+	}
+	stats.Add(isolateserver.ItemsToUpload, int64(len(items)))
+	missing := 0
+	for _, state := range states {
+		if state != nil {
+			missing++
+		}
+	}
+	common.Infof("%d items to upload, %d already on the server", missing, len(items)-missing)
+	defer stats.Phase("upload")()
+	if network < 1 {
+		network = 1
+	}
+	sem := common.NewSemaphore(network)
+	errs := make(chan error, len(items))
+	for i, state := range states {
+		if state == nil {
+			stats.Add(isolateserver.ItemsPresent, 1)
+			continue
+		}
+		if err := sem.WaitContext(ctx); err != nil {
+			errs <- err
+			break
+		}
+		go func(item *uploadItem, state *isolateserver.PushState) {
+			defer sem.Signal()
+			if err := client.Push(ctx, state, item.open); err != nil {
+				errs <- fmt.Errorf("failed to upload %s: %s", item.Digest, err)
+				return
+			}
+			stats.Add(isolateserver.ItemsUploaded, 1)
+			stats.Add(isolateserver.BytesUploaded, item.Size)
+		}(items[i], state)
+	}
+	// Wait for all the uploads to complete.
+	for i := 0; i < network; i++ {
+		if err := sem.Wait(); err != nil {
+			return err
+		}
+	}
+	close(errs)
+	return <-errs
+}
+
+// IsolateAndArchive generates the .isolated file of each tree, saves its
+// state next to it and, if server is specified, uploads the trees to it using
+// c.
+//
+// Work is shared across trees: each dependency is hashed once, a single
+// lookup is done on the server for all the items and each missing item is
+// uploaded once.
+//
+// Returns the digest of each .isolated file, keyed by its name without
+// extension, and the statistics of the run. No digest is returned on failure,
+// since the items of a tree may not all have been uploaded, but the
+// statistics are. Hashing and
+// uploads are aborted when ctx is canceled. progress, if not nil, receives the
+// hashing and upload counters.
+func IsolateAndArchive(ctx context.Context, c *http.Client, trees []Tree, namespace string, server string, conc Concurrency,
+	progress isolateserver.Progress) (map[string]string, *isolateserver.Stats, error) {
+	stats := isolateserver.NewStatsRecorder(progress)
+	out, err := isolateAndArchive(ctx, c, trees, namespace, server, conc, stats)
+	return out, stats.Stats(), err
+}
+
+func isolateAndArchive(ctx context.Context, c *http.Client, trees []Tree, namespace string, server string, conc Concurrency,
+	stats *isolateserver.StatsRecorder) (map[string]string, error) {
+	infoLoader := LoadOrCreateCache()
+	infoLoader.Concurrency = conc.Hash
+	infoLoader.Progress = stats
+	defer infoLoader.Save()
 
-	all_loaded := []*loadedIsolate{}
+	type target struct {
+		tree         Tree
+		isolatePath  string
+		isolatedPath string
+		loaded       *loadedIsolate
+	}
+	targets := make([]*target, 0, len(trees))
+	all := make([]*loadedIsolate, 0, len(trees))
+	done := stats.Phase("load")
 	for _, tree := range trees {
-		loaded, err := loadIsolate(tree)
+		t := &target{tree: tree}
+		var err error
+		if t.isolatedPath, err = absPath(tree.Cwd, tree.Opts.Isolated); err != nil {
+			return nil, err
+		}
+		if t.isolatePath, err = absPath(tree.Cwd, tree.Opts.Isolate); err != nil {
+			return nil, err
+		}
+		if t.loaded, err = loadIsolate(tree); err != nil {
+			return nil, err
+		}
+		previous, err := LoadSavedState(t.isolatedPath)
 		if err != nil {
 			return nil, err
 		}
-		all_loaded = append(all_loaded, loaded)
+		if previous.RootDir != "" {
+			previous.primeLoader(infoLoader)
+		}
+		targets = append(targets, t)
+		all = append(all, t.loaded)
 	}
+	done()
 
-	info_loader := LoadOrCreateCache()
-	defer info_loader.Save()
+	done = stats.Phase("hash")
+	depInfos, err := hashDependencies(ctx, all, infoLoader)
+	done()
+	if err != nil {
+		return nil, err
+	}
 
-	for _, loaded := range all_loaded {
-		fmt.Printf("%+v\n", loaded)
+	out := map[string]string{}
+	toUpload := &uploadItems{seen: map[isolateserver.HexDigest]bool{}}
+	for _, t := range targets {
+		isolated, state, err := buildIsolated(t.tree, t.loaded, depInfos)
+		if err != nil {
+			return nil, err
+		}
+		for relPath, f := range isolated.Files {
+			if f.Link != nil {
+				continue
+			}
+			item := &uploadItem{DigestItem: isolateserver.DigestItem{Digest: f.Digest, Size: *f.Size}}
+			if f.Touched {
+				item.content = []byte{}
+			} else {
+				item.path = filepath.Join(state.RootDir, filepath.FromSlash(relPath))
+			}
+			toUpload.add(item)
+		}
 
-		for _, dep := range loaded.Dependencies {
-			infos, err := info_loader.LookupRecursive(filepath.Join(loaded.IsolateDir, dep))
+		var children []*isolateserver.Isolated
+		if t.tree.Opts.SplitByDir || t.tree.Opts.MaxFilesPerIsolated > 0 {
+			isolated, children, err = isolateserver.SplitIsolated(isolated, t.tree.Opts.SplitByDir, t.tree.Opts.MaxFilesPerIsolated)
+			if err != nil {
+				return nil, err
+			}
+		}
+		for i, child := range children {
+			childPath := childIsolatedPath(t.isolatedPath, i)
+			data, err := child.Encode()
 			if err != nil {
 				return nil, err
 			}
-			for _, info := range infos {
-				fmt.Printf("%s\t%+v\n", dep, info)
+			if err := ioutil.WriteFile(childPath, data, 0644); err != nil {
+				return nil, err
 			}
+			state.ChildIsolatedFiles = append(state.ChildIsolatedFiles, filepath.Base(childPath))
+			toUpload.add(&uploadItem{
+				DigestItem: isolateserver.DigestItem{Digest: isolated.Includes[i], IsIsolated: true, Size: int64(len(data))},
+				content:    data,
+			})
+		}
+
+		data, err := writeIsolated(t.isolatedPath, t.isolatePath, isolated, state)
+		if err != nil {
+			return nil, err
+		}
+		digest := isolateserver.Hash(sha1.New(), data)
+		out[isolatedName(t.isolatedPath)] = string(digest)
+		common.Infof("%s: %d files, digest %s", t.isolatedPath, len(isolated.Files), digest)
+		toUpload.add(&uploadItem{
+			DigestItem: isolateserver.DigestItem{Digest: digest, IsIsolated: true, Size: int64(len(data))},
+			content:    data,
+		})
+	}
+
+	if server != "" {
+		opts := isolateserver.DefaultTransferOptions()
+		opts.CompressConcurrency = conc.Compress
+		opts.Progress = stats
+		client := isolateserver.NewWithOptions(c, server, namespace, "sha-1", isolateserver.CompressionForNamespace(namespace), opts)
+		if err := archive(ctx, client, toUpload.items, conc.Network, stats); err != nil {
+			return nil, err
 		}
 	}
+	return out, nil
+}
 
+// Remap maps the files listed in state into outDir.
+//
+// Files are copied when the tree is writeable, so modifying them doesn't
+// affect the originals. Otherwise their write bits are removed; they are
+// hardlinked when the source already has that mode and copied otherwise. Touched
+// files are created empty. The relative_cwd directory is created even if it
+// contains no file. When directories are read-only, they are made read-only
+// once populated.
+//
+// It stops when ctx is canceled.
+func Remap(ctx context.Context, state *SavedState, outDir string) error {
+	readOnly := NotSet
+	if state.ReadOnly != nil {
+		readOnly = ReadOnlyValue(*state.ReadOnly)
+	}
+	for relPath, f := range state.Files {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		src := filepath.Join(state.RootDir, filepath.FromSlash(relPath))
+		dst := filepath.Join(outDir, filepath.FromSlash(relPath))
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return err
+		}
+		if f.Link != nil {
+			if err := os.Symlink(*f.Link, dst); err != nil {
+				return err
+			}
+			continue
+		}
+		if f.Touched {
+			// Only the file's existence matters.
+			mode := os.FileMode(0644)
+			if f.Mode != nil {
+				mode = os.FileMode(*f.Mode)
+			}
+			if err := ioutil.WriteFile(dst, nil, mode); err != nil {
+				return err
+			}
+			continue
+		}
+		mode := os.FileMode(0644)
+		if f.Mode != nil {
+			mode = os.FileMode(*f.Mode).Perm()
+		}
+		if readOnly != Writeable {
+			mode &^= 0222
+			// A link shares the mode of the source, so it can only be used when
+			// the source already has the requested mode.
+			if fi, err := os.Stat(src); err == nil && fi.Mode().Perm() == mode {
+				if err := os.Link(src, dst); err == nil {
+					continue
+				}
+			}
+		}
+		if err := copyFile(src, dst, mode); err != nil {
+			return err
+		}
+	}
+	// The command runs from relative_cwd even if no file is mapped in it.
+	if err := os.MkdirAll(filepath.Join(outDir, filepath.FromSlash(state.RelativeCwd)), 0755); err != nil {
+		return err
+	}
+	if readOnly == DirsReadOnly {
+		return isolateserver.MakeDirsReadOnly(outDir)
+	}
+	return nil
+}
 
-	return nil, nil
+// copyFile copies src to dst and sets the mode of dst to mode.
+func copyFile(src, dst string, mode os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Chmod(dst, mode)
 }
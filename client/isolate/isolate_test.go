@@ -0,0 +1,448 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"context"
+	"crypto/sha1"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/ut"
+)
+
+// fakeIsolateServer records the calls made by archive.
+type fakeIsolateServer struct {
+	lock     sync.Mutex
+	present  map[isolateserver.HexDigest]bool
+	contains int
+	pushed   map[isolateserver.HexDigest][]byte
+	states   map[*isolateserver.PushState]isolateserver.HexDigest
+}
+
+func (f *fakeIsolateServer) ServerCapabilities(ctx context.Context) (*isolateserver.ServerCapabilities, error) {
+	return &isolateserver.ServerCapabilities{ServerVersion: "fake"}, nil
+}
+
+func (f *fakeIsolateServer) Contains(ctx context.Context, items []*isolateserver.DigestItem) ([]*isolateserver.PushState, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	f.contains++
+	out := make([]*isolateserver.PushState, len(items))
+	for i, item := range items {
+		if !f.present[item.Digest] {
+			out[i] = &isolateserver.PushState{}
+			f.states[out[i]] = item.Digest
+		}
+	}
+	return out, nil
+}
+
+func (f *fakeIsolateServer) Push(ctx context.Context, state *isolateserver.PushState, src isolateserver.Source) error {
+	r, err := src()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	digest := f.states[state]
+	if _, ok := f.pushed[digest]; ok {
+		panic("pushed twice")
+	}
+	f.pushed[digest] = content
+	return nil
+}
+
+func (f *fakeIsolateServer) Fetch(ctx context.Context, digest isolateserver.HexDigest, dest io.Writer) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	content, ok := f.pushed[digest]
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := dest.Write(content)
+	return err
+}
+
+// countingProgress implements isolateserver.Progress.
+type countingProgress struct {
+	lock     sync.Mutex
+	counters map[isolateserver.Counter]int64
+}
+
+func (c *countingProgress) Add(counter isolateserver.Counter, delta int64) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.counters[counter] += delta
+}
+
+// writeTree writes files, keyed by their path relative to root using '/'
+// separators, creating the directories as needed.
+func writeTree(t *testing.T, root string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		ut.AssertEqual(t, nil, os.MkdirAll(filepath.Dir(p), 0700))
+		ut.AssertEqual(t, nil, ioutil.WriteFile(p, []byte(content), 0600))
+	}
+}
+
+func TestArchiveUploadsMissingOnce(t *testing.T) {
+	contents := [][]byte{[]byte("foo"), []byte("bar"), []byte("baz")}
+	items := &uploadItems{seen: map[isolateserver.HexDigest]bool{}}
+	for _, content := range append(contents, contents...) {
+		items.add(&uploadItem{
+			DigestItem: isolateserver.DigestItem{
+				Digest: isolateserver.Hash(sha1.New(), content),
+				Size:   int64(len(content)),
+			},
+			content: content,
+		})
+	}
+	ut.AssertEqual(t, 3, len(items.items))
+
+	present := isolateserver.Hash(sha1.New(), contents[1])
+	f := &fakeIsolateServer{
+		present: map[isolateserver.HexDigest]bool{present: true},
+		pushed:  map[isolateserver.HexDigest][]byte{},
+		states:  map[*isolateserver.PushState]isolateserver.HexDigest{},
+	}
+	p := &countingProgress{counters: map[isolateserver.Counter]int64{}}
+	stats := isolateserver.NewStatsRecorder(p)
+	ut.AssertEqual(t, nil, archive(context.Background(), f, items.items, 2, stats))
+	ut.AssertEqual(t, 1, f.contains)
+	counters := map[isolateserver.Counter]int64{
+		isolateserver.ItemsToUpload: 3,
+		isolateserver.ItemsPresent:  1,
+		isolateserver.ItemsUploaded: 2,
+		isolateserver.BytesUploaded: 6,
+	}
+	ut.AssertEqual(t, counters, p.counters)
+	s := stats.Stats()
+	ut.AssertEqual(t, int64(1), s.ItemsPresent)
+	ut.AssertEqual(t, int64(6), s.BytesUploaded)
+	_, ok := s.Phases["lookup"]
+	ut.AssertEqual(t, true, ok)
+	_, ok = s.Phases["upload"]
+	ut.AssertEqual(t, true, ok)
+	expected := map[isolateserver.HexDigest][]byte{
+		isolateserver.Hash(sha1.New(), contents[0]): contents[0],
+		isolateserver.Hash(sha1.New(), contents[2]): contents[2],
+	}
+	ut.AssertEqual(t, expected, f.pushed)
+}
+
+func TestIsValidVariable(t *testing.T) {
+	ut.AssertEqual(t, true, IsValidVariable("PRODUCT_DIR"))
+	ut.AssertEqual(t, true, IsValidVariable("_a1"))
+	ut.AssertEqual(t, false, IsValidVariable("1a"))
+	ut.AssertEqual(t, false, IsValidVariable("a-b"))
+	ut.AssertEqual(t, false, IsValidVariable(""))
+}
+
+func TestReplaceVars(t *testing.T) {
+	path := common.KeyValVars{"PRODUCT_DIR": "../../out/Release"}
+	extra := common.KeyValVars{"EXECUTABLE_SUFFIX": ".exe", "PRODUCT_DIR": "ignored"}
+
+	out, missing := replaceVars("<(PRODUCT_DIR)/foo<(EXECUTABLE_SUFFIX)", path, extra)
+	ut.AssertEqual(t, "../../out/Release/foo.exe", out)
+	ut.AssertEqual(t, 0, len(missing))
+
+	out, missing = replaceVars("<(FOO)/<(BAR)<(EXECUTABLE_SUFFIX)<(", path, extra)
+	ut.AssertEqual(t, "<(FOO)/<(BAR).exe<(", out)
+	ut.AssertEqual(t, []string{"FOO", "BAR"}, missing)
+
+	// Not a valid reference.
+	out, missing = replaceVars("<()<(1A)", path, extra)
+	ut.AssertEqual(t, "<()<(1A)", out)
+	ut.AssertEqual(t, 0, len(missing))
+}
+
+func TestProcessPathVariables(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(td, "out", "Release"), 0700))
+	ut.AssertEqual(t, nil, os.MkdirAll(filepath.Join(td, "base"), 0700))
+
+	out, err := processPathVariables(td, filepath.Join(td, "base"), common.KeyValVars{"PRODUCT_DIR": "out/Release"})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, common.KeyValVars{"PRODUCT_DIR": filepath.Join("..", "out", "Release")}, out)
+
+	_, err = processPathVariables(td, td, common.KeyValVars{"PRODUCT_DIR": "out/Debug"})
+	ut.AssertEqual(t, true, err != nil)
+}
+
+func TestChildIsolatedPath(t *testing.T) {
+	ut.AssertEqual(t, filepath.Join("out", "foo.1.isolated"), childIsolatedPath(filepath.Join("out", "foo.isolated"), 1))
+}
+
+func TestIsolatedName(t *testing.T) {
+	ut.AssertEqual(t, "foo_test", isolatedName("/out/Release/foo_test.isolated"))
+	ut.AssertEqual(t, "foo", isolatedName("foo"))
+}
+
+func TestBuildIsolatedDependencies(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	files := map[string]string{
+		"foo.isolate": `{
+			'variables': {
+				'files': ['data/', 'touched'],
+				'isolate_dependency_touched': ['touched', 'log'],
+			},
+		}`,
+		"data/a":     "a",
+		"data/sub/b": "bb",
+		"log":        "ignored",
+		"touched":    "t",
+	}
+	writeTree(t, td, files)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "foo.isolate"
+	tree := Tree{Cwd: td, Opts: opts}
+
+	loaded, err := loadIsolate(tree)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"log", "touched"}, loaded.Touched)
+	depInfos, err := hashDependencies(context.Background(), []*loadedIsolate{loaded}, newCache())
+	ut.AssertEqual(t, nil, err)
+	isolated, state, err := buildIsolated(tree, loaded, depInfos)
+	ut.AssertEqual(t, nil, err)
+	digest := func(s string) isolateserver.HexDigest {
+		return isolateserver.Hash(sha1.New(), []byte(s))
+	}
+	// Directories aren't listed, touched files are empty unless they are
+	// also regular dependencies.
+	ut.AssertEqual(t, 4, len(isolated.Files))
+	ut.AssertEqual(t, digest("a"), isolated.Files["data/a"].Digest)
+	ut.AssertEqual(t, digest("bb"), isolated.Files["data/sub/b"].Digest)
+	ut.AssertEqual(t, false, isolated.Files["touched"].Touched)
+	ut.AssertEqual(t, digest("t"), isolated.Files["touched"].Digest)
+	ut.AssertEqual(t, true, isolated.Files["log"].Touched)
+	ut.AssertEqual(t, digest(""), isolated.Files["log"].Digest)
+	ut.AssertEqual(t, int64(0), *isolated.Files["log"].Size)
+
+	// Touched files are mapped empty.
+	out := filepath.Join(td, "out")
+	ut.AssertEqual(t, nil, Remap(context.Background(), state, out))
+	content, err := ioutil.ReadFile(filepath.Join(out, "log"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "", string(content))
+}
+
+func TestRemapEmptyRelativeCwd(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer isolateserver.RemoveTree(td)
+	writeTree(t, td, map[string]string{"src/data": "data"})
+	readOnly := int(DirsReadOnly)
+	state := NewSavedState()
+	state.Files = map[string]SavedFile{"data": {}}
+	state.ReadOnly = &readOnly
+	state.RelativeCwd = "out/Release"
+	state.RootDir = filepath.Join(td, "src")
+
+	out := filepath.Join(td, "out")
+	ut.AssertEqual(t, nil, Remap(context.Background(), state, out))
+	info, err := os.Stat(filepath.Join(out, "out", "Release"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, info.IsDir())
+}
+
+func TestRemapModes(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer isolateserver.RemoveTree(td)
+	writeTree(t, td, map[string]string{"src/ro": "ro", "src/rw": "rw", "src/exe": "exe"})
+	src := filepath.Join(td, "src")
+	ut.AssertEqual(t, nil, os.Chmod(filepath.Join(src, "ro"), 0444))
+	ut.AssertEqual(t, nil, os.Chmod(filepath.Join(src, "exe"), 0755))
+	mode := func(m int) *int { return &m }
+
+	for _, readOnly := range []ReadOnlyValue{Writeable, FilesReadOnly} {
+		r := int(readOnly)
+		state := NewSavedState()
+		state.Files = map[string]SavedFile{
+			"ro":  {File: isolateserver.File{Mode: mode(0444)}},
+			"rw":  {File: isolateserver.File{Mode: mode(0644)}},
+			"exe": {File: isolateserver.File{Mode: mode(0755)}},
+		}
+		state.ReadOnly = &r
+		state.RootDir = src
+		out := filepath.Join(td, fmt.Sprintf("out%d", r))
+		ut.AssertEqual(t, nil, Remap(context.Background(), state, out))
+
+		for name, f := range state.Files {
+			expected := os.FileMode(*f.Mode)
+			if readOnly != Writeable {
+				expected &^= 0222
+			}
+			info, err := os.Stat(filepath.Join(out, name))
+			ut.AssertEqual(t, nil, err)
+			ut.AssertEqual(t, expected, info.Mode().Perm())
+			srcInfo, err := os.Stat(filepath.Join(src, name))
+			ut.AssertEqual(t, nil, err)
+			// Only the files whose source already has the requested mode are
+			// linked.
+			linked := readOnly != Writeable && srcInfo.Mode().Perm() == expected
+			ut.AssertEqual(t, linked, os.SameFile(srcInfo, info))
+		}
+	}
+	// The sources are unchanged.
+	info, err := os.Stat(filepath.Join(src, "rw"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestLookupDependency(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	writeTree(t, td, map[string]string{"data/sub/a": "a"})
+	ctx := context.Background()
+	sep := string(os.PathSeparator)
+
+	infos, err := lookupDependency(ctx, newCache(), td, "data"+sep)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(infos))
+	ut.AssertEqual(t, filepath.Join(td, "data", "sub", "a"), infos[0].Path)
+
+	_, err = lookupDependency(ctx, newCache(), td, "data")
+	ut.AssertEqual(t, "data is a directory, it must end with "+sep, err.Error())
+	_, err = lookupDependency(ctx, newCache(), td, filepath.Join("data", "sub", "a")+sep)
+	ut.AssertEqual(t, true, err != nil)
+	_, err = lookupDependency(ctx, newCache(), td, "missing")
+	ut.AssertEqual(t, true, err != nil)
+}
+
+func TestBuildIsolatedRelativeCwd(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	td, err = filepath.EvalSymlinks(td)
+	ut.AssertEqual(t, nil, err)
+	files := map[string]string{
+		"src/foo/foo.isolate": `{
+			'variables': {
+				'command': ['./foo'],
+				'files': ['foo', '../base/data/'],
+			},
+		}`,
+		"src/base/data/a": "a",
+		"src/foo/foo":     "foo",
+	}
+	writeTree(t, td, files)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = filepath.Join("src", "foo", "foo.isolate")
+	tree := Tree{Cwd: td, Opts: opts}
+
+	loaded, err := loadIsolate(tree)
+	ut.AssertEqual(t, nil, err)
+	depInfos, err := hashDependencies(context.Background(), []*loadedIsolate{loaded}, newCache())
+	ut.AssertEqual(t, nil, err)
+	isolated, state, err := buildIsolated(tree, loaded, depInfos)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "foo", isolated.RelativeCwd)
+	ut.AssertEqual(t, "foo", state.RelativeCwd)
+	ut.AssertEqual(t, filepath.Join(td, "src"), state.RootDir)
+	ut.AssertEqual(t, 2, len(isolated.Files))
+	ut.AssertEqual(t, isolateserver.Hash(sha1.New(), []byte("a")), isolated.Files["base/data/a"].Digest)
+	ut.AssertEqual(t, isolateserver.Hash(sha1.New(), []byte("foo")), isolated.Files["foo/foo"].Digest)
+}
+
+func TestCommonDir(t *testing.T) {
+	data := []struct {
+		a, b, expected string
+	}{
+		{"/a/b", "/a/b", "/a/b"},
+		{"/a/b", "/a/b/c", "/a/b"},
+		{"/a/b/c", "/a/b", "/a/b"},
+		{"/a/b", "/a/bc", "/a"},
+		{"/a/b", "/c", "/"},
+		{"/", "/c", "/"},
+	}
+	for i, line := range data {
+		a, b, expected := filepath.FromSlash(line.a), filepath.FromSlash(line.b), filepath.FromSlash(line.expected)
+		ut.AssertEqualIndex(t, i, expected, commonDir(a, b))
+	}
+}
+
+func TestLoadIsolateRootDir(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	td, err = filepath.EvalSymlinks(td)
+	ut.AssertEqual(t, nil, err)
+	writeTree(t, td, map[string]string{
+		"src/foo/foo.isolate": `{'variables': {'files': ['../../data/', 'foo'], 'isolate_dependency_touched': ['bar']}}`,
+	})
+	p := filepath.Join(td, "src", "foo", "foo.isolate")
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = p
+	sep := string(os.PathSeparator)
+
+	// The root is detected from the dependencies.
+	loaded, err := loadIsolate(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, td, loaded.RootDir)
+	ut.AssertEqual(t, []string{"data" + sep, filepath.Join("src", "foo", "foo")}, loaded.Dependencies)
+	ut.AssertEqual(t, []string{filepath.Join("src", "foo", "bar")}, loaded.Touched)
+
+	// An explicit root is used as is.
+	opts.RootDir = ".."
+	loaded, err = loadIsolate(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, filepath.Dir(td), loaded.RootDir)
+	ut.AssertEqual(t, filepath.Join(filepath.Base(td), "data")+sep, loaded.Dependencies[0])
+
+	// Dependencies can't escape it.
+	opts.RootDir = "src"
+	_, err = loadIsolate(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, p+": dependency "+filepath.FromSlash("../../data/")+" escapes the root directory "+filepath.Join(td, "src"), err.Error())
+	opts.RootDir = filepath.Join("src", "bar")
+	_, err = loadIsolate(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, true, err != nil)
+}
+
+func TestLoadIsolateRootDirSymlink(t *testing.T) {
+	if common.IsWindows() {
+		t.Skip("symlinks require privileges on Windows")
+	}
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	writeTree(t, td, map[string]string{
+		"src/foo.isolate": `{'variables': {'files': ['link/data', 'link/dir/']}}`,
+		"outside/data":    "data",
+		"outside/dir/a":   "a",
+	})
+	ut.AssertEqual(t, nil, os.Symlink(filepath.Join(td, "outside"), filepath.Join(td, "src", "link")))
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = filepath.Join("src", "foo.isolate")
+	opts.RootDir = "src"
+
+	// The dependencies are in src lexically, but not once resolved.
+	_, err = loadIsolate(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, true, err != nil)
+	ut.AssertEqual(t, true, strings.Contains(err.Error(), "escapes the root directory"))
+}
@@ -0,0 +1,269 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// Kinds of LintIssue.
+const (
+	// LintLoad is reported when the .isolate files can't be loaded.
+	LintLoad = "load"
+	// LintAbsoluteInclude is reported for includes with an absolute path.
+	LintAbsoluteInclude = "absolute-include"
+	// LintMissing is reported for dependencies and includes that don't exist.
+	LintMissing = "missing"
+	// LintDirWithoutSlash is reported for directories not ending with '/'.
+	LintDirWithoutSlash = "dir-without-slash"
+	// LintFileWithSlash is reported for files ending with '/'.
+	LintFileWithSlash = "file-with-slash"
+	// LintDuplicate is reported for dependencies listed, directly or through
+	// their directory, for configurations that already list them.
+	LintDuplicate = "duplicate"
+	// LintUnreachable is reported for conditions no configuration matches.
+	LintUnreachable = "unreachable"
+)
+
+// LintIssue is a mistake found in a .isolate file.
+type LintIssue struct {
+	// File is the .isolate file, relative to the current directory of the tree
+	// when possible.
+	File string `json:"file"`
+	// Condition is the condition of the issue, empty for the top level
+	// variables and for the file itself.
+	Condition string `json:"condition,omitempty"`
+	Kind      string `json:"kind"`
+	Message   string `json:"message"`
+}
+
+func (l *LintIssue) String() string {
+	if l.Condition != "" {
+		return fmt.Sprintf("%s: condition '%s': %s: %s", l.File, l.Condition, l.Kind, l.Message)
+	}
+	return fmt.Sprintf("%s: %s: %s", l.File, l.Kind, l.Message)
+}
+
+// Lint checks the .isolate file of tree and its includes for common mistakes,
+// for all their configurations. The path and extra variables of the tree are
+// used to check the dependencies that reference them; the other ones are only
+// checked for duplicates.
+//
+// Returns an error only if the flags of the tree are invalid.
+func Lint(tree Tree) ([]*LintIssue, error) {
+	isolatePath, err := absPath(tree.Cwd, tree.Opts.Isolate)
+	if err != nil {
+		return nil, err
+	}
+	cwd, err := filepath.Abs(tree.Cwd)
+	if err != nil {
+		return nil, err
+	}
+	l := &linter{tree: tree, cwd: cwd, seen: map[string]bool{}}
+	content, err := ioutil.ReadFile(isolatePath)
+	if err != nil {
+		l.report(isolatePath, "", LintLoad, "%s", err)
+		return l.issues, nil
+	}
+	if err := l.lintFile(isolatePath); err != nil {
+		return nil, err
+	}
+	// The files that don't parse were reported by lintFile, on the file itself.
+	// Only report the other reasons the tree can't be loaded, e.g. an include
+	// cycle, first.
+	if !l.parseFailed {
+		if _, err := LoadIsolateAsConfig(filepath.Dir(isolatePath), content, nil); err != nil {
+			issues := l.issues
+			l.issues = nil
+			l.report(isolatePath, "", LintLoad, "%s", err)
+			l.issues = append(l.issues, issues...)
+		}
+	}
+	return l.issues, nil
+}
+
+type linter struct {
+	tree        Tree
+	cwd         string
+	seen        map[string]bool
+	parseFailed bool
+	issues      []*LintIssue
+}
+
+func (l *linter) report(file, cond, kind, format string, args ...interface{}) {
+	if rel, err := filepath.Rel(l.cwd, file); err == nil && !strings.HasPrefix(rel, "..") {
+		file = rel
+	}
+	l.issues = append(l.issues, &LintIssue{file, cond, kind, fmt.Sprintf(format, args...)})
+}
+
+// lintLocation is the top level variables or a condition of a .isolate file,
+// with the configurations it applies to.
+type lintLocation struct {
+	condition string
+	vars      variables
+	// configs are the keys of the fully bound configurations matched, nil for
+	// the top level variables, which apply to all of them.
+	configs map[string]bool
+}
+
+// overlaps returns true if both locations apply to a common configuration.
+func (l *lintLocation) overlaps(o *lintLocation) bool {
+	if l.configs == nil || o.configs == nil {
+		return true
+	}
+	for k := range l.configs {
+		if o.configs[k] {
+			return true
+		}
+	}
+	return false
+}
+
+// lintFile checks the .isolate file p and its includes, once each.
+func (l *linter) lintFile(p string) error {
+	if l.seen[p] {
+		return nil
+	}
+	l.seen[p] = true
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		// Already reported by Lint or by the includer.
+		return nil
+	}
+	parsed, err := parseIsolate(content)
+	if err != nil {
+		l.parseFailed = true
+		l.report(p, "", LintLoad, "%s", err)
+		return nil
+	}
+	varsAndValues, err := parsed.verify()
+	if err != nil {
+		l.parseFailed = true
+		l.report(p, "", LintLoad, "%s", err)
+		return nil
+	}
+	dir := filepath.Dir(p)
+	pathVariables, err := processPathVariables(l.tree.Cwd, dir, l.tree.Opts.PathVariables)
+	if err != nil {
+		return err
+	}
+
+	var locations []*lintLocation
+	if parsed.Variables != nil {
+		locations = append(locations, &lintLocation{vars: *parsed.Variables})
+	}
+	if len(parsed.Conditions) != 0 {
+		configVariables := makeConfigsV(nil, varsAndValues).ConfigVariables
+		all := varsAndValues.cartesianProductOfValues(configVariables)
+		for _, cond := range parsed.Conditions {
+			loc := &lintLocation{condition: cond.Condition, vars: cond.Variables, configs: map[string]bool{}}
+			for _, config := range matchConfigs(cond.Condition, configVariables, all) {
+				if name := configName(config); name.isFullyBound() {
+					loc.configs[name.key()] = true
+				}
+			}
+			if len(loc.configs) == 0 {
+				l.report(p, cond.Condition, LintUnreachable, "no configuration matches the condition")
+			}
+			locations = append(locations, loc)
+		}
+	}
+
+	// Dependencies, keyed by their cleaned path, with the locations listing
+	// them.
+	listed := map[string][]*lintLocation{}
+	for _, loc := range locations {
+		for _, f := range loc.vars.Files {
+			l.lintDependency(p, loc.condition, dir, f, pathVariables)
+			key := path.Clean(f)
+			for _, other := range listed[key] {
+				if loc.overlaps(other) {
+					l.report(p, loc.condition, LintDuplicate, "%s is already listed%s", f, describeLocation(other))
+					break
+				}
+			}
+			listed[key] = append(listed[key], loc)
+		}
+		for _, f := range loc.vars.Touched {
+			l.lintDependency(p, loc.condition, dir, f, pathVariables)
+		}
+	}
+	for _, loc := range locations {
+		for _, f := range loc.vars.Files {
+		parents:
+			for d := path.Dir(path.Clean(f)); d != "." && d != "/" && d != ".."; d = path.Dir(d) {
+				for _, other := range listed[d] {
+					if loc.overlaps(other) {
+						l.report(p, loc.condition, LintDuplicate, "%s is already included by %s/%s", f, d, describeLocation(other))
+						break parents
+					}
+				}
+			}
+		}
+	}
+
+	for _, include := range parsed.Includes {
+		if filepath.IsAbs(include) || path.IsAbs(include) {
+			l.report(p, "", LintAbsoluteInclude, "%s", include)
+			continue
+		}
+		included := filepath.Join(dir, filepath.FromSlash(include))
+		if _, err := os.Stat(included); err != nil {
+			l.report(p, "", LintMissing, "include %s", include)
+			continue
+		}
+		if err := l.lintFile(included); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func describeLocation(loc *lintLocation) string {
+	if loc.configs == nil {
+		return " in the top level variables"
+	}
+	return fmt.Sprintf(" in condition '%s'", loc.condition)
+}
+
+// lintDependency checks that the dependency f of the .isolate file p in dir
+// exists and that it ends with '/' if and only if it is a directory.
+func (l *linter) lintDependency(p, cond, dir, f string, pathVariables common.KeyValVars) {
+	resolved, missing := replaceVars(f, pathVariables, l.tree.Opts.ExtraVariables)
+	if len(missing) != 0 {
+		return
+	}
+	resolved = filepath.FromSlash(resolved)
+	if !filepath.IsAbs(resolved) {
+		resolved = filepath.Join(dir, resolved)
+	}
+	info, err := os.Stat(resolved)
+	switch {
+	case err != nil:
+		l.report(p, cond, LintMissing, "%s", f)
+	case info.IsDir() && !strings.HasSuffix(f, "/"):
+		l.report(p, cond, LintDirWithoutSlash, "%s is a directory, use %s/", f, f)
+	case !info.IsDir() && strings.HasSuffix(f, "/"):
+		l.report(p, cond, LintFileWithSlash, "%s is not a directory", f)
+	}
+}
+
+// isFullyBound returns true if all the values are bound.
+func (c configName) isFullyBound() bool {
+	for _, v := range c {
+		if !v.isBound() {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestLint(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	files := map[string]string{
+		"base.isolate": `{
+			'includes': ['/abs.isolate', 'missing.isolate'],
+			'variables': {'files': ['data/', 'data/x', 'file/']},
+		}`,
+		"foo.isolate": `{
+			'includes': ['base.isolate'],
+			'conditions': [
+				['OS=="linux"', {'variables': {'files': ['data', 'gone', 'file']}}],
+				['OS=="mac"', {'variables': {'files': ['file']}}],
+				['OS=="mac" and OS=="win"', {'variables': {'files': ['<(PRODUCT_DIR)/foo']}}],
+				['OS=="linux" or OS=="win"', {'variables': {'files': ['file']}}],
+			],
+		}`,
+		"data/x": "x",
+		"file":   "file",
+	}
+	writeTree(t, td, files)
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "foo.isolate"
+
+	issues, err := Lint(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, nil, err)
+	var actual []LintIssue
+	for _, issue := range issues {
+		if issue.Kind == LintLoad {
+			// The message depends on the platform.
+			issue.Message = ""
+		}
+		actual = append(actual, *issue)
+	}
+	linux := `OS=="linux"`
+	both := `OS=="linux" or OS=="win"`
+	expected := []LintIssue{
+		{"foo.isolate", "", LintLoad, ""},
+		{"foo.isolate", `OS=="mac" and OS=="win"`, LintUnreachable, "no configuration matches the condition"},
+		{"foo.isolate", linux, LintDirWithoutSlash, "data is a directory, use data/"},
+		{"foo.isolate", linux, LintMissing, "gone"},
+		{"foo.isolate", both, LintDuplicate, `file is already listed in condition 'OS=="linux"'`},
+		{"base.isolate", "", LintFileWithSlash, "file/ is not a directory"},
+		{"base.isolate", "", LintDuplicate, "data/x is already included by data/ in the top level variables"},
+		{"base.isolate", "", LintAbsoluteInclude, "/abs.isolate"},
+		{"base.isolate", "", LintMissing, "include missing.isolate"},
+	}
+	ut.AssertEqual(t, expected, actual)
+	ut.AssertEqual(t, `foo.isolate: condition 'OS=="linux"': missing: gone`, issues[3].String())
+}
+
+func TestLintParseError(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	writeTree(t, td, map[string]string{
+		"foo.isolate": `{'includes': ['bad.isolate']}`,
+		"bad.isolate": `{'variables': {'files': [}`,
+	})
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = "foo.isolate"
+
+	// The error is reported once, on the file that doesn't parse.
+	issues, err := Lint(Tree{Cwd: td, Opts: opts})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 1, len(issues))
+	ut.AssertEqual(t, "bad.isolate", issues[0].File)
+	ut.AssertEqual(t, LintLoad, issues[0].Kind)
+}
@@ -0,0 +1,127 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// pathSemantics describes the native absolute paths of an OS, so they can be
+// processed the same way whatever the OS running the code.
+type pathSemantics struct {
+	// separators are the characters separating path components.
+	separators string
+	// caseInsensitive is true if paths differing only by case are the same.
+	caseInsensitive bool
+	// volumes is true if paths start with a drive letter, e.g. 'C:', or a UNC
+	// share, e.g. '\\server\share'.
+	volumes bool
+}
+
+var (
+	posixPaths   = pathSemantics{separators: "/"}
+	windowsPaths = pathSemantics{separators: `\/`, caseInsensitive: true, volumes: true}
+)
+
+// hostPaths is the pathSemantics of the OS running the code. Tests replace
+// it to process the paths of other OSes.
+var hostPaths = posixPaths
+
+func init() {
+	if common.IsWindows() {
+		hostPaths = windowsPaths
+	}
+}
+
+// posixRel returns target relative to base, both absolute native paths, using
+// '/' as separator. See pathSemantics.posixRel.
+func posixRel(base, target string) (string, error) {
+	return hostPaths.posixRel(base, target)
+}
+
+// posixRel returns target relative to base, both absolute paths, using '/' as
+// separator whatever the native separator is.
+//
+// Returns an error if the paths are on different volumes; there is no
+// relative path between them.
+func (s pathSemantics) posixRel(base, target string) (string, error) {
+	baseVolume, baseParts := s.split(base)
+	targetVolume, targetParts := s.split(target)
+	if !s.equal(baseVolume, targetVolume) {
+		return "", fmt.Errorf("%s and %s are on different volumes", base, target)
+	}
+	i := 0
+	for i < len(baseParts) && i < len(targetParts) && s.equal(baseParts[i], targetParts[i]) {
+		i++
+	}
+	parts := make([]string, 0, len(baseParts)-i+len(targetParts)-i)
+	for range baseParts[i:] {
+		parts = append(parts, "..")
+	}
+	parts = append(parts, targetParts[i:]...)
+	if len(parts) == 0 {
+		return ".", nil
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// split returns the volume of the absolute path p and its cleaned components.
+// Like for filepath.Clean, ".." at the root is the root itself.
+func (s pathSemantics) split(p string) (string, []string) {
+	volume := ""
+	if s.volumes {
+		volume = s.volume(p)
+		p = p[len(volume):]
+	}
+	var parts []string
+	for _, part := range strings.FieldsFunc(p, s.isSeparator) {
+		switch {
+		case part == ".":
+		case part == "..":
+			if len(parts) != 0 {
+				parts = parts[:len(parts)-1]
+			}
+		default:
+			parts = append(parts, part)
+		}
+	}
+	return volume, parts
+}
+
+// volume returns the drive letter or the UNC share p starts with, if any.
+func (s pathSemantics) volume(p string) string {
+	if len(p) >= 2 && p[1] == ':' {
+		return p[:2]
+	}
+	if len(p) < 2 || !s.isSeparator(rune(p[0])) || !s.isSeparator(rune(p[1])) {
+		return ""
+	}
+	// UNC path: the volume is made of the server and share names.
+	server := p[2:]
+	i := strings.IndexAny(server, s.separators)
+	if i == -1 {
+		return p
+	}
+	j := strings.IndexAny(server[i+1:], s.separators)
+	if j == -1 {
+		return p
+	}
+	return p[:2+i+1+j]
+}
+
+func (s pathSemantics) isSeparator(r rune) bool {
+	return strings.ContainsRune(s.separators, r)
+}
+
+// equal returns true if the path components a and b are the same.
+func (s pathSemantics) equal(a, b string) bool {
+	if s.caseInsensitive {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
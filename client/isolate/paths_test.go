@@ -0,0 +1,69 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestPosixRel(t *testing.T) {
+	data := []struct {
+		s              pathSemantics
+		base, target   string
+		expected       string
+		expectedFailed bool
+	}{
+		{posixPaths, "/a/b", "/a/b", ".", false},
+		{posixPaths, "/a/b", "/a/b/c/d", "c/d", false},
+		{posixPaths, "/a/b/c", "/a/d", "../../d", false},
+		{posixPaths, "/a/b/", "/a/./b/../c", "../c", false},
+		{posixPaths, "/", "/a", "a", false},
+		{posixPaths, "/a/B", "/a/b", "../b", false},
+		// ".." at the root is the root.
+		{posixPaths, "/", "/../a", "a", false},
+		{posixPaths, "/a", "/../../a/b", "b", false},
+		// Windows separators, whatever the OS running the test.
+		{windowsPaths, `C:\a\b`, `C:\a\c\d`, "../c/d", false},
+		{windowsPaths, `C:\a\b`, `C:/a/b/c`, "c", false},
+		{windowsPaths, `C:\`, `C:\a`, "a", false},
+		{windowsPaths, `C:\`, `C:\..\a`, "a", false},
+		{windowsPaths, `\\server\share`, `\\server\share\..\a`, "a", false},
+		// Case-insensitive.
+		{windowsPaths, `C:\Src\Foo`, `c:\src\foo\Bar`, "Bar", false},
+		{windowsPaths, `C:\src\foo`, `C:\SRC\bar`, "../bar", false},
+		// Cross-drive.
+		{windowsPaths, `C:\a`, `D:\a`, "", true},
+		// UNC.
+		{windowsPaths, `\\server\share\a`, `\\SERVER\share\b\c`, "../b/c", false},
+		{windowsPaths, `\\server\share`, `\\server\share\a`, "a", false},
+		{windowsPaths, `\\server\share\a`, `\\server\other\a`, "", true},
+		{windowsPaths, `\\server\share\a`, `C:\a`, "", true},
+	}
+	for i, line := range data {
+		actual, err := line.s.posixRel(line.base, line.target)
+		ut.AssertEqualIndex(t, i, line.expectedFailed, err != nil)
+		ut.AssertEqualIndex(t, i, line.expected, actual)
+	}
+}
+
+func TestConfigSettingsUnionWindows(t *testing.T) {
+	defer func(old pathSemantics) {
+		hostPaths = old
+	}(hostPaths)
+	hostPaths = windowsPaths
+
+	lhs := &ConfigSettings{Command: []string{"foo"}, Files: []string{"foo"}, ReadOnly: NotSet, IsolateDir: `C:\src\foo`}
+	rhs := &ConfigSettings{Files: []string{"x", "y/"}, ReadOnly: NotSet, IsolateDir: `c:\SRC\base\data`}
+	out, err := lhs.union(rhs)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, `C:\src\foo`, out.IsolateDir)
+	ut.AssertEqual(t, []string{"../base/data/x", "../base/data/y/", "foo"}, out.Files)
+
+	rhs.IsolateDir = `D:\src\base`
+	_, err = lhs.union(rhs)
+	ut.AssertEqual(t, true, err != nil)
+}
@@ -0,0 +1,321 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// FormatIsolate returns the .isolate file content, located in isolateDir, in
+// canonical form: the files are sorted, the conditions yielding the same
+// configurations are merged and the comment at the top of the file is kept.
+// The includes are kept as is.
+func FormatIsolate(isolateDir string, content []byte) ([]byte, error) {
+	parsed, configs, err := loadIsolateFile(isolateDir, content, extractComment(content))
+	if err != nil {
+		return nil, err
+	}
+	out, err := configs.makeIsolateFile(isolateDir)
+	if err != nil {
+		return nil, err
+	}
+	out.Includes = parsed.Includes
+	return out.prettyPrint(configs.FileComment), nil
+}
+
+// MergeIsolate is like FormatIsolate but folds the includes into the
+// returned file. The files of the includes are made relative to isolateDir.
+func MergeIsolate(isolateDir string, content []byte) ([]byte, error) {
+	configs, err := LoadIsolateAsConfig(isolateDir, content, extractComment(content))
+	if err != nil {
+		return nil, err
+	}
+	out, err := configs.makeIsolateFile(isolateDir)
+	if err != nil {
+		return nil, err
+	}
+	return out.prettyPrint(configs.FileComment), nil
+}
+
+// extractComment returns the comment lines at the top of a .isolate file.
+func extractComment(content []byte) []byte {
+	var out []byte
+	for len(content) != 0 && content[0] == '#' {
+		i := bytes.IndexByte(content, '\n') + 1
+		if i == 0 {
+			i = len(content)
+		}
+		out = append(out, content[:i]...)
+		content = content[i:]
+	}
+	return out
+}
+
+const (
+	itemFile = iota
+	itemTouched
+	itemCommand
+	itemReadOnly
+)
+
+// isolateItem is a file, a touched file, a command or a read_only value
+// defined for some configurations.
+type isolateItem struct {
+	kind  int
+	value string
+}
+
+// makeIsolateFile returns the .isolate file defining c, relative to rootDir.
+//
+// Each file, touched file, command and read_only value is defined in a
+// condition matching the configurations defining it. Configurations matched by
+// a less specific one in the same set are dropped, as the condition of the
+// latter matches them too.
+func (c *Configs) makeIsolateFile(rootDir string) (*parsedIsolate, error) {
+	var items []isolateItem
+	configsByItem := map[isolateItem][]configName{}
+	commands := map[string][]string{}
+	add := func(it isolateItem, key configName) {
+		configs, ok := configsByItem[it]
+		if !ok {
+			items = append(items, it)
+		} else if configs[len(configs)-1].Equals(key) {
+			return
+		}
+		configsByItem[it] = append(configs, key)
+	}
+	for _, pair := range c.getSortedConfigPairs() {
+		s := pair.value
+		rebasePath := "."
+		if s.IsolateDir != "" && s.IsolateDir != rootDir {
+			rel, err := posixRel(rootDir, s.IsolateDir)
+			if err != nil {
+				return nil, err
+			}
+			rebasePath = rel
+		}
+		for _, f := range s.Files {
+			add(isolateItem{itemFile, rebaseFile(rebasePath, f)}, pair.key)
+		}
+		for _, f := range s.Touched {
+			add(isolateItem{itemTouched, rebaseFile(rebasePath, f)}, pair.key)
+		}
+		if len(s.Command) > 0 {
+			if rebasePath != "." {
+				common.Warningf("command %v is now relative to %s instead of %s", s.Command, rootDir, s.IsolateDir)
+			}
+			v := strings.Join(s.Command, "\x00")
+			commands[v] = s.Command
+			add(isolateItem{itemCommand, v}, pair.key)
+		}
+		if s.ReadOnly != NotSet {
+			add(isolateItem{itemReadOnly, strconv.Itoa(int(s.ReadOnly))}, pair.key)
+		}
+	}
+
+	type group struct {
+		configs []configName
+		vars    variables
+	}
+	var groups []*group
+	byConfigs := map[string]*group{}
+	for _, it := range items {
+		configs := reduceConfigs(configsByItem[it])
+		keys := make([]string, len(configs))
+		for i, config := range configs {
+			keys[i] = config.key()
+		}
+		key := strings.Join(keys, "\x01")
+		g := byConfigs[key]
+		if g == nil {
+			g = &group{configs: configs}
+			byConfigs[key] = g
+			groups = append(groups, g)
+		}
+		switch it.kind {
+		case itemFile:
+			g.vars.Files = append(g.vars.Files, it.value)
+		case itemTouched:
+			g.vars.Touched = append(g.vars.Touched, it.value)
+		case itemCommand:
+			if g.vars.Command != nil {
+				return nil, fmt.Errorf("conflicting commands %v and %v", g.vars.Command, commands[it.value])
+			}
+			g.vars.Command = commands[it.value]
+		case itemReadOnly:
+			if g.vars.ReadOnly != nil {
+				return nil, fmt.Errorf("conflicting read_only values %d and %s", *g.vars.ReadOnly, it.value)
+			}
+			readOnly, _ := strconv.Atoi(it.value)
+			g.vars.ReadOnly = &readOnly
+		}
+	}
+
+	out := &parsedIsolate{}
+	for _, g := range groups {
+		sort.Strings(g.vars.Files)
+		sort.Strings(g.vars.Touched)
+		if len(g.configs) == 1 && g.configs[0].isGlobal() {
+			vars := g.vars
+			out.Variables = &vars
+			continue
+		}
+		out.Conditions = append(out.Conditions, condition{
+			Condition: conditionString(c.ConfigVariables, g.configs),
+			Variables: g.vars,
+		})
+	}
+	sort.Sort(conditionsByString(out.Conditions))
+	return out, nil
+}
+
+// isGlobal returns true if no value is bound, i.e. it matches all the
+// configurations.
+func (c configName) isGlobal() bool {
+	for _, v := range c {
+		if v.isBound() {
+			return false
+		}
+	}
+	return true
+}
+
+// matches returns true if c matches o, i.e. o binds all the values c binds to
+// the same values.
+func (c configName) matches(o configName) bool {
+	for i, v := range c {
+		if v.isBound() && v.compare(o[i]) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// reduceConfigs returns configs without the ones matched by another one, in
+// sorted order.
+func reduceConfigs(configs []configName) []configName {
+	out := make([]configName, 0, len(configs))
+	for i, config := range configs {
+		matched := false
+		for j, other := range configs {
+			if i != j && !other.Equals(config) && other.matches(config) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			out = append(out, config)
+		}
+	}
+	sort.Sort(configNames(out))
+	return out
+}
+
+// configNames sorts configName with bound values first.
+type configNames []configName
+
+func (c configNames) Len() int {
+	return len(c)
+}
+
+func (c configNames) Less(i, j int) bool {
+	return c[i].compare(c[j]) < 0
+}
+
+func (c configNames) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+// conditionString returns the condition matching configs, e.g.
+// 'OS=="linux" and asan==1 or OS=="mac"'.
+func conditionString(configVariables []string, configs []configName) string {
+	alternatives := make([]string, 0, len(configs))
+	for _, config := range configs {
+		var terms []string
+		for i, v := range config {
+			switch {
+			case v.I != nil:
+				terms = append(terms, fmt.Sprintf("%s==%d", configVariables[i], *v.I))
+			case v.S != nil:
+				terms = append(terms, fmt.Sprintf("%s==%s", configVariables[i], strconv.Quote(*v.S)))
+			}
+		}
+		alternatives = append(alternatives, strings.Join(terms, " and "))
+	}
+	return strings.Join(alternatives, " or ")
+}
+
+type conditionsByString []condition
+
+func (c conditionsByString) Len() int {
+	return len(c)
+}
+
+func (c conditionsByString) Less(i, j int) bool {
+	return c[i].Condition < c[j].Condition
+}
+
+func (c conditionsByString) Swap(i, j int) {
+	c[i], c[j] = c[j], c[i]
+}
+
+// prettyPrint returns the .isolate file, preceded by fileComment, in the
+// style of isolate_format.py's pretty_print.
+func (p *parsedIsolate) prettyPrint(fileComment []byte) []byte {
+	w := &bytes.Buffer{}
+	w.Write(fileComment)
+	w.WriteString("{\n")
+	if p.Variables != nil && !p.Variables.isEmpty() {
+		w.WriteString("  'variables': {\n")
+		p.Variables.prettyPrint(w, "    ")
+		w.WriteString("  },\n")
+	}
+	if len(p.Conditions) != 0 {
+		w.WriteString("  'conditions': [\n")
+		for _, cond := range p.Conditions {
+			fmt.Fprintf(w, "    [%s, {\n", quoteString(cond.Condition))
+			w.WriteString("      'variables': {\n")
+			cond.Variables.prettyPrint(w, "        ")
+			w.WriteString("      },\n")
+			w.WriteString("    }],\n")
+		}
+		w.WriteString("  ],\n")
+	}
+	prettyPrintList(w, "  ", "includes", p.Includes)
+	w.WriteString("}\n")
+	return w.Bytes()
+}
+
+func (v *variables) prettyPrint(w *bytes.Buffer, indent string) {
+	prettyPrintList(w, indent, "command", v.Command)
+	prettyPrintList(w, indent, "files", v.Files)
+	if v.ReadOnly != nil {
+		fmt.Fprintf(w, "%s'read_only': %d,\n", indent, *v.ReadOnly)
+	}
+	prettyPrintList(w, indent, "isolate_dependency_touched", v.Touched)
+}
+
+func prettyPrintList(w *bytes.Buffer, indent, key string, items []string) {
+	if len(items) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "%s'%s': [\n", indent, key)
+	for _, item := range items {
+		fmt.Fprintf(w, "%s  %s,\n", indent, quoteString(item))
+	}
+	fmt.Fprintf(w, "%s],\n", indent)
+}
+
+// quoteString returns s as a single quoted Python string.
+func quoteString(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return "'" + strings.Replace(s, "'", `\'`, -1) + "'"
+}
@@ -0,0 +1,154 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestFormatIsolate(t *testing.T) {
+	content := `# Copyright.
+# Second line.
+{
+	'includes': ['z.isolate', 'a.isolate'],
+	'conditions': [
+		['OS=="mac"', {'variables': {'files': ['b', 'a']}}],
+		['OS=="linux"', {'variables': {'command': ['run', 'it\'s'], 'read_only': 1}}],
+		['OS=="mac"', {'variables': {'files': ['c']}}],
+		['OS=="linux" or OS=="mac"', {'variables': {'files': ['d/']}}],
+	],
+	'variables': {'files': ['common', 'common']},
+}`
+	expected := `# Copyright.
+# Second line.
+{
+  'variables': {
+    'files': [
+      'common',
+    ],
+  },
+  'conditions': [
+    ['OS=="linux"', {
+      'variables': {
+        'command': [
+          'run',
+          'it\'s',
+        ],
+        'read_only': 1,
+      },
+    }],
+    ['OS=="linux" or OS=="mac"', {
+      'variables': {
+        'files': [
+          'd/',
+        ],
+      },
+    }],
+    ['OS=="mac"', {
+      'variables': {
+        'files': [
+          'a',
+          'b',
+          'c',
+        ],
+      },
+    }],
+  ],
+  'includes': [
+    'z.isolate',
+    'a.isolate',
+  ],
+}
+`
+	out, err := FormatIsolate("/s/swarming", []byte(content))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, string(out))
+
+	// Formatting is idempotent.
+	again, err := FormatIsolate("/s/swarming", out)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, string(again))
+}
+
+func TestMergeIsolate(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	files := map[string]string{
+		"base/base.isolate": `{
+			'variables': {'files': ['data/']},
+			'conditions': [
+				['OS=="win"', {'variables': {'files': ['win.dll'], 'read_only': 0}}],
+			],
+		}`,
+		"foo/foo.isolate": `{
+			'includes': ['../base/base.isolate'],
+			'conditions': [
+				['OS=="linux" and asan==1', {'variables': {'files': ['asan/']}}],
+				['OS=="linux" or OS=="win"', {'variables': {'command': ['foo']}}],
+			],
+		}`,
+	}
+	writeTree(t, td, files)
+	fooDir := filepath.Join(td, "foo")
+	content := []byte(files["foo/foo.isolate"])
+	expected := `{
+  'variables': {
+    'files': [
+      '../base/data/',
+    ],
+  },
+  'conditions': [
+    ['OS=="linux" and asan==1', {
+      'variables': {
+        'files': [
+          'asan/',
+        ],
+      },
+    }],
+    ['OS=="linux" or OS=="win"', {
+      'variables': {
+        'command': [
+          'foo',
+        ],
+      },
+    }],
+    ['OS=="win"', {
+      'variables': {
+        'files': [
+          '../base/win.dll',
+        ],
+        'read_only': 0,
+      },
+    }],
+  ],
+}
+`
+	out, err := MergeIsolate(fooDir, content)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, expected, string(out))
+
+	// The merged file yields the same configurations.
+	original, err := LoadIsolateAsConfig(fooDir, content, nil)
+	ut.AssertEqual(t, nil, err)
+	merged, err := LoadIsolateAsConfig(fooDir, out, nil)
+	ut.AssertEqual(t, nil, err)
+	expectedConfigs, err := original.Configurations()
+	ut.AssertEqual(t, nil, err)
+	actualConfigs, err := merged.Configurations()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, len(expectedConfigs), len(actualConfigs))
+	for i, c := range expectedConfigs {
+		// The isolate_dir may differ when only the include binds the files.
+		d, err := DiffConfigSettings(c.Settings, actualConfigs[i].Settings)
+		ut.AssertEqualIndex(t, i, nil, err)
+		ut.AssertEqualIndex(t, i, true, d.IsEmpty())
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+)
+
+// SavedStateVersion is the version of the <.isolated>.state file format.
+const SavedStateVersion = "1.0"
+
+// SavedFile is a file entry in SavedState.
+//
+// It is the .isolated entry plus the modification time used to skip hashing
+// unmodified files on the next run.
+type SavedFile struct {
+	isolateserver.File
+	Mtime int64 `json:"t,omitempty"`
+}
+
+// SavedState is the state saved in <.isolated>.state next to the .isolated
+// file.
+//
+// It mirrors isolate.py's SavedState so variables given on a previous run can
+// be omitted on later runs and files that didn't change are not hashed again.
+type SavedState struct {
+	Algo string `json:"algo"`
+	// ChildIsolatedFiles is the list of additional .isolated files generated
+	// alongside the main one, relative to the .isolated directory.
+	ChildIsolatedFiles []string          `json:"child_isolated_files"`
+	Command            []string          `json:"command"`
+	ConfigVariables    common.KeyValVars `json:"config_variables"`
+	ExtraVariables     common.KeyValVars `json:"extra_variables"`
+	// Files maps the path relative to RootDir using '/' to its entry.
+	Files map[string]SavedFile `json:"files"`
+	// IsolateFile is the .isolate file, relative to the .isolated directory and
+	// using '/' as path separator.
+	IsolateFile string `json:"isolate_file"`
+	// PathVariables are relative to the .isolated directory and use '/' as
+	// path separator, or absolute if they are on another volume.
+	PathVariables common.KeyValVars `json:"path_variables"`
+	// ReadOnly is the ReadOnlyValue of the tree, nil if not set.
+	ReadOnly *int `json:"read_only"`
+	// RelativeCwd is the directory to run the command from, relative to RootDir
+	// and using '/' as path separator. It is empty for RootDir itself.
+	RelativeCwd string `json:"relative_cwd,omitempty"`
+	// RootDir is the absolute native path all Files are relative to.
+	RootDir string `json:"root_dir"`
+	Version string `json:"version"`
+}
+
+// StatePath returns the path of the state file for an .isolated file.
+func StatePath(isolated string) string {
+	return isolated + ".state"
+}
+
+// NewSavedState returns an empty SavedState.
+func NewSavedState() *SavedState {
+	return &SavedState{
+		Algo:               "sha-1",
+		ChildIsolatedFiles: []string{},
+		ConfigVariables:    common.KeyValVars{},
+		ExtraVariables:     common.KeyValVars{},
+		Files:              map[string]SavedFile{},
+		PathVariables:      common.KeyValVars{},
+		Version:            SavedStateVersion,
+	}
+}
+
+// LoadSavedState loads the state saved for the .isolated file isolated.
+//
+// Returns an empty SavedState if no state was saved yet.
+func LoadSavedState(isolated string) (*SavedState, error) {
+	s := NewSavedState()
+	p := StatePath(isolated)
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return s, nil
+	}
+	if err := common.ReadJSONFile(p, s); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(s.Version, "1.") {
+		return nil, fmt.Errorf("unsupported saved state version %q in %s", s.Version, p)
+	}
+	// Make sure maps are usable even if the file had null entries.
+	if s.ConfigVariables == nil {
+		s.ConfigVariables = common.KeyValVars{}
+	}
+	if s.ExtraVariables == nil {
+		s.ExtraVariables = common.KeyValVars{}
+	}
+	if s.PathVariables == nil {
+		s.PathVariables = common.KeyValVars{}
+	}
+	if s.Files == nil {
+		s.Files = map[string]SavedFile{}
+	}
+	return s, nil
+}
+
+// Save writes the state next to the .isolated file isolated.
+func (s *SavedState) Save(isolated string) error {
+	return common.WriteJSONFile(StatePath(isolated), s)
+}
+
+// ApplyTo fills in opts the .isolate file and the variables saved from a
+// previous run. Values already present in opts take precedence.
+//
+// isolatedDir is the directory containing the .isolated file. The .isolate
+// file and the path variables are rebased on it, so they are absolute.
+func (s *SavedState) ApplyTo(opts *ArchiveOptions, isolatedDir string) {
+	if opts.Isolate == "" && s.IsolateFile != "" {
+		opts.Isolate = filepath.Join(isolatedDir, filepath.FromSlash(s.IsolateFile))
+	}
+	merge := func(dst, src common.KeyValVars) {
+		for k, v := range src {
+			if _, ok := dst[k]; !ok {
+				dst[k] = v
+			}
+		}
+	}
+	merge(opts.ConfigVariables, s.ConfigVariables)
+	merge(opts.ExtraVariables, s.ExtraVariables)
+	for k, v := range s.PathVariables {
+		if _, ok := opts.PathVariables[k]; !ok {
+			p := filepath.FromSlash(v)
+			if !filepath.IsAbs(p) {
+				p = filepath.Join(isolatedDir, p)
+			}
+			opts.PathVariables[k] = p
+		}
+	}
+}
+
+// primeLoader seeds loader with the digests of the files that were not
+// modified since the state was saved, so they are not hashed again.
+func (s *SavedState) primeLoader(loader *FileInfoLoader) {
+	for relPath, f := range s.Files {
+		if f.Digest == "" || f.Size == nil || f.Touched {
+			continue
+		}
+		p := filepath.Join(s.RootDir, filepath.FromSlash(relPath))
+		fi, err := os.Lstat(p)
+		if err != nil || fi.ModTime().Unix() != f.Mtime || fi.Size() != *f.Size {
+			continue
+		}
+		loader.prime(fi, string(f.Digest))
+	}
+}
@@ -0,0 +1,109 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolate
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/ut"
+)
+
+func TestSavedStateRoundTrip(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	isolated := filepath.Join(td, "foo.isolated")
+
+	// No state yet.
+	s, err := LoadSavedState(isolated)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, NewSavedState(), s)
+
+	s.IsolateFile = "../foo.isolate"
+	s.ConfigVariables["OS"] = "linux"
+	s.PathVariables["PRODUCT_DIR"] = "out/Release"
+	s.RootDir = td
+	size := int64(3)
+	s.Files["a/b"] = SavedFile{isolateserver.File{Digest: "0123456789012345678901234567890123456789", Size: &size}, 42}
+	ut.AssertEqual(t, nil, s.Save(isolated))
+
+	loaded, err := LoadSavedState(isolated)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, s, loaded)
+}
+
+func TestSavedStateApplyTo(t *testing.T) {
+	s := NewSavedState()
+	s.IsolateFile = "../foo.isolate"
+	s.ConfigVariables["OS"] = "linux"
+	s.ConfigVariables["asan"] = "1"
+	s.ExtraVariables["version"] = "42"
+
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.ConfigVariables["OS"] = "mac"
+	s.ApplyTo(&opts, "/src/out")
+	ut.AssertEqual(t, filepath.Join("/src", "foo.isolate"), opts.Isolate)
+	ut.AssertEqual(t, common.KeyValVars{"OS": "mac", "asan": "1"}, opts.ConfigVariables)
+	ut.AssertEqual(t, common.KeyValVars{"version": "42"}, opts.ExtraVariables)
+	ut.AssertEqual(t, common.KeyValVars{}, opts.PathVariables)
+
+	// Path variables are rebased on the .isolated directory.
+	s.PathVariables["PRODUCT_DIR"] = "Release"
+	s.PathVariables["SDK"] = filepath.Join(string(filepath.Separator), "sdk")
+	opts.PathVariables["DEPTH"] = ".."
+	s.ApplyTo(&opts, "/src/out")
+	ut.AssertEqual(t, common.KeyValVars{
+		"DEPTH":       "..",
+		"PRODUCT_DIR": filepath.Join("/src/out", "Release"),
+		"SDK":         filepath.Join(string(filepath.Separator), "sdk"),
+	}, opts.PathVariables)
+
+	// An explicit .isolate file is not overridden.
+	opts.Isolate = "bar.isolate"
+	s.ApplyTo(&opts, "/src/out")
+	ut.AssertEqual(t, "bar.isolate", opts.Isolate)
+}
+
+func TestSavedStatePathVariablesFromOtherCwd(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolate")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	td, err = filepath.EvalSymlinks(td)
+	ut.AssertEqual(t, nil, err)
+	writeTree(t, td, map[string]string{
+		"src/foo/foo.isolate": `{'variables': {'files': ['<(PRODUCT_DIR)/bin']}}`,
+		"src/out/Release/bin": "bin",
+	})
+	isolated := filepath.Join(td, "src", "out", "foo.isolated")
+	archive := func(cwd string, opts ArchiveOptions) map[string]string {
+		hashes, _, err := IsolateAndArchive(context.Background(), nil, []Tree{{Cwd: cwd, Opts: opts}}, "", "", DefaultConcurrency(), nil)
+		ut.AssertEqual(t, nil, err)
+		return hashes
+	}
+
+	opts := ArchiveOptions{}
+	opts.Init()
+	opts.Isolate = filepath.Join("src", "foo", "foo.isolate")
+	opts.Isolated = filepath.Join("src", "out", "foo.isolated")
+	opts.PathVariables["PRODUCT_DIR"] = filepath.Join("src", "out", "Release")
+	expected := archive(td, opts)
+	state, err := LoadSavedState(isolated)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, common.KeyValVars{"PRODUCT_DIR": "Release"}, state.PathVariables)
+
+	// The variables saved by the first run still resolve from another cwd.
+	opts = ArchiveOptions{}
+	opts.Init()
+	opts.Isolated = isolated
+	state.ApplyTo(&opts, filepath.Dir(isolated))
+	ut.AssertEqual(t, expected, archive(filepath.Join(td, "src", "foo"), opts))
+}
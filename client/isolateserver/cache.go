@@ -6,12 +6,16 @@ package isolateserver
 
 import (
 	"bytes"
+	"context"
 	"encoding/hex"
+	"fmt"
 	"hash"
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"sync"
+	"time"
 )
 
 // LocalCache is a cache of objects.
@@ -32,13 +36,15 @@ type LocalCache interface {
 	Evict(digest HexDigest)
 
 	// Read returns contents of the cached item.
-	Read(digest HexDigest) (io.ReadCloser, error)
+	Read(ctx context.Context, digest HexDigest) (io.ReadCloser, error)
 
 	// Write reads data from src and stores it in cache.
-	Write(digest HexDigest, src io.Reader) error
+	//
+	// It aborts when ctx is canceled.
+	Write(ctx context.Context, digest HexDigest, src io.Reader) error
 
 	// Hardlink ensures file at |dest| has same content as cached |digest|.
-	Hardlink(digest HexDigest, dest string, perm os.FileMode) error
+	Hardlink(ctx context.Context, digest HexDigest, dest string, perm os.FileMode) error
 }
 
 // HashFactory creates a new hash algo as needed.
@@ -93,10 +99,13 @@ func (m *memoryLocalCache) Evict(digest HexDigest) {
 	delete(m.data, digest)
 }
 
-func (m *memoryLocalCache) Read(digest HexDigest) (io.ReadCloser, error) {
+func (m *memoryLocalCache) Read(ctx context.Context, digest HexDigest) (io.ReadCloser, error) {
 	if !digest.Validate(m.algo) {
 		return nil, os.ErrInvalid
 	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	content, ok := m.data[digest]
@@ -106,33 +115,33 @@ func (m *memoryLocalCache) Read(digest HexDigest) (io.ReadCloser, error) {
 	return ioutil.NopCloser(bytes.NewBuffer(content)), nil
 }
 
-func (m *memoryLocalCache) Write(digest HexDigest, src io.Reader) error {
+func (m *memoryLocalCache) Write(ctx context.Context, digest HexDigest, src io.Reader) error {
 	if !digest.Validate(m.algo) {
 		return os.ErrInvalid
 	}
-	content, err := ioutil.ReadAll(src)
-	if err != nil {
+	// Hash while reading so the content is only processed once.
+	h := m.factory()
+	buf := &bytes.Buffer{}
+	if _, err := io.Copy(io.MultiWriter(buf, h), &ctxReader{ctx, src}); err != nil {
 		return err
 	}
-
-	// TODO(maruel): This check is not required. It is kept to ease development
-	// but should likely be removed in the near future since it is a waste of CPU.
-	algo := m.factory()
-	algo.Write(content)
-	if HexDigest(hex.EncodeToString(algo.Sum(nil))) != digest {
+	if HexDigest(hex.EncodeToString(h.Sum(nil))) != digest {
 		return os.ErrInvalid
 	}
 
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	m.data[digest] = content
+	m.data[digest] = buf.Bytes()
 	return nil
 }
 
-func (m *memoryLocalCache) Hardlink(digest HexDigest, dest string, perm os.FileMode) error {
+func (m *memoryLocalCache) Hardlink(ctx context.Context, digest HexDigest, dest string, perm os.FileMode) error {
 	if !digest.Validate(m.algo) {
 		return os.ErrInvalid
 	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m.lock.Lock()
 	content, ok := m.data[digest]
 	m.lock.Unlock()
@@ -141,3 +150,154 @@ func (m *memoryLocalCache) Hardlink(digest HexDigest, dest string, perm os.FileM
 	}
 	return ioutil.WriteFile(dest, content, perm)
 }
+
+// diskLocalCache implements LocalCache in a directory, one file per item.
+type diskLocalCache struct {
+	// Immutable.
+	dir     string
+	algo    hash.Hash
+	factory HashFactory
+}
+
+// MakeDiskCache creates a cache storing the items as files in dir.
+//
+// Items are streamed to disk, so their size is not limited by memory.
+func MakeDiskCache(dir string, algo HashFactory) (LocalCache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &diskLocalCache{dir: dir, algo: algo(), factory: algo}, nil
+}
+
+func (d *diskLocalCache) path(digest HexDigest) string {
+	return filepath.Join(d.dir, string(digest))
+}
+
+func (d *diskLocalCache) CachedSet() []HexDigest {
+	out := []HexDigest{}
+	names, err := ioutil.ReadDir(d.dir)
+	if err != nil {
+		return out
+	}
+	for _, n := range names {
+		if digest := HexDigest(n.Name()); digest.Validate(d.algo) {
+			out = append(out, digest)
+		}
+	}
+	return out
+}
+
+func (d *diskLocalCache) Touch(digest HexDigest, size int64) bool {
+	if !digest.Validate(d.algo) {
+		return false
+	}
+	info, err := os.Stat(d.path(digest))
+	if err != nil || (size >= 0 && info.Size() != size) {
+		return false
+	}
+	now := time.Now()
+	return os.Chtimes(d.path(digest), now, now) == nil
+}
+
+func (d *diskLocalCache) Evict(digest HexDigest) {
+	if digest.Validate(d.algo) {
+		_ = os.Remove(d.path(digest))
+		// Also remove the copies kept by Hardlink for other modes.
+		if copies, err := filepath.Glob(d.path(digest) + ".*"); err == nil {
+			for _, c := range copies {
+				_ = os.Remove(c)
+			}
+		}
+	}
+}
+
+func (d *diskLocalCache) Read(ctx context.Context, digest HexDigest) (io.ReadCloser, error) {
+	if !digest.Validate(d.algo) {
+		return nil, os.ErrInvalid
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return os.Open(d.path(digest))
+}
+
+// Write streams src to a temporary file, hashing it on the fly, and moves it
+// in place once its digest is verified.
+func (d *diskLocalCache) Write(ctx context.Context, digest HexDigest, src io.Reader) error {
+	if !digest.Validate(d.algo) {
+		return os.ErrInvalid
+	}
+	f, err := ioutil.TempFile(d.dir, "tmp")
+	if err != nil {
+		return err
+	}
+	h := d.factory()
+	_, err = io.Copy(io.MultiWriter(f, h), &ctxReader{ctx, src})
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err == nil && HexDigest(hex.EncodeToString(h.Sum(nil))) != digest {
+		err = os.ErrInvalid
+	}
+	if err == nil {
+		// Items are immutable.
+		if err = os.Chmod(f.Name(), 0444); err == nil {
+			err = os.Rename(f.Name(), d.path(digest))
+		}
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+	}
+	return err
+}
+
+// Hardlink links dest to the cached file when perm has no write bit, and
+// copies it otherwise so dest can be modified without corrupting the cache.
+//
+// Cached files are read-only with mode 0444. To link files with another
+// read-only mode, e.g. 0555 for executables, a copy of the item with that
+// mode is kept next to it.
+func (d *diskLocalCache) Hardlink(ctx context.Context, digest HexDigest, dest string, perm os.FileMode) error {
+	if !digest.Validate(d.algo) {
+		return os.ErrInvalid
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if perm&0222 == 0 {
+		if src, err := d.linkable(ctx, digest, perm); err == nil {
+			if err := os.Link(src, dest); err == nil {
+				return nil
+			}
+		}
+	}
+	return copyFromCache(ctx, d, digest, dest, perm)
+}
+
+// linkable returns the path of a file with the content of the item and mode
+// perm, creating it if needed.
+func (d *diskLocalCache) linkable(ctx context.Context, digest HexDigest, perm os.FileMode) (string, error) {
+	if perm == 0444 {
+		return d.path(digest), nil
+	}
+	p := fmt.Sprintf("%s.%o", d.path(digest), perm)
+	if _, err := os.Stat(p); err == nil {
+		return p, nil
+	}
+	f, err := ioutil.TempFile(d.dir, "tmp")
+	if err != nil {
+		return "", err
+	}
+	f.Close()
+	if err = copyFromCache(ctx, d, digest, f.Name(), perm); err == nil {
+		// The mode passed to OpenFile is masked by the umask.
+		if err = os.Chmod(f.Name(), perm); err == nil {
+			err = os.Rename(f.Name(), p)
+		}
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return p, nil
+}
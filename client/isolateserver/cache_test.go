@@ -6,8 +6,10 @@ package isolateserver
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -26,19 +28,19 @@ func TestMemoryCache(t *testing.T) {
 	ut.AssertEqual(t, []HexDigest{}, c.CachedSet())
 	ut.AssertEqual(t, false, c.Touch(d, 0))
 	c.Evict(d)
-	r, err := c.Read(d)
+	r, err := c.Read(context.Background(), d)
 	ut.AssertEqual(t, nil, r)
 	ut.AssertEqual(t, os.ErrNotExist, err)
 	empty := HexDigest(hex.EncodeToString(sha1.New().Sum(nil)))
-	ut.AssertEqual(t, nil, c.Write(empty, bytes.NewBufferString("")))
+	ut.AssertEqual(t, nil, c.Write(context.Background(), empty, bytes.NewBufferString("")))
 	content := []byte("foo")
 	h := sha1.New()
 	h.Write(content)
 	digest := HexDigest(hex.EncodeToString(h.Sum(nil)))
-	ut.AssertEqual(t, os.ErrInvalid, c.Write(empty, bytes.NewBuffer(content)))
-	ut.AssertEqual(t, nil, c.Write(digest, bytes.NewBuffer(content)))
+	ut.AssertEqual(t, os.ErrInvalid, c.Write(context.Background(), empty, bytes.NewBuffer(content)))
+	ut.AssertEqual(t, nil, c.Write(context.Background(), digest, bytes.NewBuffer(content)))
 
-	r, err = c.Read(digest)
+	r, err = c.Read(context.Background(), digest)
 	ut.AssertEqual(t, nil, err)
 	actual, err := ioutil.ReadAll(r)
 	ut.AssertEqual(t, nil, err)
@@ -48,8 +50,60 @@ func TestMemoryCache(t *testing.T) {
 	ut.AssertEqual(t, 2, len(c.CachedSet()))
 
 	dest := filepath.Join(td, "foo")
-	ut.AssertEqual(t, nil, c.Hardlink(digest, dest, os.FileMode(0600)))
+	ut.AssertEqual(t, nil, c.Hardlink(context.Background(), digest, dest, os.FileMode(0600)))
 	actual, err = ioutil.ReadFile(dest)
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, content, actual)
 }
+
+func TestMemoryCacheCanceled(t *testing.T) {
+	c := MakeMemoryCache(sha1.New)
+	content := []byte("foo")
+	digest := Hash(sha1.New(), content)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ut.AssertEqual(t, context.Canceled, c.Write(ctx, digest, bytes.NewBuffer(content)))
+	ut.AssertEqual(t, false, c.Touch(digest, int64(len(content))))
+}
+
+func TestDiskCacheHardlink(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+	c, err := MakeDiskCache(filepath.Join(td, "cache"), sha1.New)
+	ut.AssertEqual(t, nil, err)
+	ctx := context.Background()
+	content := []byte("foo")
+	digest := Hash(sha1.New(), content)
+	ut.AssertEqual(t, nil, c.Write(ctx, digest, bytes.NewBuffer(content)))
+	cached, err := os.Stat(filepath.Join(td, "cache", string(digest)))
+	ut.AssertEqual(t, nil, err)
+
+	// Read-only files are linked, writeable ones are copied.
+	for i, perm := range []os.FileMode{0444, 0555, 0555, 0644} {
+		dest := filepath.Join(td, fmt.Sprintf("out%d", i))
+		ut.AssertEqual(t, nil, c.Hardlink(ctx, digest, dest, perm))
+		info, err := os.Stat(dest)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqualIndex(t, i, perm, info.Mode().Perm())
+		ut.AssertEqualIndex(t, i, perm == 0444, os.SameFile(cached, info))
+		actual, err := ioutil.ReadFile(dest)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqualIndex(t, i, content, actual)
+	}
+	out1, err := os.Stat(filepath.Join(td, "out1"))
+	ut.AssertEqual(t, nil, err)
+	out2, err := os.Stat(filepath.Join(td, "out2"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, true, os.SameFile(out1, out2))
+	// The mode of the cached item is unchanged.
+	cached, err = os.Stat(filepath.Join(td, "cache", string(digest)))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, os.FileMode(0444), cached.Mode().Perm())
+	ut.AssertEqual(t, []HexDigest{digest}, c.CachedSet())
+
+	c.Evict(digest)
+	names, err := ioutil.ReadDir(filepath.Join(td, "cache"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(names))
+}
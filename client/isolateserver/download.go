@@ -0,0 +1,94 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// DownloadTree fetches the isolated tree digest into cache, with up to jobs
+// concurrent downloads, and maps it into outDir.
+//
+// progress, if not nil, receives the download counters. When it is a
+// *StatsRecorder, it is used to collect the returned Stats; set it as the
+// TransferOptions.Progress of client too so the bytes received are
+// accounted for. The Stats are returned even on failure.
+func DownloadTree(ctx context.Context, client IsolateServer, cache LocalCache, digest HexDigest, outDir string, jobs int,
+	progress Progress) (*Stats, error) {
+	stats, ok := progress.(*StatsRecorder)
+	if !ok {
+		stats = NewStatsRecorder(progress)
+	}
+	done := stats.Phase("fetch_isolated")
+	// Includes are resolved so entries in the .isolated take precedence over
+	// the ones in the included .isolated files.
+	isolated, err := FetchIsolated(ctx, client, digest)
+	done()
+	if err != nil {
+		return stats.Stats(), err
+	}
+	common.Infof("%s: %d files", digest, len(isolated.Files))
+	done = stats.Phase("download")
+	err = fetchAll(ctx, client, cache, isolated, jobs, stats)
+	done()
+	if err != nil {
+		return stats.Stats(), err
+	}
+	done = stats.Phase("map")
+	err = MapTree(ctx, cache, isolated, outDir)
+	done()
+	return stats.Stats(), err
+}
+
+// fetchAll fetches the files of isolated that are not in cache yet, with up
+// to jobs concurrent downloads.
+func fetchAll(ctx context.Context, client IsolateServer, cache LocalCache, isolated *Isolated, jobs int, progress Progress) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := common.NewSemaphore(jobs)
+	errs := make(chan error, len(isolated.Files)+1)
+	seen := map[HexDigest]bool{}
+	for path, f := range isolated.Files {
+		size := int64(-1)
+		if f.Size != nil {
+			size = *f.Size
+		}
+		if f.Link != nil || seen[f.Digest] {
+			continue
+		}
+		seen[f.Digest] = true
+		AddProgress(progress, ItemsToDownload, 1)
+		if cache.Touch(f.Digest, size) {
+			AddProgress(progress, ItemsPresent, 1)
+			continue
+		}
+		if err := sem.WaitContext(ctx); err != nil {
+			errs <- err
+			break
+		}
+		go func(path string, digest HexDigest, size int64) {
+			defer sem.Signal()
+			if err := FetchToCache(ctx, client, cache, digest); err != nil {
+				errs <- fmt.Errorf("failed to fetch %s: %s", path, err)
+				return
+			}
+			AddProgress(progress, ItemsDownloaded, 1)
+			if size >= 0 {
+				AddProgress(progress, BytesDownloaded, size)
+			}
+		}(path, f.Digest, size)
+	}
+	for i := 0; i < jobs; i++ {
+		if err := sem.Wait(); err != nil {
+			return err
+		}
+	}
+	close(errs)
+	return <-errs
+}
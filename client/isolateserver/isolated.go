@@ -0,0 +1,230 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// IsolatedFormatVersion is version of *.isolated file format. Put into JSON.
+const IsolatedFormatVersion = "1.4"
+
+// File describes a single file entry in an .isolated file.
+//
+// Exactly one of Digest or Link is set. Touched files are only expected to
+// exist: their content is ignored and they are mapped as empty files.
+type File struct {
+	Touched bool      `json:"T,omitempty"`
+	Digest  HexDigest `json:"h,omitempty"`
+	Link    *string   `json:"l,omitempty"`
+	Mode    *int      `json:"m,omitempty"`
+	Size    *int64    `json:"s,omitempty"`
+}
+
+// Isolated is the data of an .isolated file.
+//
+// Fields are sorted alphabetically so the JSON encoding is stable and matches
+// isolated_format.py.
+type Isolated struct {
+	Algo        string          `json:"algo"`
+	Command     []string        `json:"command,omitempty"`
+	Files       map[string]File `json:"files,omitempty"`
+	Includes    []HexDigest     `json:"includes,omitempty"`
+	ReadOnly    *int            `json:"read_only,omitempty"`
+	RelativeCwd string          `json:"relative_cwd,omitempty"`
+	Version     string          `json:"version"`
+}
+
+// NewIsolated returns an empty Isolated for the sha-1 namespace.
+func NewIsolated() *Isolated {
+	return &Isolated{
+		Algo:    "sha-1",
+		Files:   map[string]File{},
+		Version: IsolatedFormatVersion,
+	}
+}
+
+// Encode returns the canonical JSON encoding of the .isolated file.
+//
+// The digest of the .isolated is calculated over these bytes.
+func (i *Isolated) Encode() ([]byte, error) {
+	return json.Marshal(i)
+}
+
+// DecodeIsolated reads and validates an .isolated file.
+func DecodeIsolated(r io.Reader) (*Isolated, error) {
+	i := &Isolated{}
+	if err := json.NewDecoder(r).Decode(i); err != nil {
+		return nil, fmt.Errorf("failed to decode .isolated: %s", err)
+	}
+	if i.Version == "" || i.Version[0] != IsolatedFormatVersion[0] {
+		return nil, fmt.Errorf("unsupported .isolated version %q", i.Version)
+	}
+	for path, f := range i.Files {
+		if (f.Digest == "") == (f.Link == nil) {
+			return nil, fmt.Errorf("file %s must have exactly one of digest or link", path)
+		}
+	}
+	return i, nil
+}
+
+// SplitIsolated splits the files of isolated in multiple .isolated files.
+//
+// When byDir is true, files are grouped by their top level directory. When
+// maxFiles is not 0, each group is cut in chunks of at most maxFiles files.
+// Files at the root of the tree stay in the returned root .isolated, along
+// with the command, read_only and relative_cwd; the other groups become
+// children referenced through the root's Includes.
+//
+// This permits subtrees shared by multiple targets, like toolchains, to be
+// uploaded and cached once.
+func SplitIsolated(isolated *Isolated, byDir bool, maxFiles int) (*Isolated, []*Isolated, error) {
+	root := &Isolated{
+		Algo:        isolated.Algo,
+		Command:     isolated.Command,
+		Files:       map[string]File{},
+		Includes:    append([]HexDigest{}, isolated.Includes...),
+		ReadOnly:    isolated.ReadOnly,
+		RelativeCwd: isolated.RelativeCwd,
+		Version:     isolated.Version,
+	}
+	paths := make([]string, 0, len(isolated.Files))
+	for p := range isolated.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+
+	// Group the files, keeping the groups in a stable order.
+	var groups [][]string
+	var rootFiles []string
+	index := map[string]int{}
+	for _, p := range paths {
+		key := ""
+		if byDir {
+			i := strings.IndexByte(p, '/')
+			if i == -1 {
+				rootFiles = append(rootFiles, p)
+				continue
+			}
+			key = p[:i]
+		}
+		i, ok := index[key]
+		if !ok {
+			i = len(groups)
+			index[key] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], p)
+	}
+	if maxFiles > 0 {
+		var chunks [][]string
+		for _, g := range groups {
+			for len(g) > maxFiles {
+				chunks = append(chunks, g[:maxFiles])
+				g = g[maxFiles:]
+			}
+			chunks = append(chunks, g)
+		}
+		groups = chunks
+	}
+	for _, p := range rootFiles {
+		root.Files[p] = isolated.Files[p]
+	}
+
+	children := make([]*Isolated, 0, len(groups))
+	for _, g := range groups {
+		child := &Isolated{Algo: isolated.Algo, Files: map[string]File{}, Version: isolated.Version}
+		for _, p := range g {
+			child.Files[p] = isolated.Files[p]
+		}
+		data, err := child.Encode()
+		if err != nil {
+			return nil, nil, err
+		}
+		h, err := (&Namespace{DigestAlgo: isolated.Algo}).GetHashAlgo()
+		if err != nil {
+			return nil, nil, err
+		}
+		children = append(children, child)
+		root.Includes = append(root.Includes, Hash(h, data))
+	}
+	return root, children, nil
+}
+
+// ResolveIncludes returns a flattened copy of isolated with the content of its
+// includes, recursively, loaded with load.
+//
+// Entries defined in an .isolated take precedence over the ones in its
+// includes, and earlier includes take precedence over later ones. This applies
+// to files, command, read_only and relative_cwd.
+func ResolveIncludes(isolated *Isolated, load func(HexDigest) (*Isolated, error)) (*Isolated, error) {
+	out := &Isolated{Algo: isolated.Algo, Files: map[string]File{}, Version: isolated.Version}
+	seen := map[HexDigest]bool{}
+	var walk func(i *Isolated) error
+	walk = func(i *Isolated) error {
+		if out.Command == nil && len(i.Command) != 0 {
+			out.Command = i.Command
+			// relative_cwd only makes sense along with the command.
+			out.RelativeCwd = i.RelativeCwd
+		}
+		if out.ReadOnly == nil {
+			out.ReadOnly = i.ReadOnly
+		}
+		for p, f := range i.Files {
+			if _, ok := out.Files[p]; !ok {
+				out.Files[p] = f
+			}
+		}
+		for _, digest := range i.Includes {
+			if seen[digest] {
+				continue
+			}
+			seen[digest] = true
+			child, err := load(digest)
+			if err != nil {
+				return fmt.Errorf("failed to load included %s: %s", digest, err)
+			}
+			if child.Algo != isolated.Algo {
+				return fmt.Errorf("included %s uses %s instead of %s", digest, child.Algo, isolated.Algo)
+			}
+			if err := walk(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := walk(isolated); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// FetchIsolated fetches an .isolated file and its includes and returns the
+// flattened tree as per ResolveIncludes.
+func FetchIsolated(ctx context.Context, client IsolateServer, digest HexDigest) (*Isolated, error) {
+	fetch := func(d HexDigest) (*Isolated, error) {
+		buf := &bytes.Buffer{}
+		if err := client.Fetch(ctx, d, buf); err != nil {
+			return nil, err
+		}
+		h := sha1.New()
+		if Hash(h, buf.Bytes()) != d {
+			return nil, fmt.Errorf("digest mismatch for %s", d)
+		}
+		return DecodeIsolated(buf)
+	}
+	root, err := fetch(digest)
+	if err != nil {
+		return nil, err
+	}
+	return ResolveIncludes(root, fetch)
+}
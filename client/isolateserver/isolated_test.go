@@ -0,0 +1,118 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func TestIsolatedEncode(t *testing.T) {
+	t.Parallel()
+	i := NewIsolated()
+	mode := 0640
+	size := int64(3)
+	i.Command = []string{"python", "foo.py"}
+	i.Files["foo.py"] = File{Digest: "0123456789012345678901234567890123456789", Mode: &mode, Size: &size}
+	data, err := i.Encode()
+	ut.AssertEqual(t, nil, err)
+	expected := `{"algo":"sha-1","command":["python","foo.py"],"files":{"foo.py":{"h":"0123456789012345678901234567890123456789","m":416,"s":3}},"version":"1.4"}`
+	ut.AssertEqual(t, expected, string(data))
+
+	decoded, err := DecodeIsolated(bytes.NewBuffer(data))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i, decoded)
+}
+
+func TestDecodeIsolatedInvalid(t *testing.T) {
+	t.Parallel()
+	invalid := []string{
+		`{"algo":"sha-1"}`,
+		`{"algo":"sha-1","version":"2.0"}`,
+		`{"algo":"sha-1","files":{"a":{}},"version":"1.4"}`,
+		`not json`,
+	}
+	for i, in := range invalid {
+		_, err := DecodeIsolated(bytes.NewBufferString(in))
+		ut.AssertEqualIndex(t, i, true, err != nil)
+	}
+}
+
+func TestSplitAndResolveIncludes(t *testing.T) {
+	t.Parallel()
+	i := NewIsolated()
+	i.Command = []string{"a.py"}
+	paths := []string{"a.py", "toolchain/bin/cc", "toolchain/lib/libc", "data/1", "data/2", "data/3"}
+	for _, p := range paths {
+		i.Files[p] = File{Digest: Hash(sha1.New(), []byte(p))}
+	}
+
+	root, children, err := SplitIsolated(i, true, 2)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"a.py"}, root.Command)
+	ut.AssertEqual(t, map[string]File{"a.py": i.Files["a.py"]}, root.Files)
+	// data is cut in 2 chunks.
+	ut.AssertEqual(t, 3, len(children))
+	ut.AssertEqual(t, 3, len(root.Includes))
+	ut.AssertEqual(t, 2, len(children[0].Files))
+	ut.AssertEqual(t, 1, len(children[1].Files))
+	ut.AssertEqual(t, 2, len(children[2].Files))
+
+	byDigest := map[HexDigest]*Isolated{}
+	for _, c := range children {
+		data, err := c.Encode()
+		ut.AssertEqual(t, nil, err)
+		byDigest[Hash(sha1.New(), data)] = c
+	}
+	load := func(d HexDigest) (*Isolated, error) {
+		return byDigest[d], nil
+	}
+	resolved, err := ResolveIncludes(root, load)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, i, resolved)
+}
+
+func TestResolveIncludesPrecedence(t *testing.T) {
+	t.Parallel()
+	one, two := 1, 2
+	first := NewIsolated()
+	first.Files["a"] = File{Digest: "1111111111111111111111111111111111111111"}
+	first.Files["b"] = File{Digest: "1111111111111111111111111111111111111111"}
+	first.ReadOnly = &two
+	second := NewIsolated()
+	second.Command = []string{"second"}
+	second.RelativeCwd = "foo"
+	second.Files["b"] = File{Digest: "2222222222222222222222222222222222222222"}
+	second.Files["c"] = File{Digest: "2222222222222222222222222222222222222222"}
+	root := NewIsolated()
+	root.Files["a"] = File{Digest: "0000000000000000000000000000000000000000"}
+	root.ReadOnly = nil
+	root.Includes = []HexDigest{"first", "second"}
+	load := func(d HexDigest) (*Isolated, error) {
+		if d == "first" {
+			return first, nil
+		}
+		return second, nil
+	}
+	resolved, err := ResolveIncludes(root, load)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"second"}, resolved.Command)
+	ut.AssertEqual(t, "foo", resolved.RelativeCwd)
+	ut.AssertEqual(t, &two, resolved.ReadOnly)
+	expected := map[string]File{
+		"a": root.Files["a"],
+		"b": first.Files["b"],
+		"c": second.Files["c"],
+	}
+	ut.AssertEqual(t, expected, resolved.Files)
+
+	root.ReadOnly = &one
+	resolved, err = ResolveIncludes(root, load)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, &one, resolved.ReadOnly)
+}
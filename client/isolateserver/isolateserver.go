@@ -5,16 +5,39 @@
 package isolateserver
 
 import (
+	"bytes"
+	"compress/zlib"
+	"context"
 	"crypto/sha1"
 	"fmt"
 	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
 
 	"github.com/luci/luci-go/client/internal/common"
 )
 
 // IsolateServer is the client interface to interact with an Isolate server.
+//
+// All the calls are aborted when ctx is canceled.
 type IsolateServer interface {
-	ServerCapabilities() (*ServerCapabilities, error)
+	ServerCapabilities(ctx context.Context) (*ServerCapabilities, error)
+	// Contains looks up cache presence on the server of multiple items.
+	//
+	// The returned list is in the same order as 'items', with entries nil for
+	// items that were present.
+	Contains(ctx context.Context, items []*DigestItem) ([]*PushState, error)
+	// Push uploads the content of an item that was reported missing by
+	// Contains.
+	//
+	// src must return the uncompressed content; it is compressed as needed by
+	// the namespace while being uploaded.
+	Push(ctx context.Context, state *PushState, src Source) error
+	// Fetch downloads an item and writes its uncompressed content to dest.
+	Fetch(ctx context.Context, digest HexDigest, dest io.Writer) error
 }
 
 // ServerCapabilities is the server details as exposed by the server.
@@ -39,10 +62,47 @@ func (n *Namespace) GetHashAlgo() (hash.Hash, error) {
 	}
 }
 
+// CompressionForNamespace returns the compression used by convention by a
+// namespace, i.e. "flate" for namespaces ending with "-gzip" or "-deflate".
+func CompressionForNamespace(namespace string) string {
+	if strings.HasSuffix(namespace, "-gzip") || strings.HasSuffix(namespace, "-deflate") {
+		return "flate"
+	}
+	return ""
+}
+
+// DigestItem is an item to look up on the server.
+type DigestItem struct {
+	Digest     HexDigest `json:"digest"`
+	IsIsolated bool      `json:"is_isolated"`
+	Size       int64     `json:"size"`
+}
+
+// PushState is the state of an item that must be uploaded, as returned by
+// Contains.
+type PushState struct {
+	status    preuploadStatus
+	size      int64
+	uploaded  bool
+	finalized bool
+}
+
 // New returns a new IsolateServer client.
-func New(url, namespace, digestAlgo, compression string) IsolateServer {
+//
+// c is used for the requests to the server; it is http.DefaultClient if nil.
+// The signed Google Storage URLs returned by the server are accessed without
+// credentials.
+func New(c *http.Client, url, namespace, digestAlgo, compression string) IsolateServer {
+	return NewWithOptions(c, url, namespace, digestAlgo, compression, DefaultTransferOptions())
+}
+
+// NewWithOptions is New with explicit bounds on concurrency and memory.
+func NewWithOptions(c *http.Client, url, namespace, digestAlgo, compression string, opts TransferOptions) IsolateServer {
 	return &isolateServer{
-		url: url,
+		client:     c,
+		url:        url,
+		compressor: newCompressor(opts),
+		progress:   opts.Progress,
 		namespace: Namespace{
 			Namespace:   namespace,
 			DigestAlgo:  digestAlgo,
@@ -53,16 +113,257 @@ func New(url, namespace, digestAlgo, compression string) IsolateServer {
 
 // Private details.
 
+type preuploadStatus struct {
+	GSUploadURL  string `json:"gs_upload_url"`
+	Index        Int    `json:"index"`
+	UploadTicket string `json:"upload_ticket"`
+}
+
 type isolateServer struct {
-	url       string
-	namespace Namespace
+	client     *http.Client
+	url        string
+	namespace  Namespace
+	compressor *compressor
+	progress   Progress
+}
+
+// postJSON calls an endpoint of the isolate server API. All the endpoints used
+// are idempotent so they are retried on transient errors.
+func (i *isolateServer) postJSON(ctx context.Context, resource string, in, out interface{}) error {
+	_, err := common.PostJSONWithRetry(ctx, i.client, common.DefaultRetryPolicy, i.url+"/_ah/api/isolateservice/v1"+resource, in, out)
+	return err
 }
 
-func (i *isolateServer) ServerCapabilities() (*ServerCapabilities, error) {
-	url := i.url + "/_ah/api/isolateservice/v1/server_details"
+func (i *isolateServer) ServerCapabilities(ctx context.Context) (*ServerCapabilities, error) {
 	out := &ServerCapabilities{}
-	if _, err := common.PostJSON(nil, url, nil, out); err != nil {
+	if err := i.postJSON(ctx, "/server_details", nil, out); err != nil {
 		return nil, err
 	}
 	return out, nil
 }
+
+func (i *isolateServer) Contains(ctx context.Context, items []*DigestItem) ([]*PushState, error) {
+	in := &struct {
+		Items     []*DigestItem `json:"items"`
+		Namespace *Namespace    `json:"namespace"`
+	}{items, &i.namespace}
+	data := &struct {
+		Items []preuploadStatus `json:"items"`
+	}{}
+	if err := i.postJSON(ctx, "/preupload", in, data); err != nil {
+		return nil, err
+	}
+	out := make([]*PushState, len(items))
+	for _, e := range data.Items {
+		index := int(e.Index)
+		if index < 0 || index >= len(items) {
+			return nil, fmt.Errorf("invalid index %d in preupload response", index)
+		}
+		out[index] = &PushState{status: e, size: items[index].Size}
+	}
+	return out, nil
+}
+
+func (i *isolateServer) Push(ctx context.Context, state *PushState, src Source) error {
+	// This push operation may be a retry after failed finalization call below,
+	// no need to reupload contents in that case.
+	if !state.uploaded {
+		var err error
+		if state.status.GSUploadURL == "" {
+			err = i.doPushDB(ctx, state, src)
+		} else {
+			err = i.doPushGCS(ctx, state, src)
+		}
+		if err != nil {
+			return err
+		}
+		state.uploaded = true
+	}
+	// Only Google Storage uploads need to be finalized.
+	if state.status.GSUploadURL != "" && !state.finalized {
+		in := &struct {
+			UploadTicket string `json:"upload_ticket"`
+		}{state.status.UploadTicket}
+		if err := i.postJSON(ctx, "/finalize_gs_upload", in, nil); err != nil {
+			return err
+		}
+		state.finalized = true
+	}
+	return nil
+}
+
+// open returns a reader of the content of src, compressed if the namespace
+// requires it, and its length, or -1 if it is not known in advance.
+func (i *isolateServer) open(ctx context.Context, state *PushState, src Source) (io.ReadCloser, int64, error) {
+	r, err := src()
+	if err != nil {
+		return nil, 0, err
+	}
+	if i.namespace.Compression == "" {
+		return r, state.size, nil
+	}
+	c, err := i.compressor.compress(ctx, i.namespace.Compression, r)
+	if err != nil {
+		r.Close()
+		return nil, 0, err
+	}
+	return &closeBoth{c, r}, -1, nil
+}
+
+// closeBoth is the reader of a compressed stream that also closes its source.
+type closeBoth struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (c *closeBoth) Close() error {
+	err := c.ReadCloser.Close()
+	if err2 := c.src.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// doPushDB stores small content inline in the datastore. The server only
+// requests it for items small enough to be buffered.
+func (i *isolateServer) doPushDB(ctx context.Context, state *PushState, src Source) error {
+	r, _, err := i.open(ctx, state, src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	in := &struct {
+		Content      []byte `json:"content"`
+		UploadTicket string `json:"upload_ticket"`
+	}{content, state.status.UploadTicket}
+	if err := i.postJSON(ctx, "/store_inline", in, nil); err != nil {
+		return err
+	}
+	AddProgress(i.progress, BytesSent, int64(len(content)))
+	return nil
+}
+
+// doPushGCS streams the content to the signed Google Storage URL returned by
+// the server. The upload is retried from the start on transient errors.
+func (i *isolateServer) doPushGCS(ctx context.Context, state *PushState, src Source) error {
+	url := state.status.GSUploadURL
+	return common.DefaultRetryPolicy.Do(ctx, "PUT "+url, func() error {
+		body, length, err := i.open(ctx, state, src)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		counter := &countingReader{r: body}
+		req, err := http.NewRequestWithContext(ctx, "PUT", url, ioutil.NopCloser(counter))
+		if err != nil {
+			return err
+		}
+		req.ContentLength = length
+		req.Header.Set("Content-Type", "application/octet-stream")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &common.RetriableError{Err: fmt.Errorf("couldn't upload to %s: %s", url, err)}
+		}
+		defer resp.Body.Close()
+		if _, err := io.Copy(ioutil.Discard, resp.Body); err != nil {
+			return err
+		}
+		if resp.StatusCode >= 400 {
+			err := fmt.Errorf("http status %d while uploading to %s", resp.StatusCode, url)
+			if common.IsRetriableStatus(resp.StatusCode) {
+				return &common.RetriableError{Err: err, RetryAfter: common.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+			}
+			return err
+		}
+		AddProgress(i.progress, BytesSent, counter.n)
+		return nil
+	})
+}
+
+// getGCS starts the download of content stored in Google Storage, retrying on
+// transient errors. The caller must close the returned body.
+func getGCS(ctx context.Context, url string) (io.ReadCloser, error) {
+	var body io.ReadCloser
+	err := common.DefaultRetryPolicy.Do(ctx, "GET "+url, func() error {
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return &common.RetriableError{Err: fmt.Errorf("couldn't fetch %s: %s", url, err)}
+		}
+		if resp.StatusCode >= 400 {
+			resp.Body.Close()
+			err := fmt.Errorf("http status %d while fetching %s", resp.StatusCode, url)
+			if common.IsRetriableStatus(resp.StatusCode) {
+				return &common.RetriableError{Err: err, RetryAfter: common.ParseRetryAfter(resp.Header.Get("Retry-After"), time.Now())}
+			}
+			return err
+		}
+		body = resp.Body
+		return nil
+	})
+	return body, err
+}
+
+func (i *isolateServer) Fetch(ctx context.Context, digest HexDigest, dest io.Writer) error {
+	in := &struct {
+		Digest    HexDigest  `json:"digest"`
+		Namespace *Namespace `json:"namespace"`
+		Offset    int64      `json:"offset"`
+	}{digest, &i.namespace, 0}
+	out := &struct {
+		Content []byte `json:"content"`
+		URL     string `json:"url"`
+	}{}
+	if err := i.postJSON(ctx, "/retrieve", in, out); err != nil {
+		return err
+	}
+	var src io.Reader = bytes.NewReader(out.Content)
+	if out.URL != "" {
+		// The content is stored in Google Storage.
+		body, err := getGCS(ctx, out.URL)
+		if err != nil {
+			return err
+		}
+		defer body.Close()
+		src = body
+	}
+	counter := &countingReader{r: src}
+	if err := i.decompress(&ctxReader{ctx, counter}, dest); err != nil {
+		return err
+	}
+	AddProgress(i.progress, BytesReceived, counter.n)
+	return nil
+}
+
+// decompress copies src to dest, decompressing it if the namespace requires
+// it.
+func (i *isolateServer) decompress(src io.Reader, dest io.Writer) error {
+	switch i.namespace.Compression {
+	case "":
+		_, err := io.Copy(dest, src)
+		return err
+	case "flate":
+		r, err := zlib.NewReader(src)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		_, err = io.Copy(dest, r)
+		return err
+	default:
+		return fmt.Errorf("unknown compression \"%s\"", i.namespace.Compression)
+	}
+}
@@ -5,11 +5,16 @@
 package isolateserver
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha1"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 
@@ -37,9 +42,14 @@ func handleJSON(t *testing.T, mux *http.ServeMux, path string, handler jsonAPI)
 	mux.Handle(path, handlerJSON(t, handler))
 }
 
+// gsThreshold is the size from which the fake server requests uploads to
+// Google Storage.
+const gsThreshold = 1024
+
 type isolateServerFake struct {
 	lock     sync.Mutex
 	contents map[HexDigest][]byte
+	setURL   func(url string)
 }
 
 func newIsolateServerFake(t *testing.T) (http.Handler, *isolateServerFake) {
@@ -55,6 +65,72 @@ func newIsolateServerFake(t *testing.T) (http.Handler, *isolateServerFake) {
 		return &ServerCapabilities{"v1"}
 	})
 
+	// Items of at least gsThreshold bytes are uploaded to the fake Google
+	// Storage, the others are stored inline.
+	var url string
+	handleJSON(t, mux, "/_ah/api/isolateservice/v1/preupload", func(body io.Reader) interface{} {
+		in := &struct {
+			Items []*DigestItem `json:"items"`
+		}{}
+		ut.AssertEqual(t, nil, json.NewDecoder(body).Decode(in))
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		out := &struct {
+			Items []preuploadStatus `json:"items"`
+		}{}
+		for i, item := range in.Items {
+			if _, ok := server.contents[item.Digest]; ok {
+				continue
+			}
+			status := preuploadStatus{Index: Int(i), UploadTicket: string(item.Digest)}
+			if item.Size >= gsThreshold {
+				status.GSUploadURL = url + "/fake/gs/" + string(item.Digest)
+			}
+			out.Items = append(out.Items, status)
+		}
+		return out
+	})
+	handleJSON(t, mux, "/_ah/api/isolateservice/v1/store_inline", func(body io.Reader) interface{} {
+		in := &struct {
+			Content      []byte `json:"content"`
+			UploadTicket string `json:"upload_ticket"`
+		}{}
+		ut.AssertEqual(t, nil, json.NewDecoder(body).Decode(in))
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		server.contents[HexDigest(in.UploadTicket)] = in.Content
+		return map[string]string{}
+	})
+	handleJSON(t, mux, "/_ah/api/isolateservice/v1/finalize_gs_upload", func(body io.Reader) interface{} {
+		return map[string]string{}
+	})
+	handleJSON(t, mux, "/_ah/api/isolateservice/v1/retrieve", func(body io.Reader) interface{} {
+		in := &struct {
+			Digest HexDigest `json:"digest"`
+		}{}
+		ut.AssertEqual(t, nil, json.NewDecoder(body).Decode(in))
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		content := server.contents[in.Digest]
+		if len(content) >= gsThreshold {
+			return map[string]string{"url": url + "/fake/gs/" + string(in.Digest)}
+		}
+		return map[string][]byte{"content": content}
+	})
+	mux.HandleFunc("/fake/gs/", func(w http.ResponseWriter, req *http.Request) {
+		digest := HexDigest(req.URL.Path[len("/fake/gs/"):])
+		server.lock.Lock()
+		defer server.lock.Unlock()
+		if req.Method == "PUT" {
+			content, err := ioutil.ReadAll(req.Body)
+			ut.AssertEqual(t, nil, err)
+			server.contents[digest] = content
+			return
+		}
+		_, _ = w.Write(server.contents[digest])
+	})
+	server.setURL = func(u string) { url = u }
+
 	// Fail on anything else.
 	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
 		t.Fatal()
@@ -66,8 +142,112 @@ func TestIsolateServerCaps(t *testing.T) {
 	mux, _ := newIsolateServerFake(t)
 	ts := httptest.NewServer(mux)
 	defer ts.Close()
-	client := New(ts.URL, "default", "sha-1", "flate")
-	caps, err := client.ServerCapabilities()
+	client := New(nil, ts.URL, "default", "sha-1", "flate")
+	caps, err := client.ServerCapabilities(context.Background())
 	ut.AssertEqual(t, nil, err)
 	ut.AssertEqual(t, &ServerCapabilities{"v1"}, caps)
 }
+
+func TestIsolateServerPushFetch(t *testing.T) {
+	mux, server := newIsolateServerFake(t)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	server.setURL(ts.URL)
+	opts := DefaultTransferOptions()
+	// Use tiny chunks to exercise the backpressure between the stages.
+	opts.ChunkSize = 7
+	opts.BufferedChunks = 2
+	client := NewWithOptions(nil, ts.URL, "default-gzip", "sha-1", "flate", opts)
+	ctx := context.Background()
+
+	small := []byte("small")
+	large := bytes.Repeat([]byte("large content "), 1000)
+	items := []*DigestItem{
+		{Digest: Hash(sha1.New(), small), Size: int64(len(small))},
+		{Digest: Hash(sha1.New(), large), Size: int64(len(large))},
+	}
+	states, err := client.Contains(ctx, items)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(states))
+	for i, content := range [][]byte{small, large} {
+		content := content
+		src := func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(content)), nil
+		}
+		ut.AssertEqual(t, nil, client.Push(ctx, states[i], src))
+	}
+	states, err = client.Contains(ctx, items)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []*PushState{nil, nil}, states)
+
+	for i, content := range [][]byte{small, large} {
+		buf := &bytes.Buffer{}
+		ut.AssertEqual(t, nil, client.Fetch(ctx, items[i].Digest, buf))
+		ut.AssertEqual(t, content, buf.Bytes())
+	}
+
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	cache, err := MakeDiskCache(td, sha1.New)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, nil, FetchToCache(ctx, client, cache, items[1].Digest))
+	ut.AssertEqual(t, true, cache.Touch(items[1].Digest, int64(len(large))))
+	ut.AssertEqual(t, []HexDigest{items[1].Digest}, cache.CachedSet())
+}
+
+func TestDownloadTree(t *testing.T) {
+	mux, server := newIsolateServerFake(t)
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+	server.setURL(ts.URL)
+	ctx := context.Background()
+
+	content := bytes.Repeat([]byte("content "), 1000)
+	digest := Hash(sha1.New(), content)
+	isolated := NewIsolated()
+	size := int64(len(content))
+	isolated.Files["a"] = File{Digest: digest, Size: &size}
+	isolated.Files["b"] = File{Digest: digest, Size: &size}
+	data, err := isolated.Encode()
+	ut.AssertEqual(t, nil, err)
+	isolatedDigest := Hash(sha1.New(), data)
+
+	stats := NewStatsRecorder(nil)
+	opts := DefaultTransferOptions()
+	opts.Progress = stats
+	client := NewWithOptions(nil, ts.URL, "default-gzip", "sha-1", "flate", opts)
+	items := []*DigestItem{{Digest: digest, Size: size}, {Digest: isolatedDigest, IsIsolated: true, Size: int64(len(data))}}
+	states, err := client.Contains(ctx, items)
+	ut.AssertEqual(t, nil, err)
+	for i, c := range [][]byte{content, data} {
+		c := c
+		src := func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(c)), nil
+		}
+		ut.AssertEqual(t, nil, client.Push(ctx, states[i], src))
+	}
+
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer os.RemoveAll(td)
+	cache, err := MakeDiskCache(filepath.Join(td, "cache"), sha1.New)
+	ut.AssertEqual(t, nil, err)
+	out, err := DownloadTree(ctx, client, cache, isolatedDigest, filepath.Join(td, "out"), 2, stats)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(1), out.ItemsToDownload)
+	ut.AssertEqual(t, int64(1), out.ItemsDownloaded)
+	ut.AssertEqual(t, size, out.BytesDownloaded)
+	ut.AssertEqual(t, true, out.CompressionRatio < 1)
+	for _, name := range []string{"a", "b"} {
+		actual, err := ioutil.ReadFile(filepath.Join(td, "out", name))
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, content, actual)
+	}
+
+	// Everything is in the cache now.
+	out, err = DownloadTree(ctx, client, cache, isolatedDigest, filepath.Join(td, "out2"), 2, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(1), out.ItemsPresent)
+	ut.AssertEqual(t, int64(0), out.ItemsDownloaded)
+}
@@ -0,0 +1,262 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// AccessProfile lists the files of a tree that were used, as recorded by a
+// LazyTree. It can be used to prefetch them, or to trim later archives.
+type AccessProfile struct {
+	Files []string `json:"files"`
+}
+
+// ReadAccessProfile reads an AccessProfile from a JSON file.
+func ReadAccessProfile(filePath string) (*AccessProfile, error) {
+	p := &AccessProfile{}
+	if err := common.ReadJSONFile(filePath, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WriteAccessProfile writes an AccessProfile as a JSON file.
+func WriteAccessProfile(filePath string, p *AccessProfile) error {
+	return common.WriteJSONFile(filePath, p)
+}
+
+// LazyTree maps the files of an isolated tree on demand, fetching them when
+// first requested instead of downloading the whole tree upfront.
+//
+// It doesn't need FUSE: files must be requested with Fetch, or by a process
+// connected to Serve with RequestFile, before they are opened. Every request
+// is recorded, so the files actually used are known even if they were
+// prefetched.
+//
+// Directories are left writeable so files can be added to them.
+type LazyTree struct {
+	client   IsolateServer
+	cache    LocalCache
+	isolated *Isolated
+	outDir   string
+	progress Progress
+	readOnly int
+
+	// entries is immutable once created; each entry synchronizes itself.
+	entries map[string]*lazyEntry
+
+	lock     sync.Mutex
+	accessed map[string]bool
+}
+
+type lazyEntry struct {
+	file File
+
+	// done is set once the file is mapped. A failed attempt leaves it unset so
+	// the next caller retries with its own context.
+	lock sync.Mutex
+	done bool
+}
+
+// NewLazyTree fetches the isolated tree digest and returns a LazyTree mapping
+// its files into outDir, fetching them into cache as needed. Nothing is
+// written to outDir yet.
+//
+// progress, if not nil, receives the download counters.
+func NewLazyTree(ctx context.Context, client IsolateServer, cache LocalCache, digest HexDigest, outDir string,
+	progress Progress) (*LazyTree, error) {
+	isolated, err := FetchIsolated(ctx, client, digest)
+	if err != nil {
+		return nil, err
+	}
+	t := &LazyTree{
+		client:   client,
+		cache:    cache,
+		isolated: isolated,
+		outDir:   outDir,
+		progress: progress,
+		readOnly: isolated.GetReadOnly(),
+		entries:  make(map[string]*lazyEntry, len(isolated.Files)),
+		accessed: map[string]bool{},
+	}
+	if t.readOnly == DirsReadOnly {
+		t.readOnly = FilesReadOnly
+	}
+	for p, f := range isolated.Files {
+		t.entries[path.Clean(p)] = &lazyEntry{file: f}
+	}
+	return t, nil
+}
+
+// Isolated returns the manifest of the tree, with its includes resolved.
+func (t *LazyTree) Isolated() *Isolated {
+	return t.isolated
+}
+
+// Fetch ensures the file p, relative to the root of the tree and using '/'
+// separators, is mapped in outDir and records the access.
+//
+// It is safe to call concurrently; each file is fetched once. A failed fetch
+// is retried by the next call.
+func (t *LazyTree) Fetch(ctx context.Context, p string) error {
+	p = path.Clean(p)
+	e := t.entries[p]
+	if e == nil {
+		return fmt.Errorf("%s is not in the tree", p)
+	}
+	t.lock.Lock()
+	t.accessed[p] = true
+	t.lock.Unlock()
+	return t.materialize(ctx, p, e)
+}
+
+func (t *LazyTree) materialize(ctx context.Context, p string, e *lazyEntry) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.done {
+		return nil
+	}
+	f := e.file
+	if f.Link == nil {
+		size := int64(-1)
+		if f.Size != nil {
+			size = *f.Size
+		}
+		AddProgress(t.progress, ItemsToDownload, 1)
+		if t.cache.Touch(f.Digest, size) {
+			AddProgress(t.progress, ItemsPresent, 1)
+		} else {
+			if err := FetchToCache(ctx, t.client, t.cache, f.Digest); err != nil {
+				return err
+			}
+			AddProgress(t.progress, ItemsDownloaded, 1)
+			if size >= 0 {
+				AddProgress(t.progress, BytesDownloaded, size)
+			}
+		}
+	}
+	if err := mapFile(ctx, t.cache, t.outDir, p, f, t.readOnly); err != nil {
+		return err
+	}
+	e.done = true
+	return nil
+}
+
+// Prefetch maps the files paths, e.g. from an AccessProfile, with up to jobs
+// concurrent downloads. Unlike Fetch, it doesn't record accesses. Paths not
+// in the tree are ignored, as the profile may come from an older version.
+func (t *LazyTree) Prefetch(ctx context.Context, paths []string, jobs int) error {
+	if jobs < 1 {
+		jobs = 1
+	}
+	sem := common.NewSemaphore(jobs)
+	errs := make(chan error, len(paths)+1)
+	for _, p := range paths {
+		p = path.Clean(p)
+		e := t.entries[p]
+		if e == nil {
+			continue
+		}
+		if err := sem.WaitContext(ctx); err != nil {
+			errs <- err
+			break
+		}
+		go func(p string, e *lazyEntry) {
+			defer sem.Signal()
+			if err := t.materialize(ctx, p, e); err != nil {
+				errs <- err
+			}
+		}(p, e)
+	}
+	for i := 0; i < jobs; i++ {
+		if err := sem.Wait(); err != nil {
+			return err
+		}
+	}
+	close(errs)
+	return <-errs
+}
+
+// Accessed returns the profile of the files requested so far.
+func (t *LazyTree) Accessed() *AccessProfile {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	out := &AccessProfile{Files: make([]string, 0, len(t.accessed))}
+	for p := range t.accessed {
+		out.Files = append(out.Files, p)
+	}
+	sort.Strings(out.Files)
+	return out
+}
+
+// Serve answers the file requests sent by RequestFile on l until ctx is
+// canceled.
+//
+// The protocol is line based: the client sends the path of a file, the server
+// replies "ok" once it is mapped, or "error <message>".
+func (t *LazyTree) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go t.serveConn(ctx, conn)
+	}
+}
+
+func (t *LazyTree) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewScanner(conn)
+	for r.Scan() {
+		reply := "ok\n"
+		if err := t.Fetch(ctx, r.Text()); err != nil {
+			common.Warningf("failed to fetch %s: %s", r.Text(), err)
+			reply = fmt.Sprintf("error %s\n", strings.Replace(err.Error(), "\n", " ", -1))
+		}
+		if _, err := conn.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// RequestFile asks the LazyTree serving on the Unix socket socketPath to map
+// the file p, relative to the root of the tree. It returns once the file can
+// be opened.
+func RequestFile(socketPath, p string) error {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := fmt.Fprintf(conn, "%s\n", p); err != nil {
+		return err
+	}
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	reply = strings.TrimSuffix(reply, "\n")
+	if reply != "ok" {
+		return fmt.Errorf("failed to fetch %s: %s", p, strings.TrimPrefix(reply, "error "))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+// memoryServer is an IsolateServer only supporting Fetch.
+type memoryServer struct {
+	contents map[HexDigest][]byte
+}
+
+func (m *memoryServer) ServerCapabilities(ctx context.Context) (*ServerCapabilities, error) {
+	return &ServerCapabilities{"memory"}, nil
+}
+
+func (m *memoryServer) Contains(ctx context.Context, items []*DigestItem) ([]*PushState, error) {
+	return nil, errors.New("not supported")
+}
+
+func (m *memoryServer) Push(ctx context.Context, state *PushState, src Source) error {
+	return errors.New("not supported")
+}
+
+func (m *memoryServer) Fetch(ctx context.Context, digest HexDigest, dest io.Writer) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	content, ok := m.contents[digest]
+	if !ok {
+		return os.ErrNotExist
+	}
+	_, err := dest.Write(content)
+	return err
+}
+
+// newLazyTree returns a LazyTree of a tree with the files "a" and "dir/b",
+// served by an in-memory fake.
+func newLazyTree(t *testing.T, outDir string) *LazyTree {
+	ctx := context.Background()
+	server := &memoryServer{contents: map[HexDigest][]byte{}}
+	isolated := NewIsolated()
+	for _, name := range []string{"a", "dir/b"} {
+		content := []byte("content of " + name)
+		digest := Hash(sha1.New(), content)
+		server.contents[digest] = content
+		size := int64(len(content))
+		isolated.Files[name] = File{Digest: digest, Size: &size}
+	}
+	data, err := isolated.Encode()
+	ut.AssertEqual(t, nil, err)
+	digest := Hash(sha1.New(), data)
+	server.contents[digest] = data
+	tree, err := NewLazyTree(ctx, server, MakeMemoryCache(sha1.New), digest, outDir, nil)
+	ut.AssertEqual(t, nil, err)
+	return tree
+}
+
+func TestLazyTree(t *testing.T) {
+	td, err := ioutil.TempDir("", "lazy")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+	ctx := context.Background()
+	tree := newLazyTree(t, td)
+	ut.AssertEqual(t, 2, len(tree.Isolated().Files))
+
+	ut.AssertEqual(t, nil, tree.Prefetch(ctx, []string{"a", "removed"}, 2))
+	content, err := ioutil.ReadFile(filepath.Join(td, "a"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content of a", string(content))
+	_, err = os.Stat(filepath.Join(td, "dir"))
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+	ut.AssertEqual(t, &AccessProfile{Files: []string{}}, tree.Accessed())
+
+	ut.AssertEqual(t, nil, tree.Fetch(ctx, "./dir/b"))
+	ut.AssertEqual(t, nil, tree.Fetch(ctx, "dir/b"))
+	ut.AssertEqual(t, nil, tree.Fetch(ctx, "a"))
+	ut.AssertEqual(t, true, tree.Fetch(ctx, "missing") != nil)
+	content, err = ioutil.ReadFile(filepath.Join(td, "dir", "b"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content of dir/b", string(content))
+	ut.AssertEqual(t, &AccessProfile{Files: []string{"a", "dir/b"}}, tree.Accessed())
+}
+
+func TestLazyTreeRetry(t *testing.T) {
+	td, err := ioutil.TempDir("", "lazy")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+	tree := newLazyTree(t, td)
+
+	// A fetch aborted by its caller mustn't fail the following ones.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	ut.AssertEqual(t, true, tree.Fetch(ctx, "a") != nil)
+	ut.AssertEqual(t, nil, tree.Fetch(context.Background(), "a"))
+	content, err := ioutil.ReadFile(filepath.Join(td, "a"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, "content of a", string(content))
+}
+
+func TestLazyTreeServe(t *testing.T) {
+	td, err := ioutil.TempDir("", "lazy")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+	out := filepath.Join(td, "out")
+	tree := newLazyTree(t, out)
+	socket := filepath.Join(td, "socket")
+	l, err := net.Listen("unix", socket)
+	ut.AssertEqual(t, nil, err)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- tree.Serve(ctx, l)
+	}()
+
+	ut.AssertEqual(t, nil, RequestFile(socket, "dir/b"))
+	_, err = os.Stat(filepath.Join(out, "dir", "b"))
+	ut.AssertEqual(t, nil, err)
+	err = RequestFile(socket, "missing")
+	ut.AssertEqual(t, "failed to fetch missing: missing is not in the tree", err.Error())
+	cancel()
+	ut.AssertEqual(t, nil, <-done)
+
+	profile := filepath.Join(td, "profile.json")
+	ut.AssertEqual(t, nil, WriteAccessProfile(profile, tree.Accessed()))
+	p, err := ReadAccessProfile(profile)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{"dir/b"}, p.Files)
+}
@@ -0,0 +1,440 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+// Package localserver implements the isolate server API on top of a local
+// directory.
+//
+// It supports the endpoints used by the isolateserver client: server_details,
+// preupload, store_inline, finalize_gs_upload and retrieve. Large items are
+// uploaded and downloaded through signed URLs served by the same handler,
+// like Google Storage URLs are for the real server.
+//
+// Items are stored as sent by the client, i.e. compressed in namespaces
+// using compression, in <root>/<namespace>/<digest>.
+package localserver
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+)
+
+// ServerVersion is returned by server_details.
+const ServerVersion = "local-1"
+
+// DefaultInlineMaxSize is the default value of Server.InlineMaxSize.
+const DefaultInlineMaxSize = 64 * 1024
+
+const (
+	apiPrefix = "/_ah/api/isolateservice/v1"
+	// storagePrefix is the path of the signed URLs used for large items.
+	storagePrefix = "/_local/storage/"
+	jsonType      = "application/json; charset=utf-8"
+)
+
+// validNamespace matches the namespaces that are safe to use as a directory
+// name; a leading alphanumeric character rules out "." and "..".
+var validNamespace = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9._\-]*$`)
+
+// Server is an http.Handler implementing the isolate server API.
+type Server struct {
+	// InlineMaxSize is the size up to which items are uploaded inline with
+	// store_inline and returned inline by retrieve. Larger items go through
+	// signed URLs.
+	InlineMaxSize int64
+
+	root string
+	// key signs the upload tickets and the storage URLs.
+	key []byte
+	mux *http.ServeMux
+}
+
+// New returns a Server storing the items in root, which is created if
+// needed.
+func New(root string) (*Server, error) {
+	if err := os.MkdirAll(root, 0700); err != nil {
+		return nil, err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	s := &Server{InlineMaxSize: DefaultInlineMaxSize, root: root, key: key, mux: http.NewServeMux()}
+	s.handleJSON("/server_details", s.serverDetails)
+	s.handleJSON("/preupload", s.preupload)
+	s.handleJSON("/store_inline", s.storeInline)
+	s.handleJSON("/finalize_gs_upload", s.finalizeUpload)
+	s.handleJSON("/retrieve", s.retrieve)
+	s.mux.HandleFunc(storagePrefix, s.storage)
+	return s, nil
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+// httpError is an error with the HTTP status to return.
+type httpError struct {
+	status int
+	msg    string
+}
+
+func (h *httpError) Error() string {
+	return h.msg
+}
+
+func badRequest(format string, args ...interface{}) error {
+	return &httpError{http.StatusBadRequest, fmt.Sprintf(format, args...)}
+}
+
+// jsonHandler handles an API call. It decodes the request body with decode and
+// returns the response to encode.
+type jsonHandler func(r *http.Request, decode func(in interface{}) error) (interface{}, error)
+
+func (s *Server) handleJSON(path string, h jsonHandler) {
+	s.mux.HandleFunc(apiPrefix+path, func(w http.ResponseWriter, r *http.Request) {
+		var out interface{}
+		var err error
+		if r.Method != "POST" {
+			err = &httpError{http.StatusMethodNotAllowed, "POST required"}
+		} else {
+			out, err = h(r, func(in interface{}) error {
+				if err := json.NewDecoder(r.Body).Decode(in); err != nil {
+					return badRequest("invalid request: %s", err)
+				}
+				return nil
+			})
+		}
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+			if h, ok := err.(*httpError); ok {
+				status = h.status
+			}
+			common.Warningf("%s: %s", r.URL.Path, err)
+			out = map[string]interface{}{"error": map[string]interface{}{"code": status, "message": err.Error()}}
+		} else if out == nil {
+			out = map[string]string{}
+		}
+		w.Header().Set("Content-Type", jsonType)
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(out)
+	})
+}
+
+// validateNamespace checks a namespace sent by the client.
+func validateNamespace(n *isolateserver.Namespace) error {
+	if !validNamespace.MatchString(n.Namespace) {
+		return badRequest("invalid namespace %q", n.Namespace)
+	}
+	if n.DigestAlgo == "" {
+		n.DigestAlgo = "sha-1"
+	}
+	if _, err := n.GetHashAlgo(); err != nil {
+		return badRequest("%s", err)
+	}
+	if n.Compression != "" && n.Compression != "flate" {
+		return badRequest("unsupported compression %q", n.Compression)
+	}
+	return nil
+}
+
+func validateDigest(digest isolateserver.HexDigest) error {
+	if !digest.Validate(sha1.New()) {
+		return badRequest("invalid digest %q", digest)
+	}
+	return nil
+}
+
+// ticket describes an upload in progress. It is handed to the client signed,
+// so the server doesn't need to keep state between the calls.
+type ticket struct {
+	Namespace isolateserver.Namespace `json:"ns"`
+	Digest    isolateserver.HexDigest `json:"d"`
+	Size      int64                   `json:"s"`
+}
+
+func (s *Server) sign(data string) string {
+	m := hmac.New(sha256.New, s.key)
+	_, _ = io.WriteString(m, data)
+	return hex.EncodeToString(m.Sum(nil))
+}
+
+func (s *Server) encodeTicket(t *ticket) string {
+	data, _ := json.Marshal(t)
+	encoded := base64.RawURLEncoding.EncodeToString(data)
+	return encoded + "." + s.sign(encoded)
+}
+
+func (s *Server) decodeTicket(encoded string) (*ticket, error) {
+	i := strings.LastIndex(encoded, ".")
+	if i == -1 || !hmac.Equal([]byte(s.sign(encoded[:i])), []byte(encoded[i+1:])) {
+		return nil, badRequest("invalid upload ticket")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(encoded[:i])
+	if err != nil {
+		return nil, badRequest("invalid upload ticket")
+	}
+	t := &ticket{}
+	if err := json.Unmarshal(data, t); err != nil {
+		return nil, badRequest("invalid upload ticket")
+	}
+	return t, nil
+}
+
+// storageURL returns the signed URL to upload or download an item.
+func (s *Server) storageURL(r *http.Request, ns string, digest isolateserver.HexDigest) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	p := storagePrefix + ns + "/" + string(digest)
+	return fmt.Sprintf("%s://%s%s?sig=%s", scheme, r.Host, p, s.sign(p))
+}
+
+func (s *Server) path(ns string, digest isolateserver.HexDigest) string {
+	return blobPath(s.root, ns, digest)
+}
+
+// uploadPath is where the content of an item uploaded through a signed URL is
+// kept until the upload is finalized.
+func (s *Server) uploadPath(ns string, digest isolateserver.HexDigest) string {
+	return s.path(ns, digest) + ".upload"
+}
+
+func (s *Server) contains(ns string, digest isolateserver.HexDigest) bool {
+	_, err := os.Stat(s.path(ns, digest))
+	return err == nil
+}
+
+// touch refreshes the modification time of the item, if present, and returns
+// true if it is. Items found by preupload are about to be referenced by a new
+// .isolated whose root may not be registered yet; this keeps gc from
+// collecting them during its grace period.
+func (s *Server) touch(ns string, digest isolateserver.HexDigest) bool {
+	now := time.Now()
+	return os.Chtimes(s.path(ns, digest), now, now) == nil
+}
+
+func (s *Server) serverDetails(r *http.Request, decode func(interface{}) error) (interface{}, error) {
+	return map[string]string{"server_version": ServerVersion}, nil
+}
+
+func (s *Server) preupload(r *http.Request, decode func(interface{}) error) (interface{}, error) {
+	in := &struct {
+		Items     []isolateserver.DigestItem `json:"items"`
+		Namespace isolateserver.Namespace    `json:"namespace"`
+	}{}
+	if err := decode(in); err != nil {
+		return nil, err
+	}
+	if err := validateNamespace(&in.Namespace); err != nil {
+		return nil, err
+	}
+	type status struct {
+		Index        string `json:"index"`
+		UploadTicket string `json:"upload_ticket"`
+		GSUploadURL  string `json:"gs_upload_url,omitempty"`
+	}
+	out := &struct {
+		Items []status `json:"items"`
+	}{Items: []status{}}
+	for i, item := range in.Items {
+		if err := validateDigest(item.Digest); err != nil {
+			return nil, err
+		}
+		if s.touch(in.Namespace.Namespace, item.Digest) {
+			continue
+		}
+		t := &ticket{Namespace: in.Namespace, Digest: item.Digest, Size: item.Size}
+		st := status{Index: strconv.Itoa(i), UploadTicket: s.encodeTicket(t)}
+		if item.Size > s.InlineMaxSize {
+			st.GSUploadURL = s.storageURL(r, in.Namespace.Namespace, item.Digest)
+		}
+		out.Items = append(out.Items, st)
+	}
+	return out, nil
+}
+
+func (s *Server) storeInline(r *http.Request, decode func(interface{}) error) (interface{}, error) {
+	in := &struct {
+		Content      []byte `json:"content"`
+		UploadTicket string `json:"upload_ticket"`
+	}{}
+	if err := decode(in); err != nil {
+		return nil, err
+	}
+	t, err := s.decodeTicket(in.UploadTicket)
+	if err != nil {
+		return nil, err
+	}
+	// Concurrent uploads of the same item each use their own file.
+	tmp, err := writeTempFile(filepath.Dir(s.path(t.Namespace.Namespace, t.Digest)), string(t.Digest)+".inline",
+		bytes.NewReader(in.Content))
+	if err != nil {
+		return nil, err
+	}
+	return nil, s.commit(t, tmp)
+}
+
+func (s *Server) finalizeUpload(r *http.Request, decode func(interface{}) error) (interface{}, error) {
+	in := &struct {
+		UploadTicket string `json:"upload_ticket"`
+	}{}
+	if err := decode(in); err != nil {
+		return nil, err
+	}
+	t, err := s.decodeTicket(in.UploadTicket)
+	if err != nil {
+		return nil, err
+	}
+	if s.contains(t.Namespace.Namespace, t.Digest) {
+		// Finalization is idempotent.
+		return nil, nil
+	}
+	return nil, s.commit(t, s.uploadPath(t.Namespace.Namespace, t.Digest))
+}
+
+// commit verifies the content uploaded to tmp against the ticket and moves
+// it in place.
+func (s *Server) commit(t *ticket, tmp string) error {
+	err := s.verify(t, tmp)
+	if err == nil {
+		err = os.Rename(tmp, s.path(t.Namespace.Namespace, t.Digest))
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+	return err
+}
+
+// verify checks that the file p contains the item described by t.
+func (s *Server) verify(t *ticket, p string) error {
+	if _, err := os.Stat(p); os.IsNotExist(err) {
+		return badRequest("%s was not uploaded", t.Digest)
+	}
+	size, err := verifyBlob(&t.Namespace, t.Digest, p)
+	if err != nil {
+		if _, ok := err.(*os.PathError); ok {
+			return err
+		}
+		return badRequest("%s", err)
+	}
+	if size != t.Size {
+		return badRequest("%s: expected %d bytes, got %d", t.Digest, t.Size, size)
+	}
+	return nil
+}
+
+func (s *Server) retrieve(r *http.Request, decode func(interface{}) error) (interface{}, error) {
+	in := &struct {
+		Digest    isolateserver.HexDigest `json:"digest"`
+		Namespace isolateserver.Namespace `json:"namespace"`
+		Offset    int64                   `json:"offset"`
+	}{}
+	if err := decode(in); err != nil {
+		return nil, err
+	}
+	if err := validateNamespace(&in.Namespace); err != nil {
+		return nil, err
+	}
+	if err := validateDigest(in.Digest); err != nil {
+		return nil, err
+	}
+	p := s.path(in.Namespace.Namespace, in.Digest)
+	info, err := os.Stat(p)
+	if os.IsNotExist(err) {
+		return nil, &httpError{http.StatusNotFound, fmt.Sprintf("%s not found", in.Digest)}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() > s.InlineMaxSize {
+		return map[string]string{"url": s.storageURL(r, in.Namespace.Namespace, in.Digest)}, nil
+	}
+	content, err := ioutil.ReadFile(p)
+	if err != nil {
+		return nil, err
+	}
+	if in.Offset < 0 || in.Offset > int64(len(content)) {
+		return nil, badRequest("invalid offset %d", in.Offset)
+	}
+	return map[string][]byte{"content": content[in.Offset:]}, nil
+}
+
+// storage serves the signed URLs: PUT uploads the content of an item, GET
+// downloads it.
+func (s *Server) storage(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, storagePrefix), "/")
+	sig := r.URL.Query().Get("sig")
+	if len(parts) != 2 || !validNamespace.MatchString(parts[0]) || validateDigest(isolateserver.HexDigest(parts[1])) != nil ||
+		!hmac.Equal([]byte(sig), []byte(s.sign(r.URL.Path))) {
+		http.Error(w, "invalid signed URL", http.StatusForbidden)
+		return
+	}
+	ns, digest := parts[0], isolateserver.HexDigest(parts[1])
+	switch r.Method {
+	case "PUT":
+		if err := writeFile(s.uploadPath(ns, digest), r.Body); err != nil {
+			common.Warningf("PUT %s: %s", r.URL.Path, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "GET":
+		http.ServeFile(w, r, s.path(ns, digest))
+	default:
+		http.Error(w, "unsupported method", http.StatusMethodNotAllowed)
+	}
+}
+
+// writeFile atomically writes the content of src to p.
+func writeFile(p string, src io.Reader) error {
+	tmp, err := writeTempFile(filepath.Dir(p), "tmp", src)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// writeTempFile writes src to a new file in dir, created if needed, whose name
+// starts with prefix, and returns its path.
+func writeTempFile(dir, prefix string, src io.Reader) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f, err := ioutil.TempFile(dir, prefix)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(f, src)
+	if err2 := f.Close(); err == nil {
+		err = err2
+	}
+	if err != nil {
+		_ = os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
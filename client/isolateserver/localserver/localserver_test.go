@@ -0,0 +1,198 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package localserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/luci/luci-go/client/internal/common"
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/ut"
+)
+
+func newServer(t *testing.T) (*httptest.Server, string) {
+	td, err := ioutil.TempDir("", "localserver")
+	ut.AssertEqual(t, nil, err)
+	s, err := New(td)
+	ut.AssertEqual(t, nil, err)
+	s.InlineMaxSize = 100
+	return httptest.NewServer(s), td
+}
+
+func source(content []byte) isolateserver.Source {
+	return func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(content)), nil
+	}
+}
+
+func TestLocalServerRoundTrip(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+	ctx := context.Background()
+
+	for _, namespace := range []string{"default", "default-gzip"} {
+		client := isolateserver.New(nil, ts.URL, namespace, "sha-1", isolateserver.CompressionForNamespace(namespace))
+		caps, err := client.ServerCapabilities(ctx)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, ServerVersion, caps.ServerVersion)
+
+		contents := [][]byte{[]byte("small"), bytes.Repeat([]byte("large "), 1000)}
+		items := make([]*isolateserver.DigestItem, len(contents))
+		for i, c := range contents {
+			items[i] = &isolateserver.DigestItem{Digest: isolateserver.Hash(sha1.New(), c), Size: int64(len(c))}
+		}
+		states, err := client.Contains(ctx, items)
+		ut.AssertEqual(t, nil, err)
+		for i, state := range states {
+			ut.AssertEqual(t, nil, client.Push(ctx, state, source(contents[i])))
+		}
+		states, err = client.Contains(ctx, items)
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, []*isolateserver.PushState{nil, nil}, states)
+
+		for i, item := range items {
+			buf := &bytes.Buffer{}
+			ut.AssertEqual(t, nil, client.Fetch(ctx, item.Digest, buf))
+			ut.AssertEqual(t, contents[i], buf.Bytes())
+			_, err := os.Stat(filepath.Join(td, namespace, string(item.Digest)))
+			ut.AssertEqual(t, nil, err)
+		}
+	}
+}
+
+func TestLocalServerRejectsCorruptContent(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+	ctx := context.Background()
+
+	client := isolateserver.New(nil, ts.URL, "default", "sha-1", "")
+	for _, size := range []int{10, 1000} {
+		content := bytes.Repeat([]byte("a"), size)
+		item := &isolateserver.DigestItem{Digest: isolateserver.Hash(sha1.New(), content), Size: int64(size)}
+		states, err := client.Contains(ctx, []*isolateserver.DigestItem{item})
+		ut.AssertEqual(t, nil, err)
+		err = client.Push(ctx, states[0], source(bytes.Repeat([]byte("b"), size)))
+		ut.AssertEqual(t, true, err != nil)
+		ut.AssertEqual(t, true, strings.Contains(err.Error(), "400"))
+		states, err = client.Contains(ctx, []*isolateserver.DigestItem{item})
+		ut.AssertEqual(t, nil, err)
+		ut.AssertEqual(t, true, states[0] != nil)
+	}
+}
+
+func TestLocalServerNotFound(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+
+	client := isolateserver.New(nil, ts.URL, "default", "sha-1", "")
+	err := client.Fetch(context.Background(), isolateserver.Hash(sha1.New(), []byte("missing")), ioutil.Discard)
+	ut.AssertEqual(t, true, common.IsNotFound(err))
+}
+
+func TestLocalServerInvalidNamespace(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+
+	// The namespace is a directory name; it mustn't escape the root.
+	item := &isolateserver.DigestItem{Digest: isolateserver.Hash(sha1.New(), []byte("foo")), Size: 3}
+	for _, ns := range []string{"..", ".", ".hidden", "a/b"} {
+		client := isolateserver.New(nil, ts.URL, ns, "sha-1", "")
+		_, err := client.Contains(context.Background(), []*isolateserver.DigestItem{item})
+		var apiErr *common.APIError
+		ut.AssertEqual(t, true, errors.As(err, &apiErr))
+		ut.AssertEqual(t, http.StatusBadRequest, apiErr.StatusCode)
+		_, err = NewStore(td, isolateserver.Namespace{Namespace: ns, DigestAlgo: "sha-1"})
+		ut.AssertEqual(t, true, err != nil)
+	}
+}
+
+func TestLocalServerConcurrentInlineUploads(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+	ctx := context.Background()
+
+	client := isolateserver.New(nil, ts.URL, "default", "sha-1", "")
+	content := []byte("small")
+	item := &isolateserver.DigestItem{Digest: isolateserver.Hash(sha1.New(), content), Size: int64(len(content))}
+	var states []*isolateserver.PushState
+	for i := 0; i < 8; i++ {
+		s, err := client.Contains(ctx, []*isolateserver.DigestItem{item})
+		ut.AssertEqual(t, nil, err)
+		states = append(states, s[0])
+	}
+	errs := make(chan error)
+	for _, state := range states {
+		go func(state *isolateserver.PushState) {
+			errs <- client.Push(ctx, state, source(content))
+		}(state)
+	}
+	for range states {
+		ut.AssertEqual(t, nil, <-errs)
+	}
+}
+
+func TestLocalServerSignedURLs(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+
+	digest := string(isolateserver.Hash(sha1.New(), []byte("foo")))
+	for _, suffix := range []string{"", "?sig=bad"} {
+		req, err := http.NewRequest("PUT", ts.URL+storagePrefix+"default/"+digest+suffix, strings.NewReader("foo"))
+		ut.AssertEqual(t, nil, err)
+		resp, err := http.DefaultClient.Do(req)
+		ut.AssertEqual(t, nil, err)
+		resp.Body.Close()
+		ut.AssertEqual(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestLocalServerDownloadTree(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+	ctx := context.Background()
+
+	client := isolateserver.New(nil, ts.URL, "default-gzip", "sha-1", "flate")
+	content := bytes.Repeat([]byte("x"), 1000)
+	size := int64(len(content))
+	isolated := isolateserver.NewIsolated()
+	isolated.Files["dir/file"] = isolateserver.File{Digest: isolateserver.Hash(sha1.New(), content), Size: &size}
+	data, err := isolated.Encode()
+	ut.AssertEqual(t, nil, err)
+	items := []*isolateserver.DigestItem{
+		{Digest: isolated.Files["dir/file"].Digest, Size: size},
+		{Digest: isolateserver.Hash(sha1.New(), data), IsIsolated: true, Size: int64(len(data))},
+	}
+	states, err := client.Contains(ctx, items)
+	ut.AssertEqual(t, nil, err)
+	for i, c := range [][]byte{content, data} {
+		ut.AssertEqual(t, nil, client.Push(ctx, states[i], source(c)))
+	}
+
+	out := filepath.Join(td, "out")
+	stats, err := isolateserver.DownloadTree(ctx, client, isolateserver.MakeMemoryCache(sha1.New), items[1].Digest, out, 4, nil)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, int64(1), stats.ItemsDownloaded)
+	actual, err := ioutil.ReadFile(filepath.Join(out, "dir", "file"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, content, actual)
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package localserver
+
+import (
+	"compress/zlib"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/luci/luci-go/client/isolateserver"
+)
+
+// Store gives access to the items of a namespace stored by a Server, for
+// maintenance.
+type Store struct {
+	root      string
+	namespace isolateserver.Namespace
+}
+
+// NewStore returns the Store of namespace in the directory root of a Server.
+func NewStore(root string, namespace isolateserver.Namespace) (*Store, error) {
+	if !validNamespace.MatchString(namespace.Namespace) {
+		return nil, fmt.Errorf("invalid namespace %q", namespace.Namespace)
+	}
+	if _, err := namespace.GetHashAlgo(); err != nil {
+		return nil, err
+	}
+	return &Store{root: root, namespace: namespace}, nil
+}
+
+func blobPath(root, ns string, digest isolateserver.HexDigest) string {
+	return filepath.Join(root, ns, string(digest))
+}
+
+func (s *Store) path(digest isolateserver.HexDigest) string {
+	return blobPath(s.root, s.namespace.Namespace, digest)
+}
+
+// Entry is a file in the directory of a namespace.
+type Entry struct {
+	// Digest is the digest of the item; empty for temporary files, e.g.
+	// uploads that were never finalized.
+	Digest  isolateserver.HexDigest
+	Name    string
+	Size    int64
+	ModTime time.Time
+}
+
+// List returns the files of the namespace, sorted by name.
+func (s *Store) List() ([]*Entry, error) {
+	infos, err := ioutil.ReadDir(filepath.Join(s.root, s.namespace.Namespace))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	h, _ := s.namespace.GetHashAlgo()
+	out := make([]*Entry, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			continue
+		}
+		e := &Entry{Name: info.Name(), Size: info.Size(), ModTime: info.ModTime()}
+		if d := isolateserver.HexDigest(info.Name()); d.Validate(h) {
+			e.Digest = d
+		}
+		out = append(out, e)
+	}
+	return out, nil
+}
+
+// Open returns a reader of the uncompressed content of an item.
+func (s *Store) Open(digest isolateserver.HexDigest) (io.ReadCloser, error) {
+	return openBlob(&s.namespace, s.path(digest))
+}
+
+// Verify checks that the content of an item matches its digest.
+func (s *Store) Verify(digest isolateserver.HexDigest) error {
+	_, err := verifyBlob(&s.namespace, digest, s.path(digest))
+	return err
+}
+
+// Delete deletes an item.
+func (s *Store) Delete(digest isolateserver.HexDigest) error {
+	return os.Remove(s.path(digest))
+}
+
+// Reachable returns the digests of the items referenced by the .isolated
+// files roots, including the roots and the included .isolated files.
+//
+// It fails if a .isolated file is missing or invalid, as what it references
+// can't be known.
+func (s *Store) Reachable(roots []isolateserver.HexDigest) (map[isolateserver.HexDigest]bool, error) {
+	out := map[isolateserver.HexDigest]bool{}
+	pending := append([]isolateserver.HexDigest(nil), roots...)
+	for len(pending) != 0 {
+		digest := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if out[digest] {
+			continue
+		}
+		out[digest] = true
+		r, err := s.Open(digest)
+		if err != nil {
+			return nil, err
+		}
+		isolated, err := isolateserver.DecodeIsolated(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", digest, err)
+		}
+		for _, f := range isolated.Files {
+			if f.Link == nil {
+				out[f.Digest] = true
+			}
+		}
+		pending = append(pending, isolated.Includes...)
+	}
+	return out, nil
+}
+
+// Collect deletes the items unreachable from roots, and the temporary files,
+// that were not modified, nor found by a preupload request, for grace. It only
+// lists them if dryRun is true.
+//
+// Returns the names of the files deleted.
+func (s *Store) Collect(roots []isolateserver.HexDigest, grace time.Duration, dryRun bool) ([]string, error) {
+	reachable, err := s.Reachable(roots)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := s.List()
+	if err != nil {
+		return nil, err
+	}
+	cutoff := time.Now().Add(-grace)
+	var out []string
+	for _, e := range entries {
+		if reachable[e.Digest] || e.ModTime.After(cutoff) {
+			continue
+		}
+		if !dryRun {
+			if err := os.Remove(filepath.Join(s.root, s.namespace.Namespace, e.Name)); err != nil {
+				return out, err
+			}
+		}
+		out = append(out, e.Name)
+	}
+	sort.Strings(out)
+	return out, nil
+}
+
+// openBlob returns a reader of the uncompressed content of the file p.
+func openBlob(ns *isolateserver.Namespace, p string) (io.ReadCloser, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	switch ns.Compression {
+	case "":
+		return f, nil
+	case "flate":
+		z, err := zlib.NewReader(f)
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("invalid compressed content: %s", err)
+		}
+		return &closeBoth{z, f}, nil
+	default:
+		f.Close()
+		return nil, fmt.Errorf("unsupported compression %q", ns.Compression)
+	}
+}
+
+// closeBoth closes a decompressor and its source.
+type closeBoth struct {
+	io.ReadCloser
+	src io.Closer
+}
+
+func (c *closeBoth) Close() error {
+	err := c.ReadCloser.Close()
+	if err2 := c.src.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+// verifyBlob checks that the file p contains the item digest and returns its
+// uncompressed size.
+func verifyBlob(ns *isolateserver.Namespace, digest isolateserver.HexDigest, p string) (int64, error) {
+	h, err := ns.GetHashAlgo()
+	if err != nil {
+		return 0, err
+	}
+	r, err := openBlob(ns, p)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	size, err := io.Copy(h, r)
+	if err != nil {
+		return 0, fmt.Errorf("%s: invalid content: %s", digest, err)
+	}
+	if actual := isolateserver.HexDigest(hex.EncodeToString(h.Sum(nil))); actual != digest {
+		return 0, fmt.Errorf("content doesn't match digest %s, got %s", digest, actual)
+	}
+	return size, nil
+}
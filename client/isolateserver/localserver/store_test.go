@@ -0,0 +1,134 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package localserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/luci/luci-go/client/isolateserver"
+	"github.com/maruel/ut"
+)
+
+// push uploads contents to the server and returns their digests.
+func push(t *testing.T, client isolateserver.IsolateServer, contents ...[]byte) []isolateserver.HexDigest {
+	ctx := context.Background()
+	items := make([]*isolateserver.DigestItem, len(contents))
+	digests := make([]isolateserver.HexDigest, len(contents))
+	for i, c := range contents {
+		digests[i] = isolateserver.Hash(sha1.New(), c)
+		items[i] = &isolateserver.DigestItem{Digest: digests[i], Size: int64(len(c))}
+	}
+	states, err := client.Contains(ctx, items)
+	ut.AssertEqual(t, nil, err)
+	for i, state := range states {
+		if state != nil {
+			ut.AssertEqual(t, nil, client.Push(ctx, state, source(contents[i])))
+		}
+	}
+	return digests
+}
+
+func TestStoreVerifyAndCollect(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+	ns := isolateserver.Namespace{Namespace: "default-gzip", DigestAlgo: "sha-1", Compression: "flate"}
+	client := isolateserver.New(nil, ts.URL, ns.Namespace, ns.DigestAlgo, ns.Compression)
+
+	kept := bytes.Repeat([]byte("kept"), 100)
+	included := []byte("included")
+	garbage := []byte("garbage")
+	digests := push(t, client, kept, included, garbage)
+
+	child := isolateserver.NewIsolated()
+	child.Files["included"] = isolateserver.File{Digest: digests[1]}
+	childData, err := child.Encode()
+	ut.AssertEqual(t, nil, err)
+	childDigest := push(t, client, childData)[0]
+	root := isolateserver.NewIsolated()
+	root.Files["kept"] = isolateserver.File{Digest: digests[0]}
+	root.Includes = []isolateserver.HexDigest{childDigest}
+	rootData, err := root.Encode()
+	ut.AssertEqual(t, nil, err)
+	rootDigest := push(t, client, rootData)[0]
+
+	store, err := NewStore(td, ns)
+	ut.AssertEqual(t, nil, err)
+	entries, err := store.List()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 5, len(entries))
+	for _, e := range entries {
+		ut.AssertEqual(t, nil, store.Verify(e.Digest))
+	}
+
+	reachable, err := store.Reachable([]isolateserver.HexDigest{rootDigest})
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 4, len(reachable))
+	ut.AssertEqual(t, false, reachable[digests[2]])
+
+	// Nothing is old enough.
+	deleted, err := store.Collect([]isolateserver.HexDigest{rootDigest}, time.Hour, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(deleted))
+
+	// An abandoned upload is collected too.
+	abandoned := filepath.Join(td, ns.Namespace, string(digests[2])+".upload")
+	ut.AssertEqual(t, nil, ioutil.WriteFile(abandoned, []byte("x"), 0600))
+	deleted, err = store.Collect([]isolateserver.HexDigest{rootDigest}, 0, true)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []string{string(digests[2]), string(digests[2]) + ".upload"}, deleted)
+	deleted, err = store.Collect([]isolateserver.HexDigest{rootDigest}, 0, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 2, len(deleted))
+	entries, err = store.List()
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 4, len(entries))
+
+	// A missing root fails instead of deleting everything.
+	_, err = store.Collect([]isolateserver.HexDigest{digests[2]}, 0, false)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+
+	// Corruption is detected.
+	ut.AssertEqual(t, nil, ioutil.WriteFile(filepath.Join(td, ns.Namespace, string(digests[0])), []byte("bad"), 0600))
+	ut.AssertEqual(t, true, store.Verify(digests[0]) != nil)
+	ut.AssertEqual(t, nil, store.Verify(digests[1]))
+}
+
+func TestCollectKeepsDeduplicatedItems(t *testing.T) {
+	ts, td := newServer(t)
+	defer ts.Close()
+	defer os.RemoveAll(td)
+	ns := isolateserver.Namespace{Namespace: "default-gzip", DigestAlgo: "sha-1", Compression: "flate"}
+	client := isolateserver.New(nil, ts.URL, ns.Namespace, ns.DigestAlgo, ns.Compression)
+
+	// An old unreachable item.
+	old := []byte("old")
+	digest := push(t, client, old)[0]
+	p := filepath.Join(td, ns.Namespace, string(digest))
+	past := time.Now().Add(-2 * time.Hour)
+	ut.AssertEqual(t, nil, os.Chtimes(p, past, past))
+
+	// A new upload reuses it; its root isn't registered yet.
+	root := isolateserver.NewIsolated()
+	root.Files["old"] = isolateserver.File{Digest: digest}
+	rootData, err := root.Encode()
+	ut.AssertEqual(t, nil, err)
+	push(t, client, old, rootData)
+
+	store, err := NewStore(td, ns)
+	ut.AssertEqual(t, nil, err)
+	deleted, err := store.Collect(nil, time.Hour, false)
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, 0, len(deleted))
+	_, err = os.Stat(p)
+	ut.AssertEqual(t, nil, err)
+}
@@ -0,0 +1,82 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+// Counter identifies a quantity reported to a Progress.
+type Counter int
+
+// Counters reported by the archive and download operations.
+const (
+	// FilesHashed is the number of files whose digest was determined, either
+	// by reading them or from the hash cache.
+	FilesHashed Counter = iota
+	// HashCacheHits is the number of files whose digest came from the hash
+	// cache.
+	HashCacheHits
+	// BytesHashed is the number of bytes read to calculate digests.
+	BytesHashed
+	// ItemsToUpload is the number of unique items to archive.
+	ItemsToUpload
+	// ItemsPresent is the number of items that didn't need to be transferred:
+	// already on the server when archiving, already in the local cache when
+	// downloading.
+	ItemsPresent
+	// ItemsUploaded and BytesUploaded count the items uploaded and their
+	// uncompressed size.
+	ItemsUploaded
+	BytesUploaded
+	// ItemsToDownload is the number of unique items to download.
+	ItemsToDownload
+	// ItemsDownloaded and BytesDownloaded count the items downloaded and their
+	// uncompressed size.
+	ItemsDownloaded
+	BytesDownloaded
+	// BytesSent and BytesReceived count the bytes transferred to and from the
+	// server, after compression.
+	BytesSent
+	BytesReceived
+
+	// NumCounters is the number of counters.
+	NumCounters
+)
+
+var counterNames = [NumCounters]string{
+	"files_hashed",
+	"hash_cache_hits",
+	"bytes_hashed",
+	"items_to_upload",
+	"items_present",
+	"items_uploaded",
+	"bytes_uploaded",
+	"items_to_download",
+	"items_downloaded",
+	"bytes_downloaded",
+	"bytes_sent",
+	"bytes_received",
+}
+
+func (c Counter) String() string {
+	if c >= 0 && c < NumCounters {
+		return counterNames[c]
+	}
+	return "unknown"
+}
+
+// Progress receives progress updates from long running operations.
+//
+// Implementations must be thread-safe; Add is called concurrently from the
+// stages of the operations.
+type Progress interface {
+	// Add adds delta to the counter c.
+	Add(c Counter, delta int64)
+}
+
+// AddProgress calls p.Add if p is not nil, so optional Progress values can be
+// reported to unconditionally.
+func AddProgress(p Progress, c Counter, delta int64) {
+	if p != nil {
+		p.Add(c, delta)
+	}
+}
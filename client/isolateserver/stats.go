@@ -0,0 +1,114 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats summarizes an archive or a download.
+type Stats struct {
+	FilesHashed   int64 `json:"files_hashed"`
+	HashCacheHits int64 `json:"hash_cache_hits"`
+	BytesHashed   int64 `json:"bytes_hashed"`
+
+	ItemsToUpload int64 `json:"items_to_upload"`
+	ItemsUploaded int64 `json:"items_uploaded"`
+	BytesUploaded int64 `json:"bytes_uploaded"`
+
+	ItemsToDownload int64 `json:"items_to_download"`
+	ItemsDownloaded int64 `json:"items_downloaded"`
+	BytesDownloaded int64 `json:"bytes_downloaded"`
+
+	// ItemsPresent is the number of items already on the server when
+	// archiving, or already in the local cache when downloading.
+	ItemsPresent int64 `json:"items_present"`
+
+	// BytesSent and BytesReceived are the bytes transferred, after
+	// compression.
+	BytesSent     int64 `json:"bytes_sent"`
+	BytesReceived int64 `json:"bytes_received"`
+
+	// HashCacheHitRate is the fraction of the files hashed whose digest came
+	// from the hash cache.
+	HashCacheHitRate float64 `json:"hash_cache_hit_rate"`
+	// CompressionRatio is the size of the data transferred divided by its
+	// uncompressed size; 1 when nothing was transferred.
+	CompressionRatio float64 `json:"compression_ratio"`
+
+	// Phases is the wall time of each phase, in seconds.
+	Phases map[string]float64 `json:"phases"`
+}
+
+// StatsRecorder implements Progress and collects the counters and the
+// duration of the phases of an operation into a Stats.
+type StatsRecorder struct {
+	next     Progress
+	counters [NumCounters]int64
+
+	lock   sync.Mutex
+	phases map[string]time.Duration
+}
+
+// NewStatsRecorder returns a StatsRecorder forwarding the counters to next,
+// which may be nil.
+func NewStatsRecorder(next Progress) *StatsRecorder {
+	return &StatsRecorder{next: next, phases: map[string]time.Duration{}}
+}
+
+// Add implements Progress.
+func (s *StatsRecorder) Add(c Counter, delta int64) {
+	atomic.AddInt64(&s.counters[c], delta)
+	AddProgress(s.next, c, delta)
+}
+
+// Phase starts timing the phase name. The returned function ends it; a phase
+// timed several times accumulates its durations.
+func (s *StatsRecorder) Phase(name string) func() {
+	start := time.Now()
+	return func() {
+		d := time.Since(start)
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.phases[name] += d
+	}
+}
+
+// Stats returns a snapshot of the statistics.
+func (s *StatsRecorder) Stats() *Stats {
+	get := func(c Counter) int64 {
+		return atomic.LoadInt64(&s.counters[c])
+	}
+	out := &Stats{
+		FilesHashed:      get(FilesHashed),
+		HashCacheHits:    get(HashCacheHits),
+		BytesHashed:      get(BytesHashed),
+		ItemsToUpload:    get(ItemsToUpload),
+		ItemsUploaded:    get(ItemsUploaded),
+		BytesUploaded:    get(BytesUploaded),
+		ItemsToDownload:  get(ItemsToDownload),
+		ItemsDownloaded:  get(ItemsDownloaded),
+		BytesDownloaded:  get(BytesDownloaded),
+		ItemsPresent:     get(ItemsPresent),
+		BytesSent:        get(BytesSent),
+		BytesReceived:    get(BytesReceived),
+		CompressionRatio: 1,
+		Phases:           map[string]float64{},
+	}
+	if out.FilesHashed != 0 {
+		out.HashCacheHitRate = float64(out.HashCacheHits) / float64(out.FilesHashed)
+	}
+	if raw := out.BytesUploaded + out.BytesDownloaded; raw != 0 {
+		out.CompressionRatio = float64(out.BytesSent+out.BytesReceived) / float64(raw)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for name, d := range s.phases {
+		out.Phases[name] = d.Seconds()
+	}
+	return out
+}
@@ -0,0 +1,39 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+type sumProgress int64
+
+func (s *sumProgress) Add(c Counter, delta int64) {
+	*s += sumProgress(delta)
+}
+
+func TestStatsRecorder(t *testing.T) {
+	var next sumProgress
+	r := NewStatsRecorder(&next)
+	s := r.Stats()
+	ut.AssertEqual(t, 1., s.CompressionRatio)
+	ut.AssertEqual(t, 0., s.HashCacheHitRate)
+	ut.AssertEqual(t, map[string]float64{}, s.Phases)
+
+	r.Add(FilesHashed, 4)
+	r.Add(HashCacheHits, 1)
+	r.Add(BytesUploaded, 1000)
+	r.Add(BytesSent, 250)
+	r.Phase("hash")()
+	s = r.Stats()
+	ut.AssertEqual(t, sumProgress(1255), next)
+	ut.AssertEqual(t, int64(4), s.FilesHashed)
+	ut.AssertEqual(t, 0.25, s.HashCacheHitRate)
+	ut.AssertEqual(t, 0.25, s.CompressionRatio)
+	_, ok := s.Phases["hash"]
+	ut.AssertEqual(t, true, ok)
+}
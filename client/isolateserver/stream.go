@@ -0,0 +1,197 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bufio"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"runtime"
+	"sync"
+
+	"github.com/luci/luci-go/client/internal/common"
+)
+
+// Source returns a new reader of the uncompressed content of an item.
+//
+// It may be called multiple times, as transfers are retried from the start.
+type Source func() (io.ReadCloser, error)
+
+// TransferOptions bounds the concurrency and the memory used by an
+// IsolateServer client.
+//
+// Items are streamed: compression runs in its own stage that hands chunks to
+// the network stage. At most BufferedChunks chunks of ChunkSize bytes are
+// buffered per item; the compression stage blocks when the network stage
+// falls behind.
+type TransferOptions struct {
+	// CompressConcurrency is the maximum number of items compressed at once.
+	CompressConcurrency int
+	// ChunkSize is the size of the buffers passed between the stages.
+	ChunkSize int
+	// BufferedChunks is the number of chunks buffered per item.
+	BufferedChunks int
+	// Progress, if set, receives BytesSent and BytesReceived.
+	Progress Progress
+}
+
+// DefaultTransferOptions returns the options used by New.
+func DefaultTransferOptions() TransferOptions {
+	return TransferOptions{
+		CompressConcurrency: runtime.NumCPU(),
+		ChunkSize:           64 * 1024,
+		BufferedChunks:      4,
+	}
+}
+
+// errPipeClosed is returned to the writer of a chunkPipe after the reader
+// closed it.
+var errPipeClosed = errors.New("read side of the pipe was closed")
+
+// chunkPipe is an in-memory pipe buffering a bounded number of chunks.
+type chunkPipe struct {
+	chunkSize int
+	chunks    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// err is set by the writer before closing chunks.
+	err error
+	// cur is the unread part of the current chunk, only used by the reader.
+	cur []byte
+}
+
+func newChunkPipe(chunkSize, buffered int) *chunkPipe {
+	return &chunkPipe{
+		chunkSize: chunkSize,
+		chunks:    make(chan []byte, buffered),
+		done:      make(chan struct{}),
+	}
+}
+
+// Write sends a copy of p to the reader, blocking while the buffer is full.
+func (c *chunkPipe) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) != 0 {
+		n := len(p)
+		if n > c.chunkSize {
+			n = c.chunkSize
+		}
+		chunk := append([]byte(nil), p[:n]...)
+		select {
+		case c.chunks <- chunk:
+		case <-c.done:
+			return written, errPipeClosed
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// closeWrite signals the end of the stream. The reader gets err, or io.EOF if
+// err is nil, once the buffered chunks are consumed.
+func (c *chunkPipe) closeWrite(err error) {
+	if err == nil {
+		err = io.EOF
+	}
+	c.err = err
+	close(c.chunks)
+}
+
+func (c *chunkPipe) Read(p []byte) (int, error) {
+	for len(c.cur) == 0 {
+		chunk, ok := <-c.chunks
+		if !ok {
+			return 0, c.err
+		}
+		c.cur = chunk
+	}
+	n := copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+// Close stops the writer.
+func (c *chunkPipe) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// compressor runs the compression stage.
+type compressor struct {
+	opts TransferOptions
+	sem  common.Semaphore
+}
+
+func newCompressor(opts TransferOptions) *compressor {
+	if opts.CompressConcurrency <= 0 {
+		opts.CompressConcurrency = 1
+	}
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultTransferOptions().ChunkSize
+	}
+	if opts.BufferedChunks <= 0 {
+		opts.BufferedChunks = 1
+	}
+	return &compressor{opts: opts, sem: common.NewSemaphore(opts.CompressConcurrency)}
+}
+
+// compress returns a reader of the content of src compressed with algo.
+//
+// The compression is done concurrently with the reads; the caller must close
+// the returned reader.
+func (c *compressor) compress(ctx context.Context, algo string, src io.Reader) (io.ReadCloser, error) {
+	if algo != "flate" {
+		return nil, fmt.Errorf("unknown compression \"%s\"", algo)
+	}
+	p := newChunkPipe(c.opts.ChunkSize, c.opts.BufferedChunks)
+	go func() {
+		if err := c.sem.WaitContext(ctx); err != nil {
+			p.closeWrite(err)
+			return
+		}
+		defer c.sem.Signal()
+		w := bufio.NewWriterSize(p, c.opts.ChunkSize)
+		z := zlib.NewWriter(w)
+		_, err := io.Copy(z, &ctxReader{ctx, src})
+		if err == nil {
+			err = z.Close()
+		}
+		if err == nil {
+			err = w.Flush()
+		}
+		p.closeWrite(err)
+	}()
+	return p, nil
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// FetchToCache streams an item from the server into cache without buffering
+// it in memory; the decompression and the cache write run concurrently.
+func FetchToCache(ctx context.Context, client IsolateServer, cache LocalCache, digest HexDigest) error {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(client.Fetch(ctx, digest, w))
+	}()
+	err := cache.Write(ctx, digest, r)
+	// Unblock Fetch if Write failed early.
+	r.CloseWithError(errPipeClosed)
+	return err
+}
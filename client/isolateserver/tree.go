@@ -0,0 +1,184 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Values of Isolated.ReadOnly. They match isolate.ReadOnlyValue.
+const (
+	// Writeable means files and directories are writeable.
+	Writeable = 0
+	// FilesReadOnly means files are read-only but directories are writeable.
+	FilesReadOnly = 1
+	// DirsReadOnly means both files and directories are read-only.
+	DirsReadOnly = 2
+)
+
+// GetReadOnly returns the read-only mode of the tree; it is FilesReadOnly when
+// not specified.
+func (i *Isolated) GetReadOnly() int {
+	if i.ReadOnly == nil {
+		return FilesReadOnly
+	}
+	return *i.ReadOnly
+}
+
+// MapTree maps the files of an isolated tree from cache into outDir.
+//
+// When the tree is read-only, files are hardlinked from the cache and their
+// write bits are stripped. When it is writeable, files are copied so they can
+// be modified without corrupting the cache. When directories are read-only,
+// they are made read-only once populated; use RemoveTree to delete outDir.
+//
+// It stops at the first error or when ctx is canceled.
+func MapTree(ctx context.Context, cache LocalCache, isolated *Isolated, outDir string) error {
+	readOnly := isolated.GetReadOnly()
+	paths := make([]string, 0, len(isolated.Files))
+	for p := range isolated.Files {
+		paths = append(paths, p)
+	}
+	sort.Strings(paths)
+	for _, p := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := mapFile(ctx, cache, outDir, p, isolated.Files[p], readOnly); err != nil {
+			return err
+		}
+	}
+	if readOnly == DirsReadOnly {
+		return MakeDirsReadOnly(outDir)
+	}
+	return nil
+}
+
+// mapFile maps the file p of a tree from cache into outDir, creating its
+// parent directories.
+func mapFile(ctx context.Context, cache LocalCache, outDir, p string, f File, readOnly int) error {
+	dst, err := treePath(outDir, p)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if f.Link != nil {
+		return os.Symlink(*f.Link, dst)
+	}
+	mode := os.FileMode(0644)
+	if f.Mode != nil {
+		mode = os.FileMode(*f.Mode).Perm()
+	}
+	if readOnly == Writeable {
+		err = copyFromCache(ctx, cache, f.Digest, dst, mode)
+	} else {
+		err = cache.Hardlink(ctx, f.Digest, dst, mode&^0222)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to map %s: %s", p, err)
+	}
+	return nil
+}
+
+// MakeDirsReadOnly removes the write bits of root and all the directories
+// below it.
+func MakeDirsReadOnly(root string) error {
+	var dirs []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			dirs = append(dirs, path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	// Process the deepest directories first; Walk is lexical so reversing is
+	// enough.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		info, err := os.Stat(dirs[i])
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(dirs[i], info.Mode().Perm()&^0222); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MakeTreeWritable adds back the user write bit to root and everything below
+// it, undoing MapTree and MakeDirsReadOnly.
+func MakeTreeWritable(root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return nil
+		}
+		perm := info.Mode().Perm() | 0200
+		if info.IsDir() {
+			// Directories must also be listable to be walked.
+			perm |= 0500
+		}
+		if perm != info.Mode().Perm() {
+			return os.Chmod(path, perm)
+		}
+		return nil
+	})
+}
+
+// RemoveTree deletes root and everything below it, even if it was made
+// read-only.
+func RemoveTree(root string) error {
+	if err := MakeTreeWritable(root); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.RemoveAll(root)
+}
+
+// treePath returns the native path of the .isolated relative path p inside
+// root. It refuses paths escaping root.
+func treePath(root, p string) (string, error) {
+	native := filepath.FromSlash(p)
+	if filepath.IsAbs(native) {
+		return "", fmt.Errorf("invalid absolute path %s", p)
+	}
+	cleaned := filepath.Clean(native)
+	if cleaned == ".." || strings.HasPrefix(cleaned, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("path %s escapes the tree", p)
+	}
+	return filepath.Join(root, cleaned), nil
+}
+
+// copyFromCache writes a copy of a cached item to dest.
+func copyFromCache(ctx context.Context, cache LocalCache, digest HexDigest, dest string, perm os.FileMode) error {
+	src, err := cache.Read(ctx, digest)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	f, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, src); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,77 @@
+// Copyright 2015 The Chromium Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style license that can be
+// found in the LICENSE file.
+
+package isolateserver
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/maruel/ut"
+)
+
+func makeTestTree(t *testing.T, readOnly int) (LocalCache, *Isolated) {
+	cache := MakeMemoryCache(sha1.New)
+	isolated := NewIsolated()
+	isolated.ReadOnly = &readOnly
+	for _, p := range []string{"a", "b/c", "b/d/e"} {
+		content := []byte(p)
+		digest := Hash(sha1.New(), content)
+		ut.AssertEqual(t, nil, cache.Write(context.Background(), digest, bytes.NewBuffer(content)))
+		mode := 0640
+		size := int64(len(content))
+		isolated.Files[p] = File{Digest: digest, Mode: &mode, Size: &size}
+	}
+	return cache, isolated
+}
+
+func TestMapTreeWriteable(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+
+	cache, isolated := makeTestTree(t, Writeable)
+	ut.AssertEqual(t, nil, MapTree(context.Background(), cache, isolated, td))
+	content, err := ioutil.ReadFile(filepath.Join(td, "b", "d", "e"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, []byte("b/d/e"), content)
+	info, err := os.Stat(filepath.Join(td, "b", "c"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+func TestMapTreeDirsReadOnly(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+
+	cache, isolated := makeTestTree(t, DirsReadOnly)
+	out := filepath.Join(td, "out")
+	ut.AssertEqual(t, nil, MapTree(context.Background(), cache, isolated, out))
+	info, err := os.Stat(filepath.Join(out, "b", "c"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, os.FileMode(0440), info.Mode().Perm())
+	info, err = os.Stat(filepath.Join(out, "b", "d"))
+	ut.AssertEqual(t, nil, err)
+	ut.AssertEqual(t, os.FileMode(0), info.Mode().Perm()&0222)
+
+	ut.AssertEqual(t, nil, RemoveTree(out))
+	_, err = os.Stat(out)
+	ut.AssertEqual(t, true, os.IsNotExist(err))
+}
+
+func TestMapTreeEscape(t *testing.T) {
+	td, err := ioutil.TempDir("", "isolateserver")
+	ut.AssertEqual(t, nil, err)
+	defer RemoveTree(td)
+
+	cache, isolated := makeTestTree(t, FilesReadOnly)
+	isolated.Files["../evil"] = isolated.Files["a"]
+	ut.AssertEqual(t, true, MapTree(context.Background(), cache, isolated, filepath.Join(td, "out")) != nil)
+}
@@ -5,9 +5,11 @@
 package isolateserver
 
 import (
+	"context"
 	"encoding/hex"
 	"encoding/json"
 	"hash"
+	"io"
 	"strconv"
 )
 
@@ -57,3 +59,16 @@ func (i *Int) UnmarshalJSON(p []byte) error {
 	*i = Int(v)
 	return nil
 }
+
+// ctxReader is an io.Reader that fails once its context is canceled.
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *ctxReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
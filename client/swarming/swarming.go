@@ -5,7 +5,9 @@
 package swarming
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -22,27 +24,43 @@ type Swarming struct {
 	client *http.Client
 }
 
-func (s *Swarming) getJSON(resource string, v interface{}) error {
+// ErrNotFound is returned when the requested entity doesn't exist on the
+// server.
+var ErrNotFound = errors.New("not found")
+
+func (s *Swarming) getJSON(ctx context.Context, resource string, v interface{}) error {
 	if len(resource) == 0 || resource[0] != '/' {
 		return errors.New("resource must start with '/'")
 	}
-	status, err := common.GetJSON(s.client, s.host+resource, v)
-	if status == http.StatusNotFound {
-		return errors.New("not found")
+	_, err := common.GetJSONWithRetry(ctx, s.client, common.DefaultRetryPolicy, s.host+resource, v)
+	switch {
+	case common.IsNotFound(err):
+		return ErrNotFound
+	case common.IsAuthError(err):
+		return fmt.Errorf("access denied, use the login subcommand or -service-account-json: %w", err)
+	case common.IsServerError(err):
+		return fmt.Errorf("server error: %w", err)
 	}
 	return err
 }
 
-// NewSwarming returns a new Swarming client.
-func New(host string) (*Swarming, error) {
+// New returns a new Swarming client.
+//
+// c is used for the requests to the server; it is http.DefaultClient if nil.
+func New(c *http.Client, host string) (*Swarming, error) {
+	if c == nil {
+		c = http.DefaultClient
+	}
 	host = strings.TrimRight(host, "/")
-	return &Swarming{host, http.DefaultClient}, nil
+	return &Swarming{host, c}, nil
 }
 
 // FetchRequest returns the TaskRequest.
-func (s *Swarming) FetchRequest(id TaskID) (*TaskRequest, error) {
+//
+// The request is aborted when ctx is canceled.
+func (s *Swarming) FetchRequest(ctx context.Context, id TaskID) (*TaskRequest, error) {
 	out := &TaskRequest{}
-	err := s.getJSON("/swarming/api/v1/client/task/"+string(id)+"/request", out)
+	err := s.getJSON(ctx, "/swarming/api/v1/client/task/"+string(id)+"/request", out)
 	return out, err
 }
 
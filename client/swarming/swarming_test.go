@@ -5,14 +5,45 @@
 package swarming
 
 import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 
+	"github.com/luci/luci-go/client/internal/common"
 	"github.com/maruel/ut"
 )
 
 func TestNew(t *testing.T) {
 	t.Parallel()
 	// TODO(maruel): Make a fake.
-	_, err := New("https://localhost:1")
+	_, err := New(nil, "https://localhost:1")
 	ut.AssertEqual(t, nil, err)
 }
+
+func TestFetchRequestNotFound(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	_, err = s.FetchRequest(context.Background(), "1234")
+	ut.AssertEqual(t, ErrNotFound, err)
+}
+
+func TestFetchRequestAccessDenied(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "go away", http.StatusForbidden)
+	}))
+	defer ts.Close()
+	s, err := New(nil, ts.URL)
+	ut.AssertEqual(t, nil, err)
+	_, err = s.FetchRequest(context.Background(), "1234")
+	ut.AssertEqual(t, true, common.IsAuthError(err))
+	var apiErr *common.APIError
+	ut.AssertEqual(t, true, errors.As(err, &apiErr))
+	ut.AssertEqual(t, http.StatusForbidden, apiErr.StatusCode)
+	ut.AssertEqual(t, "go away", apiErr.Body)
+}